@@ -0,0 +1,892 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/repository"
+)
+
+// MemoryRepository keeps everything in memory. It is meant for tests and for
+// trying the API out without a database, and behaves like
+// PostgresRepository down to the errors it returns.
+type MemoryRepository struct {
+	mu          sync.Mutex
+	users       map[string]*models.User
+	tokens      map[string]*memoryToken
+	posts       map[string]*models.Post
+	revisions   map[string][]*models.PostRevision
+	follows     map[string]map[string]bool
+	attachments map[string]*models.Attachment
+	logins      map[string]*models.LoginFailures
+	totps       map[string]*models.TOTP
+	// recoveryCodes maps the hash of every recovery code to its user, and
+	// forgets codes once used.
+	recoveryCodes map[string]string
+	accessTokens  map[string]*models.AccessToken
+	closed        bool
+}
+
+type memoryToken struct {
+	models.UserToken
+	used bool
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		users:       make(map[string]*models.User),
+		tokens:      make(map[string]*memoryToken),
+		posts:       make(map[string]*models.Post),
+		revisions:   make(map[string][]*models.PostRevision),
+		follows:     make(map[string]map[string]bool),
+		attachments: make(map[string]*models.Attachment),
+		logins:      make(map[string]*models.LoginFailures),
+		totps:       make(map[string]*models.TOTP),
+
+		recoveryCodes: make(map[string]string),
+		accessTokens:  make(map[string]*models.AccessToken),
+	}
+}
+
+func now() time.Time {
+	return time.Now().UTC()
+}
+
+// copyUser returns a copy of user that callers may keep, without the
+// password hash unless withPassword is set.
+func copyUser(user *models.User, withPassword bool) *models.User {
+	c := *user
+	if !withPassword {
+		c.Password = ""
+	}
+	return &c
+}
+
+func copyPost(post *models.Post) *models.Post {
+	c := *post
+	return &c
+}
+
+func copyAttachment(attachment *models.Attachment) *models.Attachment {
+	c := *attachment
+	return &c
+}
+
+func (repo *MemoryRepository) InsertUser(ctx context.Context, user *models.User) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	for _, u := range repo.users {
+		if strings.EqualFold(u.Email, user.Email) {
+			return &repository.ConflictError{Field: "email"}
+		}
+	}
+	if _, ok := repo.users[user.ID]; ok {
+		return &repository.ConflictError{Field: "id"}
+	}
+	user.CreatedAt = now()
+	repo.users[user.ID] = copyUser(user, true)
+	return nil
+}
+
+func (repo *MemoryRepository) GetUserById(ctx context.Context, id string) (*models.User, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	user, ok := repo.users[id]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	return copyUser(user, false), nil
+}
+
+func (repo *MemoryRepository) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	for _, user := range repo.users {
+		if strings.EqualFold(user.Email, email) {
+			return copyUser(user, true), nil
+		}
+	}
+	return nil, repository.ErrNotFound
+}
+
+func (repo *MemoryRepository) GetUserByHandle(ctx context.Context, handle string) (*models.User, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if handle != "" {
+		for _, user := range repo.users {
+			if user.Handle == handle {
+				return copyUser(user, false), nil
+			}
+		}
+	}
+	return nil, repository.ErrNotFound
+}
+
+func (repo *MemoryRepository) UpdateUserProfile(ctx context.Context, user *models.User) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	stored, ok := repo.users[user.ID]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	if user.Handle != "" {
+		for _, u := range repo.users {
+			if u.ID != user.ID && u.Handle == user.Handle {
+				return &repository.ConflictError{Field: "handle"}
+			}
+		}
+	}
+	stored.Handle = user.Handle
+	stored.DisplayName = user.DisplayName
+	stored.Bio = user.Bio
+	*user = *copyUser(stored, false)
+	return nil
+}
+
+func (repo *MemoryRepository) SetUserAvatar(ctx context.Context, userId string, avatar *models.Attachment) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	user, ok := repo.users[userId]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	if err := repo.insertAttachment(avatar); err != nil {
+		return err
+	}
+	user.AvatarId = avatar.Id
+	return nil
+}
+
+func (repo *MemoryRepository) MarkEmailVerified(ctx context.Context, userId string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	user, ok := repo.users[userId]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	if user.EmailVerifiedAt == nil {
+		verifiedAt := now()
+		user.EmailVerifiedAt = &verifiedAt
+	}
+	return nil
+}
+
+func (repo *MemoryRepository) UpdateUserPassword(ctx context.Context, userId string, password string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	user, ok := repo.users[userId]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	user.Password = password
+	return nil
+}
+
+func (repo *MemoryRepository) InsertUserToken(ctx context.Context, token *models.UserToken, ttl time.Duration) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if _, ok := repo.users[token.UserId]; !ok {
+		return repository.ErrNotFound
+	}
+	if _, ok := repo.tokens[token.TokenHash]; ok {
+		return &repository.ConflictError{Field: "token"}
+	}
+	token.ExpiresAt = now().Add(ttl)
+	repo.tokens[token.TokenHash] = &memoryToken{UserToken: *token}
+	return nil
+}
+
+func (repo *MemoryRepository) ConsumeUserToken(ctx context.Context, tokenHash string, purpose string) (*models.UserToken, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	token, ok := repo.tokens[tokenHash]
+	if !ok || token.Purpose != purpose || token.used || !token.ExpiresAt.After(now()) {
+		return nil, repository.ErrNotFound
+	}
+	token.used = true
+	c := token.UserToken
+	return &c, nil
+}
+
+func (repo *MemoryRepository) InsertPost(ctx context.Context, post *models.Post) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if _, ok := repo.users[post.UserId]; !ok {
+		return repository.ErrNotFound
+	}
+	if _, ok := repo.posts[post.Id]; ok {
+		return &repository.ConflictError{Field: "id"}
+	}
+	post.CreatedAt = now()
+	post.UpdatedAt = post.CreatedAt
+	post.Revision = 1
+	post.DeletedAt = nil
+	repo.posts[post.Id] = copyPost(post)
+	repo.insertPostRevision(post)
+	return nil
+}
+
+func (repo *MemoryRepository) insertPostRevision(post *models.Post) {
+	repo.revisions[post.Id] = append(repo.revisions[post.Id], &models.PostRevision{
+		PostId:      post.Id,
+		Revision:    post.Revision,
+		PostContent: post.PostContent,
+		EditorId:    post.UserId,
+		CreatedAt:   post.UpdatedAt,
+	})
+}
+
+func (repo *MemoryRepository) GetPostById(ctx context.Context, id string) (*models.Post, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	post, ok := repo.posts[id]
+	if !ok || post.DeletedAt != nil {
+		return nil, repository.ErrNotFound
+	}
+	return copyPost(post), nil
+}
+
+// ownPost returns the live post behind post.Id if post.UserId owns it and,
+// when post.Revision is set, it is still at that revision.
+func (repo *MemoryRepository) ownPost(post *models.Post) (*models.Post, error) {
+	stored, ok := repo.posts[post.Id]
+	if !ok || stored.UserId != post.UserId || stored.DeletedAt != nil {
+		return nil, repository.ErrNotFound
+	}
+	if post.Revision != 0 && stored.Revision != post.Revision {
+		return nil, repository.ErrVersionMismatch
+	}
+	return stored, nil
+}
+
+func (repo *MemoryRepository) UpdatePost(ctx context.Context, post *models.Post) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	stored, err := repo.ownPost(post)
+	if err != nil {
+		return err
+	}
+	stored.PostContent = post.PostContent
+	if post.Visibility != "" {
+		stored.Visibility = post.Visibility
+	}
+	stored.UpdatedAt = now()
+	stored.Revision++
+	*post = *copyPost(stored)
+	repo.insertPostRevision(post)
+	return nil
+}
+
+func (repo *MemoryRepository) DeletePost(ctx context.Context, post *models.Post) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	stored, err := repo.ownPost(post)
+	if err != nil {
+		return err
+	}
+	deletedAt := now()
+	stored.DeletedAt = &deletedAt
+	return nil
+}
+
+// listPosts returns up to limit posts matching keep with an id greater than
+// after, in id order.
+func (repo *MemoryRepository) listPosts(limit uint64, after string, keep func(*models.Post) bool) []*models.Post {
+	var posts []*models.Post
+	for _, post := range repo.posts {
+		if post.Id > after && keep(post) {
+			posts = append(posts, post)
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool { return posts[i].Id < posts[j].Id })
+	if uint64(len(posts)) > limit {
+		posts = posts[:limit]
+	}
+	for i, post := range posts {
+		posts[i] = copyPost(post)
+	}
+	return posts
+}
+
+// visible mirrors visiblePosts.
+func (repo *MemoryRepository) visible(post *models.Post, viewerId string) bool {
+	switch {
+	case post.Visibility == models.PostVisibilityPublic, post.UserId == viewerId:
+		return true
+	case post.Visibility == models.PostVisibilityFollowers:
+		return repo.follows[viewerId][post.UserId]
+	}
+	return false
+}
+
+func (repo *MemoryRepository) ListPosts(ctx context.Context, viewerId string, limit uint64, after string) ([]*models.Post, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	return repo.listPosts(limit, after, func(post *models.Post) bool {
+		return post.Status == models.PostStatusPublished && post.DeletedAt == nil && repo.visible(post, viewerId)
+	}), nil
+}
+
+func (repo *MemoryRepository) ListPostsByUser(ctx context.Context, viewerId string, userId string, limit uint64, after string) ([]*models.Post, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	return repo.listPosts(limit, after, func(post *models.Post) bool {
+		return post.UserId == userId && post.Status == models.PostStatusPublished && post.DeletedAt == nil && repo.visible(post, viewerId)
+	}), nil
+}
+
+func (repo *MemoryRepository) GetPostRevision(ctx context.Context, postId string, revision int) (*models.PostRevision, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	for _, rev := range repo.revisions[postId] {
+		if rev.Revision == revision {
+			c := *rev
+			return &c, nil
+		}
+	}
+	return nil, repository.ErrNotFound
+}
+
+func (repo *MemoryRepository) ListPostRevisions(ctx context.Context, postId string) ([]*models.PostRevision, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	var revisions []*models.PostRevision
+	stored := repo.revisions[postId]
+	for i := len(stored) - 1; i >= 0; i-- {
+		c := *stored[i]
+		revisions = append(revisions, &c)
+	}
+	return revisions, nil
+}
+
+func (repo *MemoryRepository) ListDeletedPosts(ctx context.Context, userId string, limit uint64, after string) ([]*models.Post, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	return repo.listPosts(limit, after, func(post *models.Post) bool {
+		return post.UserId == userId && post.DeletedAt != nil
+	}), nil
+}
+
+func (repo *MemoryRepository) RestorePost(ctx context.Context, post *models.Post) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	stored, ok := repo.posts[post.Id]
+	if !ok || stored.UserId != post.UserId || stored.DeletedAt == nil {
+		return repository.ErrNotFound
+	}
+	stored.DeletedAt = nil
+	*post = *copyPost(stored)
+	return nil
+}
+
+func (repo *MemoryRepository) PurgeDeletedPosts(ctx context.Context, olderThan time.Duration) (int64, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	cutoff := now().Add(-olderThan)
+	var purged int64
+	for id, post := range repo.posts {
+		if post.DeletedAt == nil || !post.DeletedAt.Before(cutoff) {
+			continue
+		}
+		delete(repo.posts, id)
+		delete(repo.revisions, id)
+		for _, attachment := range repo.attachments {
+			if attachment.PostId == id {
+				attachment.PostId = ""
+			}
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func (repo *MemoryRepository) ListUnpublishedPosts(ctx context.Context, userId string, limit uint64, after string) ([]*models.Post, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	return repo.listPosts(limit, after, func(post *models.Post) bool {
+		return post.UserId == userId && post.Status != models.PostStatusPublished && post.DeletedAt == nil
+	}), nil
+}
+
+func (repo *MemoryRepository) SetPostStatus(ctx context.Context, post *models.Post) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	stored, ok := repo.posts[post.Id]
+	if !ok || stored.UserId != post.UserId || stored.Status == models.PostStatusPublished || stored.DeletedAt != nil {
+		return repository.ErrNotFound
+	}
+	stored.Status = post.Status
+	stored.PublishAt = post.PublishAt
+	*post = *copyPost(stored)
+	return nil
+}
+
+func (repo *MemoryRepository) PublishDuePosts(ctx context.Context, limit uint64) ([]*models.Post, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	t := now()
+	var due []*models.Post
+	for _, post := range repo.posts {
+		if post.Status == models.PostStatusScheduled && post.PublishAt != nil && !post.PublishAt.After(t) && post.DeletedAt == nil {
+			due = append(due, post)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].PublishAt.Before(*due[j].PublishAt) })
+	if uint64(len(due)) > limit {
+		due = due[:limit]
+	}
+	var posts []*models.Post
+	for _, post := range due {
+		post.Status = models.PostStatusPublished
+		posts = append(posts, copyPost(post))
+	}
+	return posts, nil
+}
+
+func (repo *MemoryRepository) FollowUser(ctx context.Context, followerId string, followeeId string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	_, followerExists := repo.users[followerId]
+	_, followeeExists := repo.users[followeeId]
+	if !followerExists || !followeeExists {
+		return repository.ErrNotFound
+	}
+	if repo.follows[followerId] == nil {
+		repo.follows[followerId] = make(map[string]bool)
+	}
+	repo.follows[followerId][followeeId] = true
+	return nil
+}
+
+func (repo *MemoryRepository) UnfollowUser(ctx context.Context, followerId string, followeeId string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	delete(repo.follows[followerId], followeeId)
+	return nil
+}
+
+func (repo *MemoryRepository) IsFollowing(ctx context.Context, followerId string, followeeId string) (bool, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	return repo.follows[followerId][followeeId], nil
+}
+
+func (repo *MemoryRepository) ListFollowerIds(ctx context.Context, userId string) ([]string, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	var ids []string
+	for followerId, followees := range repo.follows {
+		if followees[userId] {
+			ids = append(ids, followerId)
+		}
+	}
+	return ids, nil
+}
+
+func (repo *MemoryRepository) InsertAttachment(ctx context.Context, attachment *models.Attachment) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	return repo.insertAttachment(attachment)
+}
+
+func (repo *MemoryRepository) insertAttachment(attachment *models.Attachment) error {
+	if _, ok := repo.users[attachment.UserId]; !ok {
+		return repository.ErrNotFound
+	}
+	if _, ok := repo.posts[attachment.PostId]; attachment.PostId != "" && !ok {
+		return repository.ErrNotFound
+	}
+	if _, ok := repo.attachments[attachment.Id]; ok {
+		return &repository.ConflictError{Field: "id"}
+	}
+	attachment.CreatedAt = now()
+	repo.attachments[attachment.Id] = copyAttachment(attachment)
+	return nil
+}
+
+func (repo *MemoryRepository) GetAttachmentById(ctx context.Context, id string) (*models.Attachment, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	attachment, ok := repo.attachments[id]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	return copyAttachment(attachment), nil
+}
+
+// listAttachments returns up to limit attachments matching keep, in id
+// order.
+func (repo *MemoryRepository) listAttachments(limit uint64, keep func(*models.Attachment) bool) []*models.Attachment {
+	var attachments []*models.Attachment
+	for _, attachment := range repo.attachments {
+		if keep(attachment) {
+			attachments = append(attachments, attachment)
+		}
+	}
+	sort.Slice(attachments, func(i, j int) bool { return attachments[i].Id < attachments[j].Id })
+	if uint64(len(attachments)) > limit {
+		attachments = attachments[:limit]
+	}
+	for i, attachment := range attachments {
+		attachments[i] = copyAttachment(attachment)
+	}
+	return attachments
+}
+
+func (repo *MemoryRepository) ListAttachments(ctx context.Context, postId string) ([]*models.Attachment, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	return repo.listAttachments(math.MaxUint64, func(attachment *models.Attachment) bool {
+		return postId != "" && attachment.PostId == postId
+	}), nil
+}
+
+func (repo *MemoryRepository) ListOrphanedAttachments(ctx context.Context, limit uint64) ([]*models.Attachment, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	avatars := make(map[string]bool)
+	for _, user := range repo.users {
+		avatars[user.AvatarId] = true
+	}
+	return repo.listAttachments(limit, func(attachment *models.Attachment) bool {
+		return attachment.PostId == "" && !avatars[attachment.Id]
+	}), nil
+}
+
+func (repo *MemoryRepository) DeleteAttachment(ctx context.Context, attachment *models.Attachment) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if _, ok := repo.attachments[attachment.Id]; !ok {
+		return repository.ErrNotFound
+	}
+	delete(repo.attachments, attachment.Id)
+	return nil
+}
+
+func copyLoginFailures(failures *models.LoginFailures) *models.LoginFailures {
+	c := *failures
+	if failures.LockedUntil != nil {
+		until := *failures.LockedUntil
+		c.LockedUntil = &until
+	}
+	return &c
+}
+
+func (repo *MemoryRepository) GetLoginFailures(ctx context.Context, key string) (*models.LoginFailures, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	failures, ok := repo.logins[key]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	return copyLoginFailures(failures), nil
+}
+
+func (repo *MemoryRepository) RecordLoginFailure(ctx context.Context, key string, window time.Duration) (*models.LoginFailures, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	t := now()
+	failures, ok := repo.logins[key]
+	if !ok {
+		failures = &models.LoginFailures{Key: key}
+		repo.logins[key] = failures
+	}
+	if !failures.FirstFailedAt.After(t.Add(-window)) {
+		failures.Failures = 0
+		failures.FirstFailedAt = t
+	}
+	failures.Failures++
+	failures.LastFailedAt = t
+	return copyLoginFailures(failures), nil
+}
+
+func (repo *MemoryRepository) LockLogin(ctx context.Context, key string, lockout time.Duration) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	failures, ok := repo.logins[key]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	until := now().Add(lockout)
+	failures.LockedUntil = &until
+	return nil
+}
+
+func (repo *MemoryRepository) ClearLoginFailures(ctx context.Context, key string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	delete(repo.logins, key)
+	return nil
+}
+
+func (repo *MemoryRepository) PurgeLoginFailures(ctx context.Context, olderThan time.Duration) (int64, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	cutoff := now().Add(-olderThan)
+	var n int64
+	for key, failures := range repo.logins {
+		if failures.LastFailedAt.Before(cutoff) && (failures.LockedUntil == nil || failures.LockedUntil.Before(cutoff)) {
+			delete(repo.logins, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (repo *MemoryRepository) SetUserTOTP(ctx context.Context, totp *models.TOTP) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if _, ok := repo.users[totp.UserId]; !ok {
+		return repository.ErrNotFound
+	}
+	repo.deleteRecoveryCodes(totp.UserId)
+	totp.EnabledAt = nil
+	totp.LastStep = 0
+	c := *totp
+	repo.totps[totp.UserId] = &c
+	return nil
+}
+
+func (repo *MemoryRepository) GetUserTOTP(ctx context.Context, userId string) (*models.TOTP, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	totp, ok := repo.totps[userId]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	c := *totp
+	return &c, nil
+}
+
+func (repo *MemoryRepository) EnableUserTOTP(ctx context.Context, userId string, recoveryCodeHashes []string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	totp, ok := repo.totps[userId]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	for _, hash := range recoveryCodeHashes {
+		if owner, ok := repo.recoveryCodes[hash]; ok && owner != userId {
+			return &repository.ConflictError{Field: "recovery_code"}
+		}
+	}
+	repo.deleteRecoveryCodes(userId)
+	for _, hash := range recoveryCodeHashes {
+		repo.recoveryCodes[hash] = userId
+	}
+	enabledAt := now()
+	totp.EnabledAt = &enabledAt
+	return nil
+}
+
+func (repo *MemoryRepository) UseTOTPStep(ctx context.Context, userId string, step int64) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	totp, ok := repo.totps[userId]
+	if !ok || step <= totp.LastStep {
+		return repository.ErrNotFound
+	}
+	totp.LastStep = step
+	return nil
+}
+
+func (repo *MemoryRepository) DeleteUserTOTP(ctx context.Context, userId string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if _, ok := repo.totps[userId]; !ok {
+		return repository.ErrNotFound
+	}
+	delete(repo.totps, userId)
+	repo.deleteRecoveryCodes(userId)
+	return nil
+}
+
+func (repo *MemoryRepository) ConsumeRecoveryCode(ctx context.Context, userId string, codeHash string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if owner, ok := repo.recoveryCodes[codeHash]; !ok || owner != userId {
+		return repository.ErrNotFound
+	}
+	delete(repo.recoveryCodes, codeHash)
+	return nil
+}
+
+func (repo *MemoryRepository) CountRecoveryCodes(ctx context.Context, userId string) (int, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if _, ok := repo.totps[userId]; !ok {
+		return 0, repository.ErrNotFound
+	}
+	n := 0
+	for _, owner := range repo.recoveryCodes {
+		if owner == userId {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (repo *MemoryRepository) deleteRecoveryCodes(userId string) {
+	for hash, owner := range repo.recoveryCodes {
+		if owner == userId {
+			delete(repo.recoveryCodes, hash)
+		}
+	}
+}
+
+func copyAccessToken(token *models.AccessToken) *models.AccessToken {
+	c := *token
+	c.Scopes = append([]string(nil), token.Scopes...)
+	if token.LastUsedAt != nil {
+		usedAt := *token.LastUsedAt
+		c.LastUsedAt = &usedAt
+	}
+	return &c
+}
+
+func (repo *MemoryRepository) InsertAccessToken(ctx context.Context, token *models.AccessToken, ttl time.Duration) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if _, ok := repo.users[token.UserId]; !ok {
+		return repository.ErrNotFound
+	}
+	for _, other := range repo.accessTokens {
+		if other.Id == token.Id {
+			return &repository.ConflictError{Field: "id"}
+		}
+		if other.TokenHash == token.TokenHash {
+			return &repository.ConflictError{Field: "token"}
+		}
+	}
+	token.CreatedAt = now()
+	token.ExpiresAt = token.CreatedAt.Add(ttl)
+	token.LastUsedAt = nil
+	repo.accessTokens[token.Id] = copyAccessToken(token)
+	return nil
+}
+
+func (repo *MemoryRepository) GetAccessTokenByHash(ctx context.Context, tokenHash string) (*models.AccessToken, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	for _, token := range repo.accessTokens {
+		if token.TokenHash == tokenHash && token.ExpiresAt.After(now()) {
+			return copyAccessToken(token), nil
+		}
+	}
+	return nil, repository.ErrNotFound
+}
+
+func (repo *MemoryRepository) ListAccessTokens(ctx context.Context, userId string) ([]*models.AccessToken, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	tokens := []*models.AccessToken{}
+	for _, token := range repo.accessTokens {
+		if token.UserId == userId {
+			tokens = append(tokens, copyAccessToken(token))
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].CreatedAt.Equal(tokens[j].CreatedAt) {
+			return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+		}
+		return tokens[i].Id < tokens[j].Id
+	})
+	return tokens, nil
+}
+
+func (repo *MemoryRepository) MarkAccessTokenUsed(ctx context.Context, id string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	token, ok := repo.accessTokens[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	usedAt := now()
+	token.LastUsedAt = &usedAt
+	return nil
+}
+
+func (repo *MemoryRepository) DeleteAccessToken(ctx context.Context, userId string, id string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if token, ok := repo.accessTokens[id]; !ok || token.UserId != userId {
+		return repository.ErrNotFound
+	}
+	delete(repo.accessTokens, id)
+	return nil
+}
+
+// Ping fails once the repository is closed, like a closed database would.
+func (repo *MemoryRepository) Ping(ctx context.Context) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if repo.closed {
+		return errors.New("memory repository is closed")
+	}
+	return nil
+}
+
+func (repo *MemoryRepository) Close() error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	repo.closed = true
+	return nil
+}
@@ -0,0 +1,14 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/bocanada/rest-ws/repository"
+	"github.com/bocanada/rest-ws/repository/repositorytest"
+)
+
+func TestMemoryRepository(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.Repository {
+		return NewMemoryRepository()
+	})
+}
@@ -3,10 +3,57 @@ package database
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/repository"
+	"github.com/lib/pq"
 )
 
+const postColumns = "id, post_content, user_id, created_at, updated_at, revision, deleted_at, status, publish_at, visibility"
+
+// visiblePosts restricts a posts query to what the viewer bound to $1 may
+// read: public posts, their own posts and followers-only posts of the users
+// they follow.
+const visiblePosts = "(visibility = 'public' OR user_id = $1 OR (visibility = 'followers' AND EXISTS (SELECT 1 FROM follows WHERE follower_id = $1 AND followee_id = posts.user_id)))"
+
+const userColumns = "id, email, COALESCE(handle, ''), display_name, bio, COALESCE(avatar_id, ''), created_at, email_verified_at"
+
+const loginFailureColumns = "key, failures, first_failed_at, last_failed_at, locked_until"
+
+const accessTokenColumns = "id, user_id, name, token_hash, scopes, expires_at, last_used_at, created_at"
+
+// attachmentColumns reads post_id as an empty string for avatars and for
+// attachments whose post has been purged.
+const attachmentColumns = "id, COALESCE(post_id, ''), user_id, file_name, content_type, size, storage_key, created_at"
+
+// uniqueFields names the field behind each unique constraint of the schema.
+var uniqueFields = map[string]string{
+	"users_pkey":                   "id",
+	"users_email_key":              "email",
+	"users_handle_key":             "handle",
+	"user_tokens_pkey":             "token",
+	"recovery_codes_pkey":          "recovery_code",
+	"posts_pkey":                   "id",
+	"attachments_pkey":             "id",
+	"access_tokens_pkey":           "id",
+	"access_tokens_token_hash_key": "token",
+}
+
+// schemaRelations are the tables and indexes of up.sql; Ping fails while
+// any of them is missing.
+var schemaRelations = []string{
+	"users", "users_email_key", "posts", "post_revisions", "follows", "attachments", "user_tokens", "login_failures", "user_totp", "recovery_codes",
+	"access_tokens", "rate_limits",
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
 type PostgresRepository struct {
 	db *sql.DB
 }
@@ -19,82 +66,587 @@ func NewPostgresRepository(url string) (*PostgresRepository, error) {
 	return &PostgresRepository{db}, nil
 }
 
+// ConfigurePool sizes the connection pool, with the semantics of the
+// sql.DB setters of the same names.
+func (repo *PostgresRepository) ConfigurePool(maxOpen int, maxIdle int, maxLifetime time.Duration) {
+	repo.db.SetMaxOpenConns(maxOpen)
+	repo.db.SetMaxIdleConns(maxIdle)
+	repo.db.SetConnMaxLifetime(maxLifetime)
+}
+
 func (repo *PostgresRepository) InsertUser(ctx context.Context, user *models.User) error {
 	_, err := repo.db.ExecContext(ctx, "INSERT INTO users (id, email, password) VALUES ($1, $2, $3)", user.ID, user.Email, user.Password)
-	return err
+	return constraintError(err)
 }
 
 func (repo *PostgresRepository) GetUserById(ctx context.Context, id string) (*models.User, error) {
-	rows, err := repo.db.QueryContext(ctx, "SELECT id, email FROM users WHERE id = $1", id)
+	row := repo.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1", id)
+	var user models.User
+	if err := scanUser(row, &user); err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+func (repo *PostgresRepository) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	row := repo.db.QueryRowContext(ctx, "SELECT "+userColumns+", password FROM users WHERE lower(email) = lower($1)", email)
+	var user models.User
+	if err := scanUser(row, &user, &user.Password); err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+func (repo *PostgresRepository) GetUserByHandle(ctx context.Context, handle string) (*models.User, error) {
+	row := repo.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE handle = $1", handle)
+	var user models.User
+	if err := scanUser(row, &user); err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+func (repo *PostgresRepository) UpdateUserProfile(ctx context.Context, user *models.User) error {
+	row := repo.db.QueryRowContext(ctx,
+		"UPDATE users SET handle = NULLIF($1, ''), display_name = $2, bio = $3 WHERE id = $4 RETURNING "+userColumns,
+		user.Handle,
+		user.DisplayName,
+		user.Bio,
+		user.ID)
+	return constraintError(notFound(scanUser(row, user)))
+}
+
+func (repo *PostgresRepository) SetUserAvatar(ctx context.Context, userId string, avatar *models.Attachment) error {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = insertAttachment(ctx, tx, avatar); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, "UPDATE users SET avatar_id = $1 WHERE id = $2", avatar.Id, userId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return repository.ErrNotFound
+	}
+	return tx.Commit()
+}
+
+func (repo *PostgresRepository) MarkEmailVerified(ctx context.Context, userId string) error {
+	res, err := repo.db.ExecContext(ctx, "UPDATE users SET email_verified_at = COALESCE(email_verified_at, NOW()) WHERE id = $1", userId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return repository.ErrNotFound
+	}
+	return nil
+}
+
+func (repo *PostgresRepository) UpdateUserPassword(ctx context.Context, userId string, password string) error {
+	res, err := repo.db.ExecContext(ctx, "UPDATE users SET password = $1 WHERE id = $2", password, userId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return repository.ErrNotFound
+	}
+	return nil
+}
+
+func (repo *PostgresRepository) InsertUserToken(ctx context.Context, token *models.UserToken, ttl time.Duration) error {
+	row := repo.db.QueryRowContext(ctx,
+		"INSERT INTO user_tokens (token_hash, user_id, purpose, expires_at) VALUES ($1, $2, $3, NOW() + make_interval(secs => $4)) RETURNING expires_at",
+		token.TokenHash,
+		token.UserId,
+		token.Purpose,
+		ttl.Seconds())
+	return constraintError(row.Scan(&token.ExpiresAt))
+}
+
+func (repo *PostgresRepository) ConsumeUserToken(ctx context.Context, tokenHash string, purpose string) (*models.UserToken, error) {
+	var token models.UserToken
+	err := repo.db.QueryRowContext(ctx,
+		"UPDATE user_tokens SET used_at = NOW() WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW() RETURNING token_hash, user_id, purpose, expires_at",
+		tokenHash,
+		purpose).Scan(&token.TokenHash, &token.UserId, &token.Purpose, &token.ExpiresAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &token, nil
+}
+
+// notFound maps sql.ErrNoRows to repository.ErrNotFound, so callers never
+// depend on the driver.
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return repository.ErrNotFound
+	}
+	return err
+}
+
+// constraintError turns a unique constraint violation into a
+// repository.ConflictError and a foreign key violation, which means a
+// referenced record is missing, into repository.ErrNotFound. Any other
+// error is returned unchanged.
+func constraintError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+	switch pqErr.Code {
+	case "23505":
+		field, ok := uniqueFields[pqErr.Constraint]
+		if !ok {
+			field = pqErr.Constraint
+		}
+		return &repository.ConflictError{Field: field}
+	case "23503":
+		return repository.ErrNotFound
+	}
+	return err
+}
+
+func scanUser(row scanner, user *models.User, extra ...any) error {
+	dest := []any{&user.ID, &user.Email, &user.Handle, &user.DisplayName, &user.Bio, &user.AvatarId, &user.CreatedAt, &user.EmailVerifiedAt}
+	return row.Scan(append(dest, extra...)...)
+}
+
+func (repo *PostgresRepository) InsertPost(ctx context.Context, post *models.Post) error {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, "INSERT INTO posts (id, post_content, user_id, status, publish_at, visibility) VALUES ($1, $2, $3, $4, $5, $6) RETURNING "+postColumns,
+		post.Id,
+		post.PostContent,
+		post.UserId,
+		post.Status,
+		post.PublishAt,
+		post.Visibility)
+	err = scanPost(row, post)
+	if err != nil {
+		return constraintError(err)
+	}
+	if err = insertPostRevision(ctx, tx, post); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (repo *PostgresRepository) GetPostById(ctx context.Context, id string) (*models.Post, error) {
+	row := repo.db.QueryRowContext(ctx, "SELECT "+postColumns+" FROM posts WHERE id = $1 AND deleted_at IS NULL", id)
+	var post models.Post
+	if err := scanPost(row, &post); err != nil {
+		return nil, notFound(err)
+	}
+	return &post, nil
+}
+
+func (repo *PostgresRepository) UpdatePost(ctx context.Context, post *models.Post) error {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE posts SET post_content = $1, visibility = COALESCE(NULLIF($4, ''), visibility), updated_at = NOW(), revision = revision + 1 WHERE id = $2 AND user_id = $3 AND deleted_at IS NULL"
+	args := []any{post.PostContent, post.Id, post.UserId, post.Visibility}
+	if post.Revision != 0 {
+		query += " AND revision = $5"
+		args = append(args, post.Revision)
+	}
+	query += " RETURNING " + postColumns
+	err = scanPost(tx.QueryRowContext(ctx, query, args...), post)
+	if errors.Is(err, sql.ErrNoRows) && post.Revision != 0 {
+		return postVersionConflict(ctx, tx, post)
+	}
+	if err != nil {
+		return notFound(err)
+	}
+	if err = insertPostRevision(ctx, tx, post); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// postVersionConflict tells apart a conditional write that matched no rows
+// because the post is gone from one that lost against a concurrent edit.
+func postVersionConflict(ctx context.Context, tx *sql.Tx, post *models.Post) error {
+	var exists bool
+	err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM posts WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL)",
+		post.Id,
+		post.UserId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return repository.ErrVersionMismatch
+	}
+	return repository.ErrNotFound
+}
+
+func insertPostRevision(ctx context.Context, tx *sql.Tx, post *models.Post) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO post_revisions (post_id, revision, post_content, editor_id, created_at) VALUES ($1, $2, $3, $4, $5)",
+		post.Id,
+		post.Revision,
+		post.PostContent,
+		post.UserId,
+		post.UpdatedAt)
+	return err
+}
+
+func (repo *PostgresRepository) GetPostRevision(ctx context.Context, postId string, revision int) (*models.PostRevision, error) {
+	row := repo.db.QueryRowContext(ctx, "SELECT post_id, revision, post_content, editor_id, created_at FROM post_revisions WHERE post_id = $1 AND revision = $2", postId, revision)
+	var rev models.PostRevision
+	if err := row.Scan(&rev.PostId, &rev.Revision, &rev.PostContent, &rev.EditorId, &rev.CreatedAt); err != nil {
+		return nil, notFound(err)
+	}
+	return &rev, nil
+}
+
+func (repo *PostgresRepository) ListPostRevisions(ctx context.Context, postId string) ([]*models.PostRevision, error) {
+	rows, err := repo.db.QueryContext(ctx, "SELECT post_id, revision, post_content, editor_id, created_at FROM post_revisions WHERE post_id = $1 ORDER BY revision DESC", postId)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var user models.User
+	var revisions []*models.PostRevision
 	for rows.Next() {
-		if err = rows.Scan(&user.ID, &user.Email); err != nil {
+		var rev models.PostRevision
+		if err = rows.Scan(&rev.PostId, &rev.Revision, &rev.PostContent, &rev.EditorId, &rev.CreatedAt); err != nil {
 			return nil, err
 		}
+		revisions = append(revisions, &rev)
 	}
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
-	return &user, nil
+	return revisions, nil
 }
 
-func (repo *PostgresRepository) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
-	rows, err := repo.db.QueryContext(ctx, "SELECT id, email, password FROM users WHERE email = $1", email)
+func (repo *PostgresRepository) DeletePost(ctx context.Context, post *models.Post) error {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE posts SET deleted_at = NOW() WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL"
+	args := []any{post.Id, post.UserId}
+	if post.Revision != 0 {
+		query += " AND revision = $3"
+		args = append(args, post.Revision)
+	}
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		if post.Revision != 0 {
+			return postVersionConflict(ctx, tx, post)
+		}
+		return repository.ErrNotFound
+	}
+	return tx.Commit()
+}
+
+func (repo *PostgresRepository) ListPosts(ctx context.Context, viewerId string, limit uint64, after string) ([]*models.Post, error) {
+	rows, err := repo.db.QueryContext(ctx,
+		"SELECT "+postColumns+" FROM posts WHERE id > $2 AND status = 'published' AND deleted_at IS NULL AND "+visiblePosts+" ORDER BY id ASC LIMIT $3",
+		viewerId,
+		after,
+		limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var user models.User
+	var posts []*models.Post
 	for rows.Next() {
-		if err = rows.Scan(&user.ID, &user.Email, &user.Password); err != nil {
+		var post models.Post
+		if err = scanPost(rows, &post); err != nil {
 			return nil, err
 		}
+		posts = append(posts, &post)
 	}
 
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
-	return &user, nil
+	return posts, nil
 }
 
-func (repo *PostgresRepository) InsertPost(ctx context.Context, post *models.Post) error {
-	_, err := repo.db.ExecContext(ctx, "INSERT INTO posts (id, post_content, user_id) VALUES ($1, $2, $3)",
+func (repo *PostgresRepository) ListPostsByUser(ctx context.Context, viewerId string, userId string, limit uint64, after string) ([]*models.Post, error) {
+	rows, err := repo.db.QueryContext(ctx,
+		"SELECT "+postColumns+" FROM posts WHERE user_id = $2 AND id > $3 AND status = 'published' AND deleted_at IS NULL AND "+visiblePosts+" ORDER BY id ASC LIMIT $4",
+		viewerId,
+		userId,
+		after,
+		limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []*models.Post
+	for rows.Next() {
+		var post models.Post
+		if err = scanPost(rows, &post); err != nil {
+			return nil, err
+		}
+		posts = append(posts, &post)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+func (repo *PostgresRepository) ListDeletedPosts(ctx context.Context, userId string, limit uint64, after string) ([]*models.Post, error) {
+	rows, err := repo.db.QueryContext(ctx,
+		"SELECT "+postColumns+" FROM posts WHERE user_id = $1 AND deleted_at IS NOT NULL AND id > $2 ORDER BY id ASC LIMIT $3",
+		userId,
+		after,
+		limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []*models.Post
+	for rows.Next() {
+		var post models.Post
+		if err = scanPost(rows, &post); err != nil {
+			return nil, err
+		}
+		posts = append(posts, &post)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+func (repo *PostgresRepository) RestorePost(ctx context.Context, post *models.Post) error {
+	row := repo.db.QueryRowContext(ctx,
+		"UPDATE posts SET deleted_at = NULL WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL RETURNING "+postColumns,
 		post.Id,
-		post.PostContent,
 		post.UserId)
-	return err
+	return notFound(scanPost(row, post))
 }
 
-func (repo *PostgresRepository) GetPostById(ctx context.Context, id string) (*models.Post, error) {
-	rows, err := repo.db.QueryContext(ctx, "SELECT id, post_content, user_id, created_at FROM posts WHERE id = $1", id)
+func (repo *PostgresRepository) PurgeDeletedPosts(ctx context.Context, olderThan time.Duration) (int64, error) {
+	res, err := repo.db.ExecContext(ctx,
+		"DELETE FROM posts WHERE deleted_at IS NOT NULL AND deleted_at < NOW() - make_interval(secs => $1)",
+		olderThan.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (repo *PostgresRepository) ListUnpublishedPosts(ctx context.Context, userId string, limit uint64, after string) ([]*models.Post, error) {
+	rows, err := repo.db.QueryContext(ctx,
+		"SELECT "+postColumns+" FROM posts WHERE user_id = $1 AND status <> 'published' AND deleted_at IS NULL AND id > $2 ORDER BY id ASC LIMIT $3",
+		userId,
+		after,
+		limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var post models.Post
+	var posts []*models.Post
 	for rows.Next() {
-		if err = rows.Scan(&post.Id, &post.PostContent, &post.UserId, &post.CreatedAt); err != nil {
+		var post models.Post
+		if err = scanPost(rows, &post); err != nil {
 			return nil, err
 		}
+		posts = append(posts, &post)
 	}
+
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
-	return &post, nil
+	return posts, nil
 }
 
-func (repo *PostgresRepository) UpdatePost(ctx context.Context, post *models.Post) error {
-	res, err := repo.db.ExecContext(ctx, "UPDATE posts SET post_content = $1 WHERE id = $2 AND user_id = $3",
-		post.PostContent,
+func (repo *PostgresRepository) SetPostStatus(ctx context.Context, post *models.Post) error {
+	row := repo.db.QueryRowContext(ctx,
+		"UPDATE posts SET status = $1, publish_at = $2 WHERE id = $3 AND user_id = $4 AND status <> 'published' AND deleted_at IS NULL RETURNING "+postColumns,
+		post.Status,
+		post.PublishAt,
 		post.Id,
 		post.UserId)
+	return notFound(scanPost(row, post))
+}
+
+func (repo *PostgresRepository) PublishDuePosts(ctx context.Context, limit uint64) ([]*models.Post, error) {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// SKIP LOCKED lets several instances run the scheduler at once without
+	// publishing (and announcing) the same post twice.
+	rows, err := tx.QueryContext(ctx,
+		"SELECT "+postColumns+" FROM posts WHERE status = 'scheduled' AND publish_at <= NOW() AND deleted_at IS NULL ORDER BY publish_at ASC LIMIT $1 FOR UPDATE SKIP LOCKED",
+		limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []*models.Post
+	var ids []string
+	for rows.Next() {
+		var post models.Post
+		if err = scanPost(rows, &post); err != nil {
+			return nil, err
+		}
+		post.Status = models.PostStatusPublished
+		posts = append(posts, &post)
+		ids = append(ids, post.Id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(posts) == 0 {
+		return nil, nil
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE posts SET status = 'published' WHERE id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+func scanPost(row scanner, post *models.Post) error {
+	err := row.Scan(&post.Id, &post.PostContent, &post.UserId, &post.CreatedAt, &post.UpdatedAt, &post.Revision, &post.DeletedAt, &post.Status, &post.PublishAt, &post.Visibility)
+	// publish_at has a time zone, which the driver reads in the session's.
+	if post.PublishAt != nil {
+		publishAt := post.PublishAt.UTC()
+		post.PublishAt = &publishAt
+	}
+	return err
+}
+
+func (repo *PostgresRepository) FollowUser(ctx context.Context, followerId string, followeeId string) error {
+	_, err := repo.db.ExecContext(ctx, "INSERT INTO follows (follower_id, followee_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", followerId, followeeId)
+	return constraintError(err)
+}
+
+func (repo *PostgresRepository) UnfollowUser(ctx context.Context, followerId string, followeeId string) error {
+	_, err := repo.db.ExecContext(ctx, "DELETE FROM follows WHERE follower_id = $1 AND followee_id = $2", followerId, followeeId)
+	return err
+}
+
+func (repo *PostgresRepository) IsFollowing(ctx context.Context, followerId string, followeeId string) (bool, error) {
+	var following bool
+	err := repo.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM follows WHERE follower_id = $1 AND followee_id = $2)", followerId, followeeId).Scan(&following)
+	return following, err
+}
+
+func (repo *PostgresRepository) ListFollowerIds(ctx context.Context, userId string) ([]string, error) {
+	rows, err := repo.db.QueryContext(ctx, "SELECT follower_id FROM follows WHERE followee_id = $1", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (repo *PostgresRepository) InsertAttachment(ctx context.Context, attachment *models.Attachment) error {
+	return insertAttachment(ctx, repo.db, attachment)
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func insertAttachment(ctx context.Context, db queryRower, attachment *models.Attachment) error {
+	row := db.QueryRowContext(ctx,
+		"INSERT INTO attachments (id, post_id, user_id, file_name, content_type, size, storage_key) VALUES ($1, NULLIF($2, ''), $3, $4, $5, $6, $7) RETURNING created_at",
+		attachment.Id,
+		attachment.PostId,
+		attachment.UserId,
+		attachment.FileName,
+		attachment.ContentType,
+		attachment.Size,
+		attachment.StorageKey)
+	return constraintError(row.Scan(&attachment.CreatedAt))
+}
+
+func (repo *PostgresRepository) GetAttachmentById(ctx context.Context, id string) (*models.Attachment, error) {
+	row := repo.db.QueryRowContext(ctx, "SELECT "+attachmentColumns+" FROM attachments WHERE id = $1", id)
+	var attachment models.Attachment
+	if err := scanAttachment(row, &attachment); err != nil {
+		return nil, notFound(err)
+	}
+	return &attachment, nil
+}
+
+func (repo *PostgresRepository) ListAttachments(ctx context.Context, postId string) ([]*models.Attachment, error) {
+	rows, err := repo.db.QueryContext(ctx, "SELECT "+attachmentColumns+" FROM attachments WHERE post_id = $1 ORDER BY id ASC", postId)
+	if err != nil {
+		return nil, err
+	}
+	return collectAttachments(rows)
+}
+
+func (repo *PostgresRepository) ListOrphanedAttachments(ctx context.Context, limit uint64) ([]*models.Attachment, error) {
+	rows, err := repo.db.QueryContext(ctx, "SELECT "+attachmentColumns+" FROM attachments WHERE post_id IS NULL AND NOT EXISTS (SELECT 1 FROM users WHERE users.avatar_id = attachments.id) ORDER BY id ASC LIMIT $1", limit)
+	if err != nil {
+		return nil, err
+	}
+	return collectAttachments(rows)
+}
+
+func (repo *PostgresRepository) DeleteAttachment(ctx context.Context, attachment *models.Attachment) error {
+	res, err := repo.db.ExecContext(ctx, "DELETE FROM attachments WHERE id = $1", attachment.Id)
 	if err != nil {
 		return err
 	}
@@ -103,15 +655,123 @@ func (repo *PostgresRepository) UpdatePost(ctx context.Context, post *models.Pos
 		return err
 	}
 	if n == 0 {
-		return sql.ErrNoRows
+		return repository.ErrNotFound
 	}
 	return nil
 }
 
-func (repo *PostgresRepository) DeletePost(ctx context.Context, post *models.Post) error {
-	res, err := repo.db.ExecContext(ctx, "DELETE FROM posts WHERE id = $1 AND user_id = $2",
-		post.Id,
-		post.UserId)
+func collectAttachments(rows *sql.Rows) ([]*models.Attachment, error) {
+	defer rows.Close()
+
+	var attachments []*models.Attachment
+	for rows.Next() {
+		var attachment models.Attachment
+		if err := scanAttachment(rows, &attachment); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, &attachment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return attachments, nil
+}
+
+func scanAttachment(row scanner, attachment *models.Attachment) error {
+	return row.Scan(&attachment.Id, &attachment.PostId, &attachment.UserId, &attachment.FileName, &attachment.ContentType, &attachment.Size, &attachment.StorageKey, &attachment.CreatedAt)
+}
+
+func (repo *PostgresRepository) GetLoginFailures(ctx context.Context, key string) (*models.LoginFailures, error) {
+	var failures models.LoginFailures
+	row := repo.db.QueryRowContext(ctx, "SELECT "+loginFailureColumns+" FROM login_failures WHERE key = $1", key)
+	if err := scanLoginFailures(row, &failures); err != nil {
+		return nil, notFound(err)
+	}
+	return &failures, nil
+}
+
+func (repo *PostgresRepository) RecordLoginFailure(ctx context.Context, key string, window time.Duration) (*models.LoginFailures, error) {
+	var failures models.LoginFailures
+	row := repo.db.QueryRowContext(ctx,
+		`INSERT INTO login_failures AS f (key, failures, first_failed_at, last_failed_at) VALUES ($1, 1, NOW(), NOW())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN f.first_failed_at > NOW() - make_interval(secs => $2) THEN f.failures + 1 ELSE 1 END,
+			first_failed_at = CASE WHEN f.first_failed_at > NOW() - make_interval(secs => $2) THEN f.first_failed_at ELSE NOW() END,
+			last_failed_at = NOW()
+		RETURNING `+loginFailureColumns,
+		key,
+		window.Seconds())
+	if err := scanLoginFailures(row, &failures); err != nil {
+		return nil, err
+	}
+	return &failures, nil
+}
+
+func (repo *PostgresRepository) LockLogin(ctx context.Context, key string, lockout time.Duration) error {
+	return repo.execOne(ctx, "UPDATE login_failures SET locked_until = NOW() + make_interval(secs => $2) WHERE key = $1", key, lockout.Seconds())
+}
+
+func (repo *PostgresRepository) ClearLoginFailures(ctx context.Context, key string) error {
+	_, err := repo.db.ExecContext(ctx, "DELETE FROM login_failures WHERE key = $1", key)
+	return err
+}
+
+func (repo *PostgresRepository) PurgeLoginFailures(ctx context.Context, olderThan time.Duration) (int64, error) {
+	res, err := repo.db.ExecContext(ctx,
+		`DELETE FROM login_failures WHERE last_failed_at < NOW() - make_interval(secs => $1)
+		AND (locked_until IS NULL OR locked_until < NOW() - make_interval(secs => $1))`,
+		olderThan.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func scanLoginFailures(row scanner, failures *models.LoginFailures) error {
+	return row.Scan(&failures.Key, &failures.Failures, &failures.FirstFailedAt, &failures.LastFailedAt, &failures.LockedUntil)
+}
+
+func (repo *PostgresRepository) SetUserTOTP(ctx context.Context, totp *models.TOTP) error {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO user_totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, enabled_at = NULL, last_step = 0, created_at = NOW()`,
+		totp.UserId,
+		totp.Secret)
+	if err = constraintError(err); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", totp.UserId); err != nil {
+		return err
+	}
+	totp.EnabledAt = nil
+	totp.LastStep = 0
+	return tx.Commit()
+}
+
+func (repo *PostgresRepository) GetUserTOTP(ctx context.Context, userId string) (*models.TOTP, error) {
+	var totp models.TOTP
+	err := repo.db.QueryRowContext(ctx, "SELECT user_id, secret, enabled_at, last_step FROM user_totp WHERE user_id = $1", userId).
+		Scan(&totp.UserId, &totp.Secret, &totp.EnabledAt, &totp.LastStep)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &totp, nil
+}
+
+func (repo *PostgresRepository) EnableUserTOTP(ctx context.Context, userId string, recoveryCodeHashes []string) error {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "UPDATE user_totp SET enabled_at = NOW() WHERE user_id = $1", userId)
 	if err != nil {
 		return err
 	}
@@ -120,42 +780,154 @@ func (repo *PostgresRepository) DeletePost(ctx context.Context, post *models.Pos
 		return err
 	}
 	if n == 0 {
-		return sql.ErrNoRows
+		return repository.ErrNotFound
 	}
-	return nil
+	if _, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userId); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		_, err = tx.ExecContext(ctx, "INSERT INTO recovery_codes (code_hash, user_id) VALUES ($1, $2)", hash, userId)
+		if err = constraintError(err); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (repo *PostgresRepository) UseTOTPStep(ctx context.Context, userId string, step int64) error {
+	return repo.execOne(ctx, "UPDATE user_totp SET last_step = $2 WHERE user_id = $1 AND last_step < $2", userId, step)
+}
+
+func (repo *PostgresRepository) DeleteUserTOTP(ctx context.Context, userId string) error {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM user_totp WHERE user_id = $1", userId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return repository.ErrNotFound
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (repo *PostgresRepository) ConsumeRecoveryCode(ctx context.Context, userId string, codeHash string) error {
+	return repo.execOne(ctx, "UPDATE recovery_codes SET used_at = NOW() WHERE code_hash = $1 AND user_id = $2 AND used_at IS NULL", codeHash, userId)
+}
+
+func (repo *PostgresRepository) CountRecoveryCodes(ctx context.Context, userId string) (int, error) {
+	var n int
+	err := repo.db.QueryRowContext(ctx,
+		"SELECT COUNT(c.code_hash) FROM user_totp t LEFT JOIN recovery_codes c ON c.user_id = t.user_id AND c.used_at IS NULL WHERE t.user_id = $1 GROUP BY t.user_id",
+		userId).Scan(&n)
+	if err != nil {
+		return 0, notFound(err)
+	}
+	return n, nil
+}
+
+func (repo *PostgresRepository) InsertAccessToken(ctx context.Context, token *models.AccessToken, ttl time.Duration) error {
+	row := repo.db.QueryRowContext(ctx,
+		"INSERT INTO access_tokens (id, user_id, name, token_hash, scopes, expires_at) VALUES ($1, $2, $3, $4, $5, NOW() + make_interval(secs => $6)) RETURNING expires_at, created_at",
+		token.Id,
+		token.UserId,
+		token.Name,
+		token.TokenHash,
+		pq.Array(token.Scopes),
+		ttl.Seconds())
+	token.LastUsedAt = nil
+	return constraintError(row.Scan(&token.ExpiresAt, &token.CreatedAt))
 }
 
-func (repo *PostgresRepository) ListPosts(ctx context.Context, limit uint64, after string) ([]*models.Post, error) {
-	var rows *sql.Rows
-	var err error
-	if after == "" {
-		rows, err = repo.db.QueryContext(ctx,
-			"SELECT id, post_content, user_id, created_at FROM posts ORDER BY id ASC LIMIT $1",
-			limit)
-	} else {
-		rows, err = repo.db.QueryContext(ctx,
-			"SELECT id, post_content, user_id, created_at FROM posts WHERE id > $2  ORDER BY id ASC LIMIT $1",
-			limit,
-			after)
+func (repo *PostgresRepository) GetAccessTokenByHash(ctx context.Context, tokenHash string) (*models.AccessToken, error) {
+	var token models.AccessToken
+	row := repo.db.QueryRowContext(ctx, "SELECT "+accessTokenColumns+" FROM access_tokens WHERE token_hash = $1 AND expires_at > NOW()", tokenHash)
+	if err := scanAccessToken(row, &token); err != nil {
+		return nil, notFound(err)
 	}
+	return &token, nil
+}
+
+func (repo *PostgresRepository) ListAccessTokens(ctx context.Context, userId string) ([]*models.AccessToken, error) {
+	rows, err := repo.db.QueryContext(ctx, "SELECT "+accessTokenColumns+" FROM access_tokens WHERE user_id = $1 ORDER BY created_at, id", userId)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-
-	var posts []*models.Post
+	tokens := []*models.AccessToken{}
 	for rows.Next() {
-		var post models.Post
-		if err = rows.Scan(&post.Id, &post.PostContent, &post.UserId, &post.CreatedAt); err != nil {
+		var token models.AccessToken
+		if err := scanAccessToken(rows, &token); err != nil {
 			return nil, err
 		}
-		posts = append(posts, &post)
+		tokens = append(tokens, &token)
 	}
-
-	if err = rows.Err(); err != nil {
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
-	return posts, nil
+	return tokens, nil
+}
+
+func (repo *PostgresRepository) MarkAccessTokenUsed(ctx context.Context, id string) error {
+	return repo.execOne(ctx, "UPDATE access_tokens SET last_used_at = NOW() WHERE id = $1", id)
+}
+
+func (repo *PostgresRepository) DeleteAccessToken(ctx context.Context, userId string, id string) error {
+	return repo.execOne(ctx, "DELETE FROM access_tokens WHERE id = $1 AND user_id = $2", id, userId)
+}
+
+func scanAccessToken(row scanner, token *models.AccessToken) error {
+	return row.Scan(&token.Id, &token.UserId, &token.Name, &token.TokenHash, pq.Array(&token.Scopes), &token.ExpiresAt, &token.LastUsedAt, &token.CreatedAt)
+}
+
+// execOne runs query and fails with repository.ErrNotFound unless it
+// changed a row.
+func (repo *PostgresRepository) execOne(ctx context.Context, query string, args ...any) error {
+	res, err := repo.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return repository.ErrNotFound
+	}
+	return nil
+}
+
+func (repo *PostgresRepository) Ping(ctx context.Context) error {
+	if err := repo.db.PingContext(ctx); err != nil {
+		return err
+	}
+	var missing []string
+	err := repo.db.QueryRowContext(ctx,
+		"SELECT COALESCE(array_agg(name), '{}') FROM unnest($1::text[]) AS name WHERE to_regclass(name) IS NULL",
+		pq.Array(schemaRelations)).Scan(pq.Array(&missing))
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("schema is missing %s, apply up.sql", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Stats returns the statistics of the connection pool.
+func (repo *PostgresRepository) Stats() sql.DBStats {
+	return repo.db.Stats()
 }
 
 func (repo *PostgresRepository) Close() error {
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bocanada/rest-ws/repository"
+	"github.com/bocanada/rest-ws/repository/repositorytest"
+	"github.com/lib/pq"
+	"github.com/segmentio/ksuid"
+)
+
+// TestPostgresRepository runs the repository contract against the database
+// in TEST_DATABASE_URL. Every test gets a schema of its own, dropped when it
+// ends, so the database can be shared.
+func TestPostgresRepository(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	repositorytest.Run(t, func(t *testing.T) repository.Repository {
+		return newTestRepository(t, url)
+	})
+}
+
+func newTestRepository(t *testing.T, url string) *PostgresRepository {
+	t.Helper()
+	dsn := url
+	if strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://") {
+		var err error
+		if dsn, err = pq.ParseURL(url); err != nil {
+			t.Fatal(err)
+		}
+	}
+	schema := "test_" + strings.ToLower(ksuid.New().String())
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	if _, err = admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	repo, err := NewPostgresRepository(dsn + " search_path=" + schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	ddl, err := os.ReadFile("up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = repo.db.Exec(string(ddl)); err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
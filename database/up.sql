@@ -3,15 +3,134 @@ DROP TABLE IF EXISTS users;
 CREATE TABLE users (
     id VARCHAR(32) PRIMARY KEY,
     password VARCHAR(255) NOT NULL,
-    email VARCHAR(255) UNIQUE NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    handle VARCHAR(32) UNIQUE,
+    display_name VARCHAR(64) NOT NULL DEFAULT '',
+    bio VARCHAR(280) NOT NULL DEFAULT '',
+    avatar_id VARCHAR(32),
+    email_verified_at TIMESTAMP,
     created_at TIMESTAMP NOT NULL DEFAULT NOW()
 );
 
+-- Emails are stored normalised, the index also keeps older mixed-case rows
+-- from being registered twice.
+CREATE UNIQUE INDEX users_email_key ON users (lower(email));
+
 DROP TABLE IF EXISTS posts;
 
 CREATE TABLE posts (
     id VARCHAR(32) PRIMARY KEY,
     post_content VARCHAR(322) NOT NULL,
     created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    revision INTEGER NOT NULL DEFAULT 1,
+    deleted_at TIMESTAMP,
+    status VARCHAR(16) NOT NULL DEFAULT 'published',
+    -- Scheduled by clients in any time zone, compared with NOW().
+    publish_at TIMESTAMPTZ,
+    visibility VARCHAR(16) NOT NULL DEFAULT 'public',
     user_id VARCHAR(32) REFERENCES users(id)
 );
+
+DROP TABLE IF EXISTS post_revisions;
+
+CREATE TABLE post_revisions (
+    post_id VARCHAR(32) REFERENCES posts(id) ON DELETE CASCADE,
+    revision INTEGER NOT NULL,
+    post_content VARCHAR(322) NOT NULL,
+    editor_id VARCHAR(32) REFERENCES users(id),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (post_id, revision)
+);
+
+DROP TABLE IF EXISTS follows;
+
+CREATE TABLE follows (
+    follower_id VARCHAR(32) REFERENCES users(id) ON DELETE CASCADE,
+    followee_id VARCHAR(32) REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (follower_id, followee_id)
+);
+
+DROP TABLE IF EXISTS attachments;
+
+CREATE TABLE attachments (
+    id VARCHAR(32) PRIMARY KEY,
+    post_id VARCHAR(32) REFERENCES posts(id) ON DELETE SET NULL,
+    user_id VARCHAR(32) REFERENCES users(id),
+    file_name VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    size BIGINT NOT NULL,
+    storage_key VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+DROP TABLE IF EXISTS user_tokens;
+
+CREATE TABLE user_tokens (
+    token_hash VARCHAR(64) PRIMARY KEY,
+    user_id VARCHAR(32) REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(32) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+DROP TABLE IF EXISTS user_totp;
+
+-- TOTP secrets of two-factor authentication, enforced once enabled_at is
+-- set. last_step keeps codes from being used twice.
+CREATE TABLE user_totp (
+    user_id VARCHAR(32) PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret VARCHAR(64) NOT NULL,
+    enabled_at TIMESTAMP,
+    last_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+DROP TABLE IF EXISTS recovery_codes;
+
+CREATE TABLE recovery_codes (
+    code_hash VARCHAR(64) PRIMARY KEY,
+    user_id VARCHAR(32) REFERENCES users(id) ON DELETE CASCADE,
+    used_at TIMESTAMP
+);
+
+DROP TABLE IF EXISTS access_tokens;
+
+-- Personal access tokens, for scripts acting as their user within scopes.
+CREATE TABLE access_tokens (
+    id VARCHAR(32) PRIMARY KEY,
+    user_id VARCHAR(32) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(64) NOT NULL,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    scopes TEXT[] NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+DROP TABLE IF EXISTS login_failures;
+
+-- Failed logins per email address and per client address, whether or not
+-- an account exists, for the lockout of LoginHandler. The times are
+-- compared with the clock of the server, hence their time zone.
+CREATE TABLE login_failures (
+    key VARCHAR(512) PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    first_failed_at TIMESTAMPTZ NOT NULL,
+    last_failed_at TIMESTAMPTZ NOT NULL,
+    locked_until TIMESTAMPTZ
+);
+
+DROP TABLE IF EXISTS rate_limits;
+
+-- Token buckets of ratelimit.PostgresLimiter, shared by every instance.
+-- Buckets refill by the time elapsed since updated_at on the clock of the
+-- server, hence its time zone.
+CREATE TABLE rate_limits (
+    key VARCHAR(512) PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    allowed BOOLEAN NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
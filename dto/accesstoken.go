@@ -0,0 +1,63 @@
+package dto
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/validation"
+)
+
+const (
+	MaxAccessTokenNameLength = 64
+	// DefaultAccessTokenDays is the lifetime of access tokens created
+	// without expires_in_days.
+	DefaultAccessTokenDays = 30
+	MaxAccessTokenDays     = 365
+)
+
+type CreateAccessTokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+type AccessToken struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// CreateAccessTokenResponse carries the token itself, which is only ever
+// shown this once.
+type CreateAccessTokenResponse struct {
+	AccessToken
+	Token string `json:"token"`
+}
+
+func NewAccessToken(token *models.AccessToken) AccessToken {
+	return AccessToken{
+		Id:         token.Id,
+		Name:       token.Name,
+		Scopes:     token.Scopes,
+		ExpiresAt:  token.ExpiresAt,
+		LastUsedAt: token.LastUsedAt,
+		CreatedAt:  token.CreatedAt,
+	}
+}
+
+func (req *CreateAccessTokenRequest) Validate() error {
+	var v validation.Validator
+	v.Required("name", req.Name)
+	v.MaxLength("name", req.Name, MaxAccessTokenNameLength)
+	v.Check(len(req.Scopes) > 0, "scopes", validation.CodeRequired, "is required")
+	for _, scope := range req.Scopes {
+		v.OneOf("scopes", scope, models.Scopes...)
+	}
+	v.Check(req.ExpiresInDays >= 0 && req.ExpiresInDays <= MaxAccessTokenDays, "expires_in_days", validation.CodeOutOfRange,
+		fmt.Sprintf("must be between 1 and %d, or 0 for %d", MaxAccessTokenDays, DefaultAccessTokenDays))
+	return v.Err()
+}
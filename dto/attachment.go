@@ -0,0 +1,31 @@
+package dto
+
+import (
+	"time"
+
+	"github.com/bocanada/rest-ws/models"
+)
+
+type Attachment struct {
+	Id          string    `json:"id"`
+	PostId      string    `json:"post_id,omitempty"`
+	FileName    string    `json:"file_name"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	URL         string    `json:"url"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// NewAttachment maps attachment using url, a signed download link, since the
+// storage location itself is never exposed.
+func NewAttachment(attachment *models.Attachment, url string) Attachment {
+	return Attachment{
+		Id:          attachment.Id,
+		PostId:      attachment.PostId,
+		FileName:    attachment.FileName,
+		ContentType: attachment.ContentType,
+		Size:        attachment.Size,
+		URL:         url,
+		CreatedAt:   attachment.CreatedAt,
+	}
+}
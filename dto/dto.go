@@ -0,0 +1,5 @@
+// Package dto holds the types the HTTP API reads and writes. Handlers never
+// send storage models from the models package directly; they map them
+// through the constructors in this package, which decide what each resource
+// exposes.
+package dto
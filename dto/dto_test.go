@@ -0,0 +1,147 @@
+package dto
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bocanada/rest-ws/models"
+)
+
+// sensitiveFields are substrings that must never appear in the JSON name of
+// a response field.
+var sensitiveFields = []string{"password", "secret", "hash", "storage_key"}
+
+// privateResponses may expose the email address because they are only ever
+// sent to the account owner.
+var privateResponses = map[string]bool{
+	"Me":             true,
+	"SignUpResponse": true,
+}
+
+// responseTypes parses the package sources so that new response types are
+// checked without having to register them anywhere.
+func responseTypes(t *testing.T) map[string]*ast.StructType {
+	t.Helper()
+	pkgs, err := parser.ParseDir(token.NewFileSet(), ".", func(fi fs.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	structs := map[string]*ast.StructType{}
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			ast.Inspect(file, func(n ast.Node) bool {
+				if spec, ok := n.(*ast.TypeSpec); ok {
+					if st, ok := spec.Type.(*ast.StructType); ok {
+						structs[spec.Name.Name] = st
+					}
+				}
+				return true
+			})
+		}
+	}
+	return structs
+}
+
+func jsonName(field *ast.Field, goName string) string {
+	if field.Tag == nil {
+		return goName
+	}
+	tag := reflect.StructTag(strings.Trim(field.Tag.Value, "`")).Get("json")
+	name := strings.Split(tag, ",")[0]
+	if name == "" {
+		return goName
+	}
+	return name
+}
+
+func checkStruct(t *testing.T, structs map[string]*ast.StructType, path string, st *ast.StructType, private bool) {
+	for _, field := range st.Fields.List {
+		typ := field.Type
+		for {
+			switch inner := typ.(type) {
+			case *ast.StarExpr:
+				typ = inner.X
+				continue
+			case *ast.ArrayType:
+				typ = inner.Elt
+				continue
+			}
+			break
+		}
+		if sel, ok := typ.(*ast.SelectorExpr); ok {
+			if pkg, ok := sel.X.(*ast.Ident); ok && pkg.Name == "models" {
+				t.Errorf("%s exposes the storage model models.%s", path, sel.Sel.Name)
+			}
+		}
+		var names []string
+		if len(field.Names) == 0 {
+			if ident, ok := typ.(*ast.Ident); ok {
+				names = append(names, ident.Name)
+			}
+		}
+		for _, name := range field.Names {
+			names = append(names, name.Name)
+		}
+		for _, goName := range names {
+			name := strings.ToLower(jsonName(field, goName))
+			if name == "-" {
+				continue
+			}
+			for _, sensitive := range sensitiveFields {
+				if strings.Contains(name, sensitive) {
+					t.Errorf("%s.%s is sensitive and must not be part of a response", path, goName)
+					break
+				}
+			}
+			if !private && strings.Contains(name, "email") {
+				t.Errorf("%s.%s exposes an email address in a public response", path, goName)
+			}
+		}
+		if ident, ok := typ.(*ast.Ident); ok {
+			if nested, ok := structs[ident.Name]; ok {
+				checkStruct(t, structs, path+"."+ident.Name, nested, private)
+			}
+		}
+	}
+}
+
+func TestResponsesDoNotExposeSensitiveFields(t *testing.T) {
+	structs := responseTypes(t)
+	if len(structs) == 0 {
+		t.Fatal("no types found in package dto")
+	}
+	for name, st := range structs {
+		if strings.HasSuffix(name, "Request") {
+			continue
+		}
+		checkStruct(t, structs, name, st, privateResponses[name])
+	}
+}
+
+func TestUserModelNeverSerialisesPassword(t *testing.T) {
+	data, err := json.Marshal(models.User{ID: "1", Email: "a@b.c", Password: "$2a$10$hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hash") || strings.Contains(string(data), "password") {
+		t.Errorf("models.User leaks its password: %s", data)
+	}
+}
+
+func TestProfileHasNoEmail(t *testing.T) {
+	data, err := json.Marshal(NewProfile(&models.User{ID: "1", Email: "a@b.c", Password: "secret"}, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "a@b.c") || strings.Contains(string(data), "secret") {
+		t.Errorf("profile leaks private data: %s", data)
+	}
+}
@@ -0,0 +1,30 @@
+package dto
+
+import "time"
+
+// HealthResponse is the body of /healthz and /readyz. Checks maps every
+// dependency /readyz looked at to "ok" or to why it failed.
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+type StatusResponse struct {
+	Version          string            `json:"version"`
+	StartedAt        time.Time         `json:"started_at"`
+	UptimeSeconds    int64             `json:"uptime_seconds"`
+	WebSocketClients int               `json:"websocket_clients"`
+	Checks           map[string]string `json:"checks"`
+	DBPool           *DBPoolStats      `json:"db_pool,omitempty"`
+}
+
+// DBPoolStats is the part of sql.DBStats worth watching; repositories
+// without a connection pool have none.
+type DBPoolStats struct {
+	MaxOpenConnections int   `json:"max_open_connections"`
+	OpenConnections    int   `json:"open_connections"`
+	InUse              int   `json:"in_use"`
+	Idle               int   `json:"idle"`
+	WaitCount          int64 `json:"wait_count"`
+	WaitDurationMs     int64 `json:"wait_duration_ms"`
+}
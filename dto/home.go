@@ -0,0 +1,9 @@
+package dto
+
+type HomeResponse struct {
+	Message string `json:"message"`
+}
+
+type MessageResponse struct {
+	Message string `json:"message"`
+}
@@ -0,0 +1,109 @@
+package dto
+
+import (
+	"time"
+
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/validation"
+)
+
+type UpsertPostRequest struct {
+	PostContent string     `json:"post_content"`
+	Status      string     `json:"status"`
+	PublishAt   *time.Time `json:"publish_at"`
+	Visibility  string     `json:"visibility"`
+}
+
+type PublishPostRequest struct {
+	PublishAt *time.Time `json:"publish_at"`
+}
+
+type InsertPostResponse struct {
+	Id          string `json:"id"`
+	PostContent string `json:"post_content"`
+}
+
+type Post struct {
+	Id          string     `json:"id"`
+	PostContent string     `json:"post_content"`
+	UserId      string     `json:"user_id"`
+	Status      string     `json:"status"`
+	Visibility  string     `json:"visibility"`
+	Revision    int        `json:"revision"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	PublishAt   *time.Time `json:"publish_at,omitempty"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+}
+
+type PostRevision struct {
+	PostId      string    `json:"post_id"`
+	Revision    int       `json:"revision"`
+	PostContent string    `json:"post_content"`
+	EditorId    string    `json:"editor_id"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func NewPost(post *models.Post) Post {
+	return Post{
+		Id:          post.Id,
+		PostContent: post.PostContent,
+		UserId:      post.UserId,
+		Status:      post.Status,
+		Visibility:  post.Visibility,
+		Revision:    post.Revision,
+		CreatedAt:   post.CreatedAt,
+		UpdatedAt:   post.UpdatedAt,
+		PublishAt:   post.PublishAt,
+		DeletedAt:   post.DeletedAt,
+	}
+}
+
+func NewPosts(posts []*models.Post) []Post {
+	res := make([]Post, 0, len(posts))
+	for _, post := range posts {
+		res = append(res, NewPost(post))
+	}
+	return res
+}
+
+func NewPostRevision(rev *models.PostRevision) PostRevision {
+	return PostRevision{
+		PostId:      rev.PostId,
+		Revision:    rev.Revision,
+		PostContent: rev.PostContent,
+		EditorId:    rev.EditorId,
+		CreatedAt:   rev.CreatedAt,
+	}
+}
+
+func NewPostRevisions(revisions []*models.PostRevision) []PostRevision {
+	res := make([]PostRevision, 0, len(revisions))
+	for _, rev := range revisions {
+		res = append(res, NewPostRevision(rev))
+	}
+	return res
+}
+
+// MaxPostContentLength matches the size of the post_content column.
+const MaxPostContentLength = 322
+
+func (req *UpsertPostRequest) Validate() error {
+	var v validation.Validator
+	v.Required("post_content", req.PostContent)
+	v.MaxLength("post_content", req.PostContent, MaxPostContentLength)
+	if req.Status != "" {
+		v.OneOf("status", req.Status, models.PostStatusDraft, models.PostStatusScheduled, models.PostStatusPublished)
+	}
+	if req.Status == models.PostStatusScheduled {
+		v.Check(req.PublishAt != nil, "publish_at", validation.CodeRequired, "is required for scheduled posts")
+	}
+	if req.Visibility != "" {
+		v.OneOf("visibility", req.Visibility, models.PostVisibilityPublic, models.PostVisibilityFollowers, models.PostVisibilityPrivate)
+	}
+	return v.Err()
+}
+
+func (req *PublishPostRequest) Validate() error {
+	return nil
+}
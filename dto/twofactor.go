@@ -0,0 +1,57 @@
+package dto
+
+import (
+	"time"
+
+	"github.com/bocanada/rest-ws/validation"
+)
+
+// maxCodeLength bounds TOTP and recovery codes, dashes included.
+const maxCodeLength = 32
+
+// TwoFactorCodeRequest carries a code of the authenticator app of the
+// user, or one of their recovery codes where those are accepted.
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// LoginChallengeRequest completes the login of a user with two-factor
+// authentication.
+type LoginChallengeRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
+
+type TwoFactorStatus struct {
+	Enabled           bool       `json:"enabled"`
+	EnabledAt         *time.Time `json:"enabled_at,omitempty"`
+	RecoveryCodesLeft int        `json:"recovery_codes_left"`
+}
+
+// TwoFactorEnrollment holds the otpauth:// URI authenticator apps enroll
+// the secret from. It is meant to be shown as a QR code; its secret
+// parameter can be typed in by hand instead.
+type TwoFactorEnrollment struct {
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+// RecoveryCodesResponse lists recovery codes, which are only ever shown
+// this once.
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func (req *TwoFactorCodeRequest) Validate() error {
+	var v validation.Validator
+	v.Required("code", req.Code)
+	v.MaxLength("code", req.Code, maxCodeLength)
+	return v.Err()
+}
+
+func (req *LoginChallengeRequest) Validate() error {
+	var v validation.Validator
+	v.Required("challenge_token", req.ChallengeToken)
+	v.Required("code", req.Code)
+	v.MaxLength("code", req.Code, maxCodeLength)
+	return v.Err()
+}
@@ -0,0 +1,130 @@
+package dto
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/validation"
+)
+
+type SignUpLoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// UpdateProfileRequest only changes the fields that are present.
+type UpdateProfileRequest struct {
+	Handle      *string `json:"handle"`
+	DisplayName *string `json:"display_name"`
+	Bio         *string `json:"bio"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type SignUpResponse struct {
+	Id    string `json:"id"`
+	Email string `json:"email"`
+}
+
+// LoginResponse carries an access token, or for users with two-factor
+// authentication a challenge token to send along with their code to
+// /login/2fa.
+type LoginResponse struct {
+	Token             string `json:"token,omitempty"`
+	TwoFactorRequired bool   `json:"two_factor_required,omitempty"`
+	ChallengeToken    string `json:"challenge_token,omitempty"`
+}
+
+// Profile is the public face of a user. It must never carry the email
+// address or anything else only the user should see.
+type Profile struct {
+	Id          string    `json:"id"`
+	Handle      string    `json:"handle"`
+	DisplayName string    `json:"display_name"`
+	Bio         string    `json:"bio"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Me is what users see about their own account.
+type Me struct {
+	Profile
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+type Follow struct {
+	UserId    string `json:"user_id"`
+	Following bool   `json:"following"`
+}
+
+func NewProfile(user *models.User, avatarURL string) Profile {
+	return Profile{
+		Id:          user.ID,
+		Handle:      user.Handle,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		AvatarURL:   avatarURL,
+		CreatedAt:   user.CreatedAt,
+	}
+}
+
+func NewMe(user *models.User, avatarURL string) Me {
+	return Me{Profile: NewProfile(user, avatarURL), Email: user.Email, EmailVerified: user.EmailVerifiedAt != nil}
+}
+
+const (
+	MaxDisplayNameLength = 64
+	MaxBioLength         = 280
+	// bcrypt ignores everything past 72 bytes, and refuses to hash it.
+	maxPasswordBytes = 72
+)
+
+var handlePattern = regexp.MustCompile(`^[A-Za-z0-9_]{3,32}$`)
+
+func (req *SignUpLoginRequest) Validate() error {
+	var v validation.Validator
+	v.Required("email", req.Email)
+	v.Email("email", req.Email)
+	v.Required("password", req.Password)
+	v.MaxBytes("password", req.Password, maxPasswordBytes)
+	return v.Err()
+}
+
+func (req *UpdateProfileRequest) Validate() error {
+	var v validation.Validator
+	if req.Handle != nil {
+		v.Matches("handle", strings.TrimSpace(*req.Handle), handlePattern, "must be 3 to 32 letters, digits or underscores")
+	}
+	if req.DisplayName != nil {
+		v.MaxLength("display_name", *req.DisplayName, MaxDisplayNameLength)
+	}
+	if req.Bio != nil {
+		v.MaxLength("bio", *req.Bio, MaxBioLength)
+	}
+	return v.Err()
+}
+
+func (req *ForgotPasswordRequest) Validate() error {
+	var v validation.Validator
+	v.Required("email", req.Email)
+	v.Email("email", req.Email)
+	return v.Err()
+}
+
+func (req *ResetPasswordRequest) Validate() error {
+	var v validation.Validator
+	v.Required("token", req.Token)
+	v.Required("password", req.Password)
+	v.MaxBytes("password", req.Password, maxPasswordBytes)
+	return v.Err()
+}
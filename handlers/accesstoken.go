@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/bocanada/rest-ws/dto"
+	"github.com/bocanada/rest-ws/helpers"
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/repository"
+	"github.com/bocanada/rest-ws/server"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+	"github.com/segmentio/ksuid"
+)
+
+var AccessTokenNotFound = models.NewError(http.StatusNotFound, "access_token_not_found", "access token not found")
+
+func ListAccessTokensHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		tokens, err := s.Repository().ListAccessTokens(r.Context(), claims.UserId)
+		if err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		resp := make([]dto.AccessToken, 0, len(tokens))
+		for _, token := range tokens {
+			resp = append(resp, dto.NewAccessToken(token))
+		}
+		helpers.NewResponseOk(resp).Send(w, http.StatusOK)
+	}
+}
+
+// CreateAccessTokenHandler issues a personal access token, which scripts
+// send in the Authorization header instead of a JWT. Only its hash is kept,
+// so the response is the one chance to copy it.
+func CreateAccessTokenHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		var req dto.CreateAccessTokenRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		id, err := ksuid.NewRandom()
+		if err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		secret, err := helpers.NewToken()
+		if err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		token := models.AccessTokenPrefix + secret
+		days := req.ExpiresInDays
+		if days == 0 {
+			days = dto.DefaultAccessTokenDays
+		}
+		accessToken := models.AccessToken{
+			Id:        id.String(),
+			UserId:    claims.UserId,
+			Name:      req.Name,
+			TokenHash: helpers.HashToken(token),
+			Scopes:    req.Scopes,
+		}
+		if err = s.Repository().InsertAccessToken(r.Context(), &accessToken, time.Duration(days)*24*time.Hour); err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = UserNotFound
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		resp := dto.CreateAccessTokenResponse{AccessToken: dto.NewAccessToken(&accessToken), Token: token}
+		helpers.NewResponseOk(resp).Send(w, http.StatusOK)
+	}
+}
+
+func DeleteAccessTokenHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		if err = s.Repository().DeleteAccessToken(r.Context(), claims.UserId, mux.Vars(r)["id"]); err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = AccessTokenNotFound
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		helpers.NewResponseOk(dto.MessageResponse{Message: "Access token revoked"}).Send(w, http.StatusOK)
+	}
+}
@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bocanada/rest-ws/dto"
+	"github.com/bocanada/rest-ws/helpers"
+	"github.com/bocanada/rest-ws/mail"
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/repository"
+	"github.com/bocanada/rest-ws/server"
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	InvalidOrExpiredToken = models.NewError(http.StatusBadRequest, "invalid_token", "token is invalid or has expired")
+	EmailNotVerified      = models.NewError(http.StatusForbidden, "email_not_verified", "verify your email address first")
+	EmailAlreadyVerified  = models.NewError(http.StatusConflict, "email_already_verified", "email address is already verified")
+)
+
+func VerifyEmailHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := s.Repository().ConsumeUserToken(r.Context(), helpers.HashToken(r.URL.Query().Get("token")), models.TokenPurposeVerifyEmail)
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				helpers.SendError(w, r, InvalidOrExpiredToken)
+			} else {
+				helpers.SendError(w, r, err)
+			}
+			return
+		}
+		if err = s.Repository().MarkEmailVerified(r.Context(), token.UserId); err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				helpers.SendError(w, r, UserNotFound)
+			} else {
+				helpers.SendError(w, r, err)
+			}
+			return
+		}
+		helpers.NewResponseOk(dto.MessageResponse{Message: "Your email address is verified"}).Send(w, http.StatusOK)
+	}
+}
+
+func ResendVerificationHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		user, err := s.Repository().GetUserById(r.Context(), claims.UserId)
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = UserNotFound
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		if user.EmailVerifiedAt != nil {
+			helpers.SendError(w, r, EmailAlreadyVerified)
+			return
+		}
+		if err = sendVerificationEmail(r.Context(), s, user); err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		helpers.NewResponseOk(dto.MessageResponse{Message: "Verification email sent"}).Send(w, http.StatusOK)
+	}
+}
+
+func ForgotPasswordHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req dto.ForgotPasswordRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		user, err := s.Repository().GetUserByEmail(r.Context(), helpers.NormalizeEmail(req.Email))
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			helpers.SendError(w, r, err)
+			return
+		}
+		// Answer the same way whether or not the account exists, so this
+		// endpoint cannot be used to find out who has one.
+		if err == nil {
+			token, err := newUserToken(r.Context(), s, user.ID, models.TokenPurposePasswordReset, s.Config().PasswordResetTTL)
+			if err != nil {
+				helpers.SendError(w, r, err)
+				return
+			}
+			sendMail(s, mail.Message{
+				To:      user.Email,
+				Subject: "Reset your password",
+				Body: fmt.Sprintf("Someone asked to reset the password of your account.\n\n"+
+					"Within %s, send this token along with your new password to %s/password/reset:\n\n%s\n\n"+
+					"If it wasn't you, you can ignore this email.", s.Config().PasswordResetTTL, s.Config().PublicUrl, token),
+			})
+		}
+		helpers.NewResponseOk(dto.MessageResponse{Message: "If the account exists, a reset email is on its way"}).Send(w, http.StatusOK)
+	}
+}
+
+func ResetPasswordHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req dto.ResetPasswordRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		hashedPasswd, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		token, err := s.Repository().ConsumeUserToken(r.Context(), helpers.HashToken(req.Token), models.TokenPurposePasswordReset)
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				helpers.SendError(w, r, InvalidOrExpiredToken)
+			} else {
+				helpers.SendError(w, r, err)
+			}
+			return
+		}
+		if err = s.Repository().UpdateUserPassword(r.Context(), token.UserId, string(hashedPasswd)); err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				helpers.SendError(w, r, UserNotFound)
+			} else {
+				helpers.SendError(w, r, err)
+			}
+			return
+		}
+		helpers.NewResponseOk(dto.MessageResponse{Message: "Your password has been changed"}).Send(w, http.StatusOK)
+	}
+}
+
+func sendVerificationEmail(ctx context.Context, s server.Server, user *models.User) error {
+	token, err := newUserToken(ctx, s, user.ID, models.TokenPurposeVerifyEmail, s.Config().VerifyEmailTTL)
+	if err != nil {
+		return err
+	}
+	link := s.Config().PublicUrl + "/verify-email?" + url.Values{"token": {token}}.Encode()
+	sendMail(s, mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Welcome!\n\nOpen this link within %s to verify your email address:\n\n%s\n\n"+
+			"You will be able to post once it is verified.", s.Config().VerifyEmailTTL, link),
+	})
+	return nil
+}
+
+// newUserToken stores a new single-use token for userId and returns it. Only
+// its hash is kept, so this is the one chance to mail it.
+func newUserToken(ctx context.Context, s server.Server, userId string, purpose string, ttl time.Duration) (string, error) {
+	token, err := helpers.NewToken()
+	if err != nil {
+		return "", err
+	}
+	userToken := models.UserToken{
+		TokenHash: helpers.HashToken(token),
+		UserId:    userId,
+		Purpose:   purpose,
+	}
+	if err = s.Repository().InsertUserToken(ctx, &userToken, ttl); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// sendMail delivers msg in the background: SMTP servers can be slow, and
+// how long a request takes must not depend on whether an email was sent.
+func sendMail(s server.Server, msg mail.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := s.Mailer().Send(ctx, msg); err != nil {
+			s.Logger().Error("sending email failed", "to", msg.To, "error", err)
+		}
+	}()
+}
+
+// requireVerifiedEmail sends an error response and returns false unless
+// userId has verified their email address.
+func requireVerifiedEmail(s server.Server, w http.ResponseWriter, r *http.Request, userId string) bool {
+	user, err := s.Repository().GetUserById(r.Context(), userId)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			err = UserNotFound
+		}
+		helpers.SendError(w, r, err)
+		return false
+	}
+	if user.EmailVerifiedAt == nil {
+		helpers.SendError(w, r, EmailNotVerified)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,1132 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bocanada/rest-ws/dto"
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/server"
+	"github.com/bocanada/rest-ws/testserver"
+	"github.com/bocanada/rest-ws/totp"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSignUpAndLogin(t *testing.T) {
+	t.Parallel()
+	s := testserver.New(t)
+	credentials := dto.SignUpLoginRequest{Email: "Someone@Example.com", Password: "secret"}
+
+	resp, signUp := testserver.Call[dto.SignUpResponse](s, http.MethodPost, "/signup", "", credentials)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("signup: status %d, error %q", resp.StatusCode, signUp.Error)
+	}
+	if signUp.Result.Email != "someone@example.com" {
+		t.Errorf("signup email = %q, want it normalised", signUp.Result.Email)
+	}
+	if msg := s.Mail.WaitFor(t, "someone@example.com"); !strings.Contains(msg.Body, "/verify-email?token=") {
+		t.Errorf("verification email has no link: %q", msg.Body)
+	}
+
+	resp, dup := testserver.Call[any](s, http.MethodPost, "/signup", "", dto.SignUpLoginRequest{Email: "SOMEONE@example.com", Password: "other"})
+	if resp.StatusCode != http.StatusConflict || dup.Code != "email_taken" {
+		t.Errorf("duplicate signup: status %d, code %q, want 409 email_taken", resp.StatusCode, dup.Code)
+	}
+
+	resp, login := testserver.Call[dto.LoginResponse](s, http.MethodPost, "/login", "", credentials)
+	if resp.StatusCode != http.StatusOK || login.Result.Token == "" {
+		t.Fatalf("login: status %d, error %q", resp.StatusCode, login.Error)
+	}
+	resp, me := testserver.Call[dto.Me](s, http.MethodGet, "/me", login.Result.Token, nil)
+	if resp.StatusCode != http.StatusOK || me.Result.Id != signUp.Result.Id {
+		t.Errorf("me: status %d, id %q, want %q", resp.StatusCode, me.Result.Id, signUp.Result.Id)
+	}
+
+	for _, wrong := range []dto.SignUpLoginRequest{
+		{Email: "someone@example.com", Password: "wrong"},
+		{Email: "nobody@example.com", Password: "secret"},
+	} {
+		resp, failed := testserver.Call[any](s, http.MethodPost, "/login", "", wrong)
+		if resp.StatusCode != http.StatusUnauthorized || failed.Code != "invalid_credentials" {
+			t.Errorf("login as %s: status %d, code %q, want 401 invalid_credentials", wrong.Email, resp.StatusCode, failed.Code)
+		}
+	}
+}
+
+func TestValidationErrors(t *testing.T) {
+	t.Parallel()
+	s := testserver.New(t)
+	_, token := s.NewUser()
+
+	resp, body := testserver.Call[any](s, http.MethodPost, "/api/v1/posts", token, dto.UpsertPostRequest{
+		PostContent: strings.Repeat("x", dto.MaxPostContentLength+1),
+		Visibility:  "everyone",
+	})
+	if resp.StatusCode != http.StatusUnprocessableEntity || body.Code != "validation_failed" {
+		t.Fatalf("status %d, code %q, want 422 validation_failed", resp.StatusCode, body.Code)
+	}
+	fields := make(map[string]string)
+	for _, e := range body.Errors {
+		fields[e.Field] = e.Code
+	}
+	if fields["post_content"] != "too_long" || fields["visibility"] != "invalid_choice" {
+		t.Errorf("field errors = %v, want post_content too_long and visibility invalid_choice", fields)
+	}
+
+	resp = s.Do(http.MethodPost, "/api/v1/posts", token, strings.NewReader("{"))
+	if body := testserver.Decode[any](t, resp); resp.StatusCode != http.StatusBadRequest || body.Code != "malformed_body" {
+		t.Errorf("malformed body: status %d, code %q, want 400 malformed_body", resp.StatusCode, body.Code)
+	}
+}
+
+func TestPostLifecycle(t *testing.T) {
+	t.Parallel()
+	s := testserver.New(t)
+	author, token := s.NewUser()
+	_, otherToken := s.NewUser()
+	ws := s.DialWebSocket("")
+
+	resp, created := testserver.Call[dto.InsertPostResponse](s, http.MethodPost, "/api/v1/posts", token, dto.UpsertPostRequest{PostContent: "hello"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("insert: status %d, error %q", resp.StatusCode, created.Error)
+	}
+	var broadcast dto.Post
+	testserver.DecodePayload(t, ws.Expect(models.PostCreatedMessage), &broadcast)
+	if broadcast.Id != created.Result.Id || broadcast.UserId != author.ID {
+		t.Errorf("broadcast post = %+v, want %s by %s", broadcast, created.Result.Id, author.ID)
+	}
+
+	path := "/posts/" + created.Result.Id
+	resp, got := testserver.Call[dto.Post](s, http.MethodGet, path, token, nil)
+	if resp.StatusCode != http.StatusOK || got.Result.PostContent != "hello" {
+		t.Fatalf("get: status %d, post %+v", resp.StatusCode, got.Result)
+	}
+	if resp.Header.Get("ETag") == "" {
+		t.Error("get: no ETag")
+	}
+
+	resp, forbidden := testserver.Call[any](s, http.MethodDelete, "/api/v1"+path, otherToken, nil)
+	if resp.StatusCode != http.StatusForbidden || forbidden.Code != "not_post_author" {
+		t.Errorf("delete by another user: status %d, code %q, want 403 not_post_author", resp.StatusCode, forbidden.Code)
+	}
+	resp, _ = testserver.Call[dto.Post](s, http.MethodDelete, "/api/v1"+path, token, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete: status %d", resp.StatusCode)
+	}
+	ws.Expect(models.PostDeletedMessage)
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		prefix := ""
+		if method == http.MethodDelete {
+			prefix = "/api/v1"
+		}
+		resp, missing := testserver.Call[any](s, method, prefix+path, token, nil)
+		if resp.StatusCode != http.StatusNotFound || missing.Code != "post_not_found" {
+			t.Errorf("%s of a deleted post: status %d, code %q, want 404 post_not_found", method, resp.StatusCode, missing.Code)
+		}
+	}
+}
+
+func TestDraftsAreNotBroadcast(t *testing.T) {
+	t.Parallel()
+	s := testserver.New(t)
+	_, token := s.NewUser()
+	ws := s.DialWebSocket("")
+
+	resp, _ := testserver.Call[dto.InsertPostResponse](s, http.MethodPost, "/api/v1/posts", token, dto.UpsertPostRequest{
+		PostContent: "draft",
+		Status:      models.PostStatusDraft,
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("insert: status %d", resp.StatusCode)
+	}
+	ws.ExpectNone(100 * time.Millisecond)
+}
+
+func TestProblemDetails(t *testing.T) {
+	t.Parallel()
+	s := testserver.New(t)
+	_, token := s.NewUser()
+
+	req, err := http.NewRequest(http.MethodGet, s.URL+"/posts/missing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Accept", "application/problem+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("Content-Type") != "application/problem+json" {
+		t.Errorf("status %d, content type %q, want 404 application/problem+json", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestServersAreIsolated(t *testing.T) {
+	t.Parallel()
+	a, b := testserver.New(t), testserver.New(t)
+	user, _ := a.NewUser()
+
+	resp, _ := testserver.Call[dto.Me](b, http.MethodGet, "/me", b.Token(user.ID), nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("user of another server: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	t.Parallel()
+	const admin = "admin-user"
+	s := testserver.New(t, func(cfg *server.Config) {
+		cfg.AdminUserIds = []string{admin}
+	})
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		resp, body := testserver.Call[dto.HealthResponse](s, http.MethodGet, path, "", nil)
+		if resp.StatusCode != http.StatusOK || body.Result.Status != "ok" {
+			t.Errorf("%s: status %d, body %+v", path, resp.StatusCode, body)
+		}
+	}
+
+	_, token := s.NewUser()
+	resp, body := testserver.Call[any](s, http.MethodGet, "/status", token, nil)
+	if resp.StatusCode != http.StatusForbidden || body.Code != "not_admin" {
+		t.Errorf("status as a user: status %d, code %q, want 403 not_admin", resp.StatusCode, body.Code)
+	}
+
+	s.DialWebSocket("")
+	resp, status := testserver.Call[dto.StatusResponse](s, http.MethodGet, "/status", s.Token(admin), nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status as an admin: status %d", resp.StatusCode)
+	}
+	if status.Result.WebSocketClients != 1 || status.Result.Checks["database"] != "ok" || status.Result.Version == "" {
+		t.Errorf("status = %+v", status.Result)
+	}
+}
+
+func TestReadyzHidesFailures(t *testing.T) {
+	t.Parallel()
+	const admin = "admin-user"
+	s := testserver.New(t, func(cfg *server.Config) {
+		cfg.AdminUserIds = []string{admin}
+	})
+	s.Repo.Close()
+
+	resp, body := testserver.Call[dto.HealthResponse](s, http.MethodGet, "/readyz", "", nil)
+	if resp.StatusCode != http.StatusServiceUnavailable || body.Result.Checks["database"] != "unavailable" {
+		t.Errorf("readyz: status %d, checks %v, want 503 with the database unavailable", resp.StatusCode, body.Result.Checks)
+	}
+	resp, status := testserver.Call[dto.StatusResponse](s, http.MethodGet, "/status", s.Token(admin), nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(status.Result.Checks["database"], "closed") {
+		t.Errorf("status: status %d, checks %v, want the full error", resp.StatusCode, status.Result.Checks)
+	}
+	if !strings.Contains(s.Logs.String(), "memory repository is closed") {
+		t.Errorf("the failure is not logged:\n%s", s.Logs.String())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	s := testserver.New(t)
+	_, token := s.NewUser()
+	s.DialWebSocket("")
+
+	resp, _ := testserver.Call[any](s, http.MethodGet, "/posts/missing", token, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("get: status %d", resp.StatusCode)
+	}
+	resp, _ = testserver.Call[any](s, http.MethodPost, "/api/v1/posts", token, dto.UpsertPostRequest{})
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("insert: status %d", resp.StatusCode)
+	}
+	resp = s.Do(http.MethodGet, "/metrics", "", nil)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`restws_http_requests_total{code="404",method="GET",route="/posts/{id}"} 1`,
+		`restws_http_requests_total{code="422",method="POST",route="/api/v1/posts"} 1`,
+		`restws_http_request_duration_seconds_count{method="GET",route="/posts/{id}"} 1`,
+		`restws_repository_errors_total{kind="not_found",method="GetPostById"} 1`,
+		`restws_repository_call_duration_seconds_count{method="GetPostById"} 1`,
+		`restws_websocket_clients 1`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+}
+
+func TestRequestIds(t *testing.T) {
+	t.Parallel()
+	s := testserver.New(t)
+
+	resp := s.Do(http.MethodGet, "/healthz", "", nil)
+	resp.Body.Close()
+	generated := resp.Header.Get("X-Request-ID")
+	if generated == "" {
+		t.Fatal("no X-Request-ID in the response")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s.URL+"/posts/missing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Request-ID", "client-chosen-id")
+	req.Header.Set("Origin", "https://app.example")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("X-Request-ID"); got != "client-chosen-id" {
+		t.Errorf("X-Request-ID = %q, want the one the client sent", got)
+	}
+	// Browsers only let scripts read the headers CORS exposes.
+	if exposed := resp.Header.Get("Access-Control-Expose-Headers"); !strings.Contains(strings.ToLower(exposed), "x-request-id") {
+		t.Errorf("Access-Control-Expose-Headers = %q, want X-Request-ID in it", exposed)
+	}
+
+	s.DialWebSocket("")
+	entries := logEntries(t, s.Logs.String())
+	for _, want := range []map[string]any{
+		{"msg": "request", "request_id": generated, "route": "/healthz", "status": 200.0},
+		{"msg": "request", "request_id": "client-chosen-id", "route": "/posts/{id}", "status": 401.0},
+		{"msg": "websocket connected", "user_id": ""},
+	} {
+		if !containsEntry(entries, want) {
+			t.Errorf("no log entry with %v in:\n%s", want, s.Logs.String())
+		}
+	}
+}
+
+func logEntries(t *testing.T, logs string) []map[string]any {
+	t.Helper()
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(logs), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// containsEntry reports whether one of entries has every field of want.
+func containsEntry(entries []map[string]any, want map[string]any) bool {
+	for _, entry := range entries {
+		matches := true
+		for key, value := range want {
+			if entry[key] != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTracing(t *testing.T) {
+	t.Parallel()
+	s := testserver.New(t)
+	_, token := s.NewUser()
+	s.DialWebSocket("")
+
+	const traceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	body, err := json.Marshal(dto.UpsertPostRequest{PostContent: "traced"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL+"/api/v1/posts", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", token)
+	req.Header.Set("traceparent", "00-"+traceId+"-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("insert: status %d", resp.StatusCode)
+	}
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range s.Spans.GetSpans() {
+		if span.SpanContext.TraceID().String() == traceId {
+			spans[span.Name] = span
+		}
+	}
+	request, ok := spans["POST /api/v1/posts"]
+	if !ok {
+		t.Fatalf("no request span in the incoming trace, got %v", spans)
+	}
+	insert, ok := spans["repository.InsertPost"]
+	if !ok {
+		t.Fatalf("no InsertPost span in the incoming trace, got %v", spans)
+	}
+	if insert.Parent.SpanID() != request.SpanContext.SpanID() {
+		t.Error("InsertPost span is not a child of the request span")
+	}
+	if !hasAttribute(insert.Attributes, "db.operation", "INSERT") {
+		t.Errorf("InsertPost attributes = %v, want db.operation INSERT", insert.Attributes)
+	}
+	broadcast, ok := spans["hub.broadcast"]
+	if !ok {
+		t.Fatalf("no broadcast span in the incoming trace, got %v", spans)
+	}
+	if !hasAttribute(broadcast.Attributes, "websocket.recipients", "1") {
+		t.Errorf("broadcast attributes = %v, want 1 recipient", broadcast.Attributes)
+	}
+}
+
+func hasAttribute(attributes []attribute.KeyValue, key string, value string) bool {
+	for _, a := range attributes {
+		if string(a.Key) == key && a.Value.Emit() == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRateLimits(t *testing.T) {
+	t.Parallel()
+	s := testserver.New(t, func(cfg *server.Config) {
+		cfg.RateLimits = []string{"POST /login=ip:2/1m", "POST /api/v1/posts=user:1/1m"}
+		cfg.HubMessageLimit = 3
+		cfg.HubMessagePeriod = time.Minute
+	})
+	credentials := dto.SignUpLoginRequest{Email: "nobody@example.com", Password: "secret"}
+
+	for i, want := range []string{"1", "0"} {
+		resp, _ := testserver.Call[any](s, http.MethodPost, "/login", "", credentials)
+		if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("RateLimit-Remaining") != want {
+			t.Fatalf("login %d: status %d, RateLimit-Remaining %q, want 401 and %s", i, resp.StatusCode, resp.Header.Get("RateLimit-Remaining"), want)
+		}
+	}
+	resp, body := testserver.Call[any](s, http.MethodPost, "/login", "", credentials)
+	if resp.StatusCode != http.StatusTooManyRequests || body.Code != "rate_limited" {
+		t.Errorf("login over the limit: status %d, code %q, want 429 rate_limited", resp.StatusCode, body.Code)
+	}
+	if resp.Header.Get("Retry-After") == "" || resp.Header.Get("RateLimit-Limit") != "2" {
+		t.Errorf("login over the limit: headers %v", resp.Header)
+	}
+	if resp, _ := testserver.Call[any](s, http.MethodGet, "/healthz", "", nil); resp.StatusCode != http.StatusOK || resp.Header.Get("RateLimit-Limit") != "" {
+		t.Errorf("unlimited route: status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+
+	// Users have a bucket each.
+	for i := 0; i < 2; i++ {
+		_, token := s.NewUser()
+		resp, _ := testserver.Call[any](s, http.MethodPost, "/api/v1/posts", token, dto.UpsertPostRequest{})
+		if resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("user %d: status %d, want their first post through", i, resp.StatusCode)
+		}
+		resp, _ = testserver.Call[any](s, http.MethodPost, "/api/v1/posts", token, dto.UpsertPostRequest{})
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("user %d: status %d, want their second post limited", i, resp.StatusCode)
+		}
+	}
+
+	// Access tokens count towards their user, and only once checked.
+	_, token := s.NewUser()
+	var pats []string
+	for i := 0; i < 2; i++ {
+		_, created := testserver.Call[dto.CreateAccessTokenResponse](s, http.MethodPost, "/api/v1/me/tokens", token, dto.CreateAccessTokenRequest{Name: "ci", Scopes: []string{models.ScopePostsWrite}})
+		pats = append(pats, created.Result.Token)
+	}
+	if resp := s.Do(http.MethodPost, "/api/v1/posts", models.AccessTokenPrefix+"forged", dto.UpsertPostRequest{}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("forged access token: status %d, want 401", resp.StatusCode)
+	}
+	if resp := s.Do(http.MethodPost, "/api/v1/posts", pats[0], dto.UpsertPostRequest{}); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("first access token: status %d, want the first post through", resp.StatusCode)
+	}
+	if resp := s.Do(http.MethodPost, "/api/v1/posts", pats[1], dto.UpsertPostRequest{}); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("second access token of the user: status %d, want it limited", resp.StatusCode)
+	}
+
+	ws := s.DialWebSocket("")
+	for i := 0; i < 4; i++ {
+		ws.Send(map[string]string{"type": "ping"})
+	}
+	ws.ExpectClosed(websocket.ClosePolicyViolation)
+}
+
+func TestLoginLockout(t *testing.T) {
+	t.Parallel()
+	s := testserver.New(t, func(cfg *server.Config) {
+		cfg.RateLimits = nil
+		cfg.LoginDelayAfter = 10
+		cfg.LoginLockoutThreshold = 3
+		cfg.LoginIPLockoutThreshold = 8
+	})
+	user, _ := s.NewUser()
+
+	for _, email := range []string{user.Email, "nobody@example.com"} {
+		for i := 0; i < 3; i++ {
+			resp, body := testserver.Call[any](s, http.MethodPost, "/login", "", dto.SignUpLoginRequest{Email: email, Password: "wrong"})
+			if resp.StatusCode != http.StatusUnauthorized || body.Code != "invalid_credentials" {
+				t.Fatalf("failed login %d as %s: status %d, code %q", i, email, resp.StatusCode, body.Code)
+			}
+		}
+		// Unknown emails lock the same way, so lockouts reveal nothing.
+		resp, body := testserver.Call[any](s, http.MethodPost, "/login", "", dto.SignUpLoginRequest{Email: email, Password: testserver.Password})
+		if resp.StatusCode != http.StatusLocked || body.Code != "login_locked" || resp.Header.Get("Retry-After") == "" {
+			t.Errorf("login to a locked account as %s: status %d, code %q, Retry-After %q", email, resp.StatusCode, body.Code, resp.Header.Get("Retry-After"))
+		}
+	}
+	if msg := s.Mail.WaitFor(t, user.Email); msg.Subject != "Your account was locked" {
+		t.Errorf("email subject = %q, want the lockout notice", msg.Subject)
+	}
+
+	// Other accounts still work until the address itself is locked out.
+	other, _ := s.NewUser()
+	resp, _ := testserver.Call[dto.LoginResponse](s, http.MethodPost, "/login", "", dto.SignUpLoginRequest{Email: other.Email, Password: testserver.Password})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("login to another account: status %d", resp.StatusCode)
+	}
+	for i := 0; i < 2; i++ {
+		testserver.Call[any](s, http.MethodPost, "/login", "", dto.SignUpLoginRequest{Email: other.Email, Password: "wrong"})
+	}
+	third, _ := s.NewUser()
+	resp, body := testserver.Call[any](s, http.MethodPost, "/login", "", dto.SignUpLoginRequest{Email: third.Email, Password: testserver.Password})
+	if resp.StatusCode != http.StatusLocked || body.Code != "login_locked" {
+		t.Errorf("login from a locked out address: status %d, code %q", resp.StatusCode, body.Code)
+	}
+}
+
+func TestLoginDelays(t *testing.T) {
+	t.Parallel()
+	s := testserver.New(t, func(cfg *server.Config) {
+		cfg.RateLimits = nil
+		cfg.LoginDelayAfter = 1
+	})
+	user, _ := s.NewUser()
+
+	resp, _ := testserver.Call[any](s, http.MethodPost, "/login", "", dto.SignUpLoginRequest{Email: user.Email, Password: "wrong"})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("failed login: status %d", resp.StatusCode)
+	}
+	resp, body := testserver.Call[any](s, http.MethodPost, "/login", "", dto.SignUpLoginRequest{Email: user.Email, Password: testserver.Password})
+	if resp.StatusCode != http.StatusTooManyRequests || body.Code != "login_delayed" || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("login right after a failure: status %d, code %q, Retry-After %q", resp.StatusCode, body.Code, resp.Header.Get("Retry-After"))
+	}
+
+	time.Sleep(time.Second)
+	resp, _ = testserver.Call[dto.LoginResponse](s, http.MethodPost, "/login", "", dto.SignUpLoginRequest{Email: user.Email, Password: testserver.Password})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login after the delay: status %d", resp.StatusCode)
+	}
+	if _, err := s.Repo.GetLoginFailures(context.Background(), "email:"+user.Email); err == nil {
+		t.Error("failed logins not cleared by a successful one")
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	t.Parallel()
+	// Wrong codes count as failed logins of the address as well; they must
+	// not delay the attempts this test makes next.
+	s := testserver.New(t, func(cfg *server.Config) {
+		cfg.LoginDelayAfter = 10
+	})
+	user, token := s.NewUser()
+	password := dto.SignUpLoginRequest{Email: user.Email, Password: testserver.Password}
+
+	resp, enrollment := testserver.Call[dto.TwoFactorEnrollment](s, http.MethodPost, "/api/v1/me/2fa", token, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("enroll: status %d", resp.StatusCode)
+	}
+	uri, err := url.Parse(enrollment.Result.ProvisioningURI)
+	if err != nil || uri.Scheme != "otpauth" {
+		t.Fatalf("provisioning uri %q: %v", enrollment.Result.ProvisioningURI, err)
+	}
+	secret := uri.Query().Get("secret")
+	code := func(steps int64) string {
+		c, err := totp.Code(secret, totp.Step(time.Now())+steps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	resp, body := testserver.Call[any](s, http.MethodPost, "/api/v1/me/2fa/confirm", token, dto.TwoFactorCodeRequest{Code: "abcdef"})
+	if resp.StatusCode != http.StatusUnauthorized || body.Code != "invalid_two_factor_code" {
+		t.Errorf("confirm with a wrong code: status %d, code %q", resp.StatusCode, body.Code)
+	}
+	resp, recovery := testserver.Call[dto.RecoveryCodesResponse](s, http.MethodPost, "/api/v1/me/2fa/confirm", token, dto.TwoFactorCodeRequest{Code: code(0)})
+	if resp.StatusCode != http.StatusOK || len(recovery.Result.RecoveryCodes) != 10 {
+		t.Fatalf("confirm: status %d, %d recovery codes", resp.StatusCode, len(recovery.Result.RecoveryCodes))
+	}
+
+	// Every login now takes a code, which only works once.
+	challenge := func() string {
+		t.Helper()
+		resp, login := testserver.Call[dto.LoginResponse](s, http.MethodPost, "/login", "", password)
+		if resp.StatusCode != http.StatusOK || !login.Result.TwoFactorRequired || login.Result.Token != "" || login.Result.ChallengeToken == "" {
+			t.Fatalf("login: status %d, result %+v", resp.StatusCode, login.Result)
+		}
+		return login.Result.ChallengeToken
+	}
+	resp, body = testserver.Call[any](s, http.MethodPost, "/login/2fa", "", dto.LoginChallengeRequest{ChallengeToken: challenge(), Code: code(0)})
+	if resp.StatusCode != http.StatusUnauthorized || body.Code != "invalid_two_factor_code" {
+		t.Errorf("login with a used code: status %d, code %q", resp.StatusCode, body.Code)
+	}
+	resp, login := testserver.Call[dto.LoginResponse](s, http.MethodPost, "/login/2fa", "", dto.LoginChallengeRequest{ChallengeToken: challenge(), Code: code(1)})
+	if resp.StatusCode != http.StatusOK || login.Result.Token == "" {
+		t.Fatalf("login with a code: status %d", resp.StatusCode)
+	}
+	if resp, _ := testserver.Call[dto.Me](s, http.MethodGet, "/me", login.Result.Token, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("me with the token of a two-factor login: status %d", resp.StatusCode)
+	}
+
+	recoveryCode := strings.ToUpper(recovery.Result.RecoveryCodes[0])
+	resp, _ = testserver.Call[dto.LoginResponse](s, http.MethodPost, "/login/2fa", "", dto.LoginChallengeRequest{ChallengeToken: challenge(), Code: recoveryCode})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("login with a recovery code: status %d", resp.StatusCode)
+	}
+	resp, _ = testserver.Call[any](s, http.MethodPost, "/login/2fa", "", dto.LoginChallengeRequest{ChallengeToken: challenge(), Code: recoveryCode})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("login with a used recovery code: status %d", resp.StatusCode)
+	}
+	resp, status := testserver.Call[dto.TwoFactorStatus](s, http.MethodGet, "/api/v1/me/2fa", token, nil)
+	if resp.StatusCode != http.StatusOK || !status.Result.Enabled || status.Result.RecoveryCodesLeft != 9 {
+		t.Errorf("status: %d, %+v", resp.StatusCode, status.Result)
+	}
+
+	resp, _ = testserver.Call[any](s, http.MethodDelete, "/api/v1/me/2fa", token, dto.TwoFactorCodeRequest{Code: recovery.Result.RecoveryCodes[1]})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("disable: status %d", resp.StatusCode)
+	}
+	resp, login = testserver.Call[dto.LoginResponse](s, http.MethodPost, "/login", "", password)
+	if resp.StatusCode != http.StatusOK || login.Result.Token == "" {
+		t.Errorf("login once disabled: status %d, result %+v", resp.StatusCode, login.Result)
+	}
+}
+
+func TestWrongTwoFactorCodesLockTheAccount(t *testing.T) {
+	t.Parallel()
+	s := testserver.New(t, func(cfg *server.Config) {
+		cfg.RateLimits = nil
+		cfg.LoginDelayAfter = 10
+		cfg.LoginLockoutThreshold = 3
+	})
+	// enroll returns the secret of a new enrollment of the user of token.
+	enroll := func(token string) string {
+		t.Helper()
+		resp, enrollment := testserver.Call[dto.TwoFactorEnrollment](s, http.MethodPost, "/api/v1/me/2fa", token, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("enroll: status %d", resp.StatusCode)
+		}
+		uri, err := url.Parse(enrollment.Result.ProvisioningURI)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uri.Query().Get("secret")
+	}
+	code := func(secret string) string {
+		t.Helper()
+		c, err := totp.Code(secret, totp.Step(time.Now()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	confirming, confirmingToken := s.NewUser()
+	confirmingSecret := enroll(confirmingToken)
+	disabling, disablingToken := s.NewUser()
+	disablingSecret := enroll(disablingToken)
+	if resp := s.Do(http.MethodPost, "/api/v1/me/2fa/confirm", disablingToken, dto.TwoFactorCodeRequest{Code: code(disablingSecret)}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("confirm: status %d", resp.StatusCode)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		user   *models.User
+		method string
+		path   string
+		token  string
+		secret string
+	}{
+		{"confirm", confirming, http.MethodPost, "/api/v1/me/2fa/confirm", confirmingToken, confirmingSecret},
+		{"disable", disabling, http.MethodDelete, "/api/v1/me/2fa", disablingToken, disablingSecret},
+	} {
+		for i := 0; i < 3; i++ {
+			resp, body := testserver.Call[any](s, tc.method, tc.path, tc.token, dto.TwoFactorCodeRequest{Code: "wrong-code"})
+			if resp.StatusCode != http.StatusUnauthorized || body.Code != "invalid_two_factor_code" {
+				t.Fatalf("%s with wrong code %d: status %d, code %q", tc.name, i, resp.StatusCode, body.Code)
+			}
+		}
+		resp, body := testserver.Call[any](s, tc.method, tc.path, tc.token, dto.TwoFactorCodeRequest{Code: code(tc.secret)})
+		if resp.StatusCode != http.StatusLocked || body.Code != "login_locked" {
+			t.Errorf("%s once locked: status %d, code %q, want 423 login_locked", tc.name, resp.StatusCode, body.Code)
+		}
+		resp, body = testserver.Call[any](s, http.MethodPost, "/login", "", dto.SignUpLoginRequest{Email: tc.user.Email, Password: testserver.Password})
+		if resp.StatusCode != http.StatusLocked || body.Code != "login_locked" {
+			t.Errorf("login after wrong %s codes: status %d, code %q, want 423 login_locked", tc.name, resp.StatusCode, body.Code)
+		}
+		if msg := s.Mail.WaitFor(t, tc.user.Email); msg.Subject != "Your account was locked" {
+			t.Errorf("email subject = %q, want the lockout notice", msg.Subject)
+		}
+	}
+}
+
+func TestAccessTokens(t *testing.T) {
+	t.Parallel()
+	s := testserver.New(t)
+	_, token := s.NewUser()
+
+	resp, body := testserver.Call[any](s, http.MethodPost, "/api/v1/me/tokens", token, dto.CreateAccessTokenRequest{Name: "ci", Scopes: []string{"posts:admin"}})
+	if resp.StatusCode != http.StatusUnprocessableEntity || len(body.Errors) != 1 || body.Errors[0].Field != "scopes" {
+		t.Errorf("create with an unknown scope: status %d, fields %+v", resp.StatusCode, body.Errors)
+	}
+	resp, created := testserver.Call[dto.CreateAccessTokenResponse](s, http.MethodPost, "/api/v1/me/tokens", token, dto.CreateAccessTokenRequest{Name: "ci", Scopes: []string{models.ScopePostsRead}})
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(created.Result.Token, models.AccessTokenPrefix) {
+		t.Fatalf("create: status %d, result %+v", resp.StatusCode, created.Result)
+	}
+	if days := time.Until(created.Result.ExpiresAt).Hours() / 24; days < dto.DefaultAccessTokenDays-1 || days > dto.DefaultAccessTokenDays {
+		t.Errorf("create: expires in %.1f days, want %d", days, dto.DefaultAccessTokenDays)
+	}
+	pat := created.Result.Token
+
+	_, post := testserver.Call[dto.InsertPostResponse](s, http.MethodPost, "/api/v1/posts", token, dto.UpsertPostRequest{PostContent: "hello"})
+	if resp, got := testserver.Call[dto.Post](s, http.MethodGet, "/posts/"+post.Result.Id, pat, nil); resp.StatusCode != http.StatusOK || got.Result.Id != post.Result.Id {
+		t.Errorf("read a post with the token: status %d", resp.StatusCode)
+	}
+	resp, body = testserver.Call[any](s, http.MethodPost, "/api/v1/posts", pat, dto.UpsertPostRequest{PostContent: "from ci"})
+	if resp.StatusCode != http.StatusForbidden || body.Code != "insufficient_scope" {
+		t.Errorf("write a post without posts:write: status %d, code %q", resp.StatusCode, body.Code)
+	}
+	// Tokens cannot manage tokens, whatever their scopes.
+	resp, body = testserver.Call[any](s, http.MethodPost, "/api/v1/me/tokens", pat, dto.CreateAccessTokenRequest{Name: "escalate", Scopes: models.Scopes})
+	if resp.StatusCode != http.StatusForbidden || body.Code != "insufficient_scope" {
+		t.Errorf("create a token with a token: status %d, code %q", resp.StatusCode, body.Code)
+	}
+
+	resp, list := testserver.Call[[]dto.AccessToken](s, http.MethodGet, "/api/v1/me/tokens", token, nil)
+	if resp.StatusCode != http.StatusOK || len(list.Result) != 1 || list.Result[0].Id != created.Result.Id || list.Result[0].LastUsedAt == nil {
+		t.Fatalf("list: status %d, result %+v", resp.StatusCode, list.Result)
+	}
+	_, other := s.NewUser()
+	if resp := s.Do(http.MethodDelete, "/api/v1/me/tokens/"+created.Result.Id, other, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("revoke the token of another user: status %d", resp.StatusCode)
+	}
+	if resp := s.Do(http.MethodDelete, "/api/v1/me/tokens/"+created.Result.Id, token, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("revoke: status %d", resp.StatusCode)
+	}
+	if resp := s.Do(http.MethodGet, "/posts/"+post.Result.Id, pat, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("read a post with a revoked token: status %d", resp.StatusCode)
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	t.Parallel()
+	s := testserver.New(t, func(cfg *server.Config) {
+		cfg.MaxUploadSize = 1024
+	})
+	_, token := s.NewUser()
+	_, post := testserver.Call[dto.InsertPostResponse](s, http.MethodPost, "/api/v1/posts", token, dto.UpsertPostRequest{PostContent: "with files"})
+	path := "/api/v1/posts/" + post.Result.Id + "/attachments"
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 100)...)
+
+	for name, tc := range map[string]struct {
+		content []byte
+		status  int
+		code    string
+	}{
+		"html named png": {[]byte("<html><script>alert(1)</script></html>"), http.StatusUnsupportedMediaType, "unsupported_content_type"},
+		"too large":      {append(png, bytes.Repeat([]byte{0}, 1024)...), http.StatusRequestEntityTooLarge, "attachment_too_large"},
+	} {
+		resp := s.Upload(http.MethodPost, path, token, "image.png", tc.content)
+		if body := testserver.Decode[any](t, resp); resp.StatusCode != tc.status || body.Code != tc.code {
+			t.Errorf("%s: status %d, code %q, want %d %s", name, resp.StatusCode, body.Code, tc.status, tc.code)
+		}
+	}
+	_, other := s.NewUser()
+	if resp := s.Upload(http.MethodPost, path, other, "image.png", png); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("upload to the post of another user: status %d", resp.StatusCode)
+	}
+
+	resp := s.Upload(http.MethodPost, path, token, "../../image.png", png)
+	uploaded := testserver.Decode[dto.Attachment](t, resp)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload: status %d", resp.StatusCode)
+	}
+	if a := uploaded.Result; a.ContentType != "image/png" || a.FileName != "image.png" || a.Size != int64(len(png)) || a.URL == "" {
+		t.Errorf("upload = %+v", a)
+	}
+	resp, list := testserver.Call[[]dto.Attachment](s, http.MethodGet, "/posts/"+post.Result.Id+"/attachments", token, nil)
+	if resp.StatusCode != http.StatusOK || len(list.Result) != 1 || list.Result[0].Id != uploaded.Result.Id {
+		t.Errorf("list: status %d, result %+v", resp.StatusCode, list.Result)
+	}
+
+	download := s.Do(http.MethodGet, uploaded.Result.URL, "", nil)
+	content, _ := io.ReadAll(download.Body)
+	download.Body.Close()
+	if download.StatusCode != http.StatusOK || !bytes.Equal(content, png) {
+		t.Fatalf("download: status %d, %d bytes", download.StatusCode, len(content))
+	}
+	if h := download.Header; h.Get("Content-Type") != "image/png" || h.Get("X-Content-Type-Options") != "nosniff" || !strings.HasPrefix(h.Get("Content-Disposition"), "attachment") {
+		t.Errorf("download headers: %v", h)
+	}
+	signed, _ := url.Parse(uploaded.Result.URL)
+	for name, path := range map[string]string{
+		"unsigned":           signed.Path,
+		"another attachment": "/attachments/other?" + signed.RawQuery,
+		"later expiry":       signed.Path + "?expires=99999999999&signature=" + signed.Query().Get("signature"),
+	} {
+		resp := s.Do(http.MethodGet, path, "", nil)
+		if body := testserver.Decode[any](t, resp); resp.StatusCode != http.StatusForbidden || body.Code != "invalid_signature" {
+			t.Errorf("download %s: status %d, code %q", name, resp.StatusCode, body.Code)
+		}
+	}
+
+	if resp := s.Do(http.MethodDelete, path+"/"+uploaded.Result.Id, other, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("delete by another user: status %d", resp.StatusCode)
+	}
+	if resp := s.Do(http.MethodDelete, path+"/"+uploaded.Result.Id, token, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete: status %d", resp.StatusCode)
+	}
+	if resp := s.Do(http.MethodGet, uploaded.Result.URL, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("download after delete: status %d", resp.StatusCode)
+	}
+}
+
+func TestScheduledPostsAreStoredInUTC(t *testing.T) {
+	t.Parallel()
+	s := testserver.New(t)
+	_, token := s.NewUser()
+	publishAt := time.Now().Add(time.Hour).Truncate(time.Second).In(time.FixedZone("UTC+5", 5*60*60))
+
+	resp, created := testserver.Call[dto.InsertPostResponse](s, http.MethodPost, "/api/v1/posts", token, dto.UpsertPostRequest{PostContent: "later", PublishAt: &publishAt})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("schedule: status %d", resp.StatusCode)
+	}
+	stored, err := s.Repo.GetPostById(context.Background(), created.Result.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != models.PostStatusScheduled || stored.PublishAt == nil || !stored.PublishAt.Equal(publishAt) || stored.PublishAt.Location() != time.UTC {
+		t.Errorf("stored post: status %s, publish_at %v, want scheduled at %v in UTC", stored.Status, stored.PublishAt, publishAt.UTC())
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name           string
+		requireIfMatch bool
+		method         string
+		// header is sent with the given value, where "current" and "stale"
+		// stand for the ETag of the post and that of its first revision.
+		header string
+		value  string
+		status int
+		code   string
+	}{
+		{"get, current If-None-Match", false, http.MethodGet, "If-None-Match", "current", http.StatusNotModified, ""},
+		{"get, weak current If-None-Match", false, http.MethodGet, "If-None-Match", "W/current", http.StatusNotModified, ""},
+		{"get, stale If-None-Match", false, http.MethodGet, "If-None-Match", "stale", http.StatusOK, ""},
+		{"update, stale If-Match", false, http.MethodPatch, "If-Match", "stale", http.StatusPreconditionFailed, "precondition_failed"},
+		{"update, current If-Match", false, http.MethodPatch, "If-Match", "current", http.StatusOK, ""},
+		{"update, no If-Match", false, http.MethodPatch, "", "", http.StatusOK, ""},
+		{"update, no If-Match required", true, http.MethodPatch, "", "", http.StatusPreconditionRequired, "precondition_required"},
+		{"delete, stale If-Match", false, http.MethodDelete, "If-Match", "stale", http.StatusPreconditionFailed, "precondition_failed"},
+		{"delete, current If-Match", true, http.MethodDelete, "If-Match", "current", http.StatusOK, ""},
+		{"delete, no If-Match required", true, http.MethodDelete, "", "", http.StatusPreconditionRequired, "precondition_required"},
+		{"restore, stale If-Match", false, http.MethodPost, "If-Match", "stale", http.StatusPreconditionFailed, "precondition_failed"},
+		{"restore, current If-Match", true, http.MethodPost, "If-Match", "current", http.StatusOK, ""},
+		{"restore, no If-Match", false, http.MethodPost, "", "", http.StatusOK, ""},
+		{"restore, no If-Match required", true, http.MethodPost, "", "", http.StatusPreconditionRequired, "precondition_required"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := testserver.New(t, func(cfg *server.Config) {
+				cfg.RequireIfMatch = tc.requireIfMatch
+			})
+			_, token := s.NewUser()
+			_, created := testserver.Call[dto.InsertPostResponse](s, http.MethodPost, "/api/v1/posts", token, dto.UpsertPostRequest{PostContent: "first"})
+			path := "/posts/" + created.Result.Id
+			resp := s.Do(http.MethodGet, path, token, nil)
+			resp.Body.Close()
+			stale := resp.Header.Get("ETag")
+			update, err := http.NewRequest(http.MethodPatch, s.URL+"/api/v1"+path, strings.NewReader(`{"post_content":"second"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			update.Header.Set("Authorization", token)
+			update.Header.Set("If-Match", stale)
+			if resp, err = http.DefaultClient.Do(update); err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("update to a second revision: %v, %v", resp, err)
+			}
+			resp.Body.Close()
+			current := resp.Header.Get("ETag")
+			if current == "" || current == stale {
+				t.Fatalf("ETag after update = %q, was %q", current, stale)
+			}
+
+			var body io.Reader
+			if tc.method == http.MethodPatch {
+				body = strings.NewReader(`{"post_content":"third"}`)
+			}
+			if tc.method != http.MethodGet {
+				path = "/api/v1" + path
+			}
+			// POST restores the first revision.
+			if tc.method == http.MethodPost {
+				path += "/revisions/1/restore"
+			}
+			req, err := http.NewRequest(tc.method, s.URL+path, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", token)
+			if tc.header != "" {
+				value := strings.NewReplacer("current", current, "stale", stale).Replace(tc.value)
+				req.Header.Set(tc.header, value)
+			}
+			resp, err = http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tc.status)
+			}
+			if tc.code != "" {
+				if got := testserver.Decode[any](t, resp); got.Code != tc.code {
+					t.Errorf("code %q, want %q", got.Code, tc.code)
+				}
+			}
+		})
+	}
+}
+
+func TestRestrictedPostsAreOnlyBroadcastToTheirAudience(t *testing.T) {
+	t.Parallel()
+	s := testserver.New(t)
+	author, authorToken := s.NewUser()
+	_, followerToken := s.NewUser()
+	_, strangerToken := s.NewUser()
+	if resp := s.Do(http.MethodPost, "/api/v1/users/"+author.ID+"/follow", followerToken, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("follow: status %d", resp.StatusCode)
+	}
+	authorWS := s.DialWebSocket(authorToken)
+	followerWS := s.DialWebSocket(followerToken)
+	strangerWS := s.DialWebSocket(strangerToken)
+	anonymousWS := s.DialWebSocket("")
+
+	for _, tc := range []struct {
+		visibility string
+		receivers  []*testserver.WebSocketClient
+		others     []*testserver.WebSocketClient
+	}{
+		{models.PostVisibilityFollowers, []*testserver.WebSocketClient{authorWS, followerWS}, []*testserver.WebSocketClient{strangerWS, anonymousWS}},
+		{models.PostVisibilityPrivate, []*testserver.WebSocketClient{authorWS}, []*testserver.WebSocketClient{followerWS, strangerWS, anonymousWS}},
+	} {
+		resp, created := testserver.Call[dto.InsertPostResponse](s, http.MethodPost, "/api/v1/posts", authorToken, dto.UpsertPostRequest{PostContent: tc.visibility, Visibility: tc.visibility})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("insert %s post: status %d", tc.visibility, resp.StatusCode)
+		}
+		for _, ws := range tc.receivers {
+			var post dto.Post
+			testserver.DecodePayload(t, ws.Expect(models.PostCreatedMessage), &post)
+			if post.Id != created.Result.Id {
+				t.Errorf("%s post: got event for %s, want %s", tc.visibility, post.Id, created.Result.Id)
+			}
+		}
+		for _, ws := range tc.others {
+			ws.ExpectNone(100 * time.Millisecond)
+		}
+	}
+}
+
+func TestTrash(t *testing.T) {
+	t.Parallel()
+	s := testserver.New(t)
+	author, token := s.NewUser()
+	_, otherToken := s.NewUser()
+	ws := s.DialWebSocket("")
+
+	var ids []string
+	for _, content := range []string{"kept", "trashed"} {
+		resp, created := testserver.Call[dto.InsertPostResponse](s, http.MethodPost, "/api/v1/posts", token, dto.UpsertPostRequest{PostContent: content})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("insert: status %d, error %q", resp.StatusCode, created.Error)
+		}
+		ws.Expect(models.PostCreatedMessage)
+		ids = append(ids, created.Result.Id)
+	}
+	kept, trashed := ids[0], ids[1]
+	del := func() {
+		t.Helper()
+		if resp := s.Do(http.MethodDelete, "/api/v1/posts/"+trashed, token, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("delete: status %d", resp.StatusCode)
+		}
+		ws.Expect(models.PostDeletedMessage)
+	}
+	// listed checks which of the posts path lists.
+	listed := func(path string, want ...string) {
+		t.Helper()
+		resp, posts := testserver.Call[[]dto.Post](s, http.MethodGet, path, token, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d", path, resp.StatusCode)
+		}
+		var got []string
+		for _, post := range posts.Result {
+			got = append(got, post.Id)
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%s lists %v, want %v", path, got, want)
+		}
+	}
+
+	del()
+	listed("/posts", kept)
+	listed("/users/"+author.ID+"/posts", kept)
+	listed("/api/v1/trash", trashed)
+
+	restore := "/api/v1/trash/" + trashed + "/restore"
+	resp, missing := testserver.Call[any](s, http.MethodPost, restore, otherToken, nil)
+	if resp.StatusCode != http.StatusNotFound || missing.Code != "post_not_in_trash" {
+		t.Errorf("restore by another user: status %d, code %q, want 404 post_not_in_trash", resp.StatusCode, missing.Code)
+	}
+	resp, restored := testserver.Call[dto.Post](s, http.MethodPost, restore, token, nil)
+	if resp.StatusCode != http.StatusOK || restored.Result.PostContent != "trashed" {
+		t.Fatalf("restore: status %d, post %+v", resp.StatusCode, restored.Result)
+	}
+	ws.Expect(models.PostRestoredMessage)
+	if resp := s.Do(http.MethodGet, "/posts/"+trashed, token, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("get a restored post: status %d", resp.StatusCode)
+	}
+	listed("/api/v1/trash")
+	resp, missing = testserver.Call[any](s, http.MethodPost, restore, token, nil)
+	if resp.StatusCode != http.StatusNotFound || missing.Code != "post_not_in_trash" {
+		t.Errorf("restore a live post: status %d, code %q, want 404 post_not_in_trash", resp.StatusCode, missing.Code)
+	}
+
+	del()
+	if n, err := s.Repo.PurgeDeletedPosts(context.Background(), 0); err != nil || n != 1 {
+		t.Fatalf("purge: %d posts, error %v, want 1", n, err)
+	}
+	listed("/api/v1/trash")
+	resp, missing = testserver.Call[any](s, http.MethodPost, restore, token, nil)
+	if resp.StatusCode != http.StatusNotFound || missing.Code != "post_not_in_trash" {
+		t.Errorf("restore a purged post: status %d, code %q, want 404 post_not_in_trash", resp.StatusCode, missing.Code)
+	}
+	listed("/posts", kept)
+}
+
+func TestProfiles(t *testing.T) {
+	t.Parallel()
+	s := testserver.New(t)
+	user, token := s.NewUser()
+	_, otherToken := s.NewUser()
+	ptr := func(v string) *string { return &v }
+
+	resp, me := testserver.Call[dto.Me](s, http.MethodPatch, "/api/v1/me", token, dto.UpdateProfileRequest{
+		Handle:      ptr(" Alice_1 "),
+		DisplayName: ptr("Alice"),
+		Bio:         ptr("hello"),
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("update: status %d, error %q", resp.StatusCode, me.Error)
+	}
+	if me.Result.Handle != "alice_1" || me.Result.DisplayName != "Alice" || me.Result.Email != user.Email {
+		t.Errorf("update = %+v, want handle alice_1 and display name Alice", me.Result)
+	}
+
+	// Only the fields present change.
+	resp, me = testserver.Call[dto.Me](s, http.MethodPatch, "/api/v1/me", token, dto.UpdateProfileRequest{Bio: ptr("bye")})
+	if resp.StatusCode != http.StatusOK || me.Result.Bio != "bye" || me.Result.DisplayName != "Alice" || me.Result.Handle != "alice_1" {
+		t.Errorf("partial update: status %d, me %+v", resp.StatusCode, me.Result)
+	}
+
+	for _, handle := range []string{"alice_1", "ALICE_1"} {
+		resp = s.Do(http.MethodGet, "/users/"+handle, "", nil)
+		raw, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("get %s: status %d", handle, resp.StatusCode)
+		}
+		var profile models.Response[dto.Profile]
+		if err = json.Unmarshal(raw, &profile); err != nil {
+			t.Fatal(err)
+		}
+		if profile.Result.Id != user.ID || profile.Result.DisplayName != "Alice" || profile.Result.Bio != "bye" {
+			t.Errorf("get %s = %+v", handle, profile.Result)
+		}
+		if strings.Contains(string(raw), user.Email) {
+			t.Errorf("get %s: the profile shows the email address: %s", handle, raw)
+		}
+	}
+	resp, missing := testserver.Call[any](s, http.MethodGet, "/users/nobody", "", nil)
+	if resp.StatusCode != http.StatusNotFound || missing.Code != "user_not_found" {
+		t.Errorf("unknown handle: status %d, code %q, want 404 user_not_found", resp.StatusCode, missing.Code)
+	}
+	resp, missing = testserver.Call[any](s, http.MethodGet, "/users/missing/posts", "", nil)
+	if resp.StatusCode != http.StatusNotFound || missing.Code != "user_not_found" {
+		t.Errorf("posts of an unknown user: status %d, code %q, want 404 user_not_found", resp.StatusCode, missing.Code)
+	}
+
+	resp, taken := testserver.Call[any](s, http.MethodPatch, "/api/v1/me", otherToken, dto.UpdateProfileRequest{Handle: ptr("ALICE_1")})
+	if resp.StatusCode != http.StatusConflict || taken.Code != "handle_taken" {
+		t.Errorf("taken handle: status %d, code %q, want 409 handle_taken", resp.StatusCode, taken.Code)
+	}
+	resp, invalid := testserver.Call[any](s, http.MethodPatch, "/api/v1/me", otherToken, dto.UpdateProfileRequest{Handle: ptr("a!")})
+	if resp.StatusCode != http.StatusUnprocessableEntity || len(invalid.Errors) != 1 || invalid.Errors[0].Field != "handle" {
+		t.Errorf("invalid handle: status %d, errors %+v, want 422 on handle", resp.StatusCode, invalid.Errors)
+	}
+}
+
+func TestRestorePostRevision(t *testing.T) {
+	t.Parallel()
+	s := testserver.New(t)
+	_, token := s.NewUser()
+	_, otherToken := s.NewUser()
+	_, created := testserver.Call[dto.InsertPostResponse](s, http.MethodPost, "/api/v1/posts", token, dto.UpsertPostRequest{PostContent: "first"})
+	path := "/api/v1/posts/" + created.Result.Id
+	if resp := s.Do(http.MethodPatch, path, token, dto.UpsertPostRequest{PostContent: "second"}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("update: status %d", resp.StatusCode)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		path  string
+		token string
+		code  string
+	}{
+		{"another user's post", path + "/revisions/1/restore", otherToken, "post_not_found"},
+		{"unknown post", "/api/v1/posts/missing/revisions/1/restore", token, "post_not_found"},
+		{"unknown revision", path + "/revisions/9/restore", token, "revision_not_found"},
+	} {
+		resp, body := testserver.Call[any](s, http.MethodPost, tc.path, tc.token, nil)
+		if resp.StatusCode != http.StatusNotFound || body.Code != tc.code {
+			t.Errorf("%s: status %d, code %q, want 404 %s", tc.name, resp.StatusCode, body.Code, tc.code)
+		}
+	}
+
+	resp, restored := testserver.Call[dto.Post](s, http.MethodPost, path+"/revisions/1/restore", token, nil)
+	if resp.StatusCode != http.StatusOK || restored.Result.PostContent != "first" || restored.Result.Revision != 3 {
+		t.Errorf("restore: status %d, post %+v, want the first content as revision 3", resp.StatusCode, restored.Result)
+	}
+}
@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/bocanada/rest-ws/dto"
+	"github.com/bocanada/rest-ws/helpers"
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/repository"
+	"github.com/bocanada/rest-ws/server"
+	"github.com/bocanada/rest-ws/storage"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+	"github.com/segmentio/ksuid"
+)
+
+var (
+	AttachmentNotFound     = models.NewError(http.StatusNotFound, "attachment_not_found", "attachment does not exist")
+	AttachmentTooLarge     = models.NewError(http.StatusRequestEntityTooLarge, "attachment_too_large", "attachment is too large")
+	UnsupportedContentType = models.NewError(http.StatusUnsupportedMediaType, "unsupported_content_type", "attachment type is not supported")
+	InvalidSignature       = models.NewError(http.StatusForbidden, "invalid_signature", "download link is invalid or has expired")
+	NotPostAuthor          = models.NewError(http.StatusForbidden, "not_post_author", "only the author can change this post")
+
+	allowedContentTypes = map[string]bool{
+		"image/png":       true,
+		"image/jpeg":      true,
+		"image/gif":       true,
+		"image/webp":      true,
+		"application/pdf": true,
+		"text/plain":      true,
+	}
+)
+
+func UploadAttachmentHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		vars := mux.Vars(r)
+		post, err := s.Repository().GetPostById(r.Context(), vars["id"])
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = PostNotFound
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		if post.UserId != claims.UserId {
+			helpers.SendError(w, r, NotPostAuthor)
+			return
+		}
+
+		upload := receiveUpload(s, w, r, allowedContentTypes)
+		if upload == nil {
+			return
+		}
+		defer upload.file.Close()
+
+		id, err := ksuid.NewRandom()
+		if err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		attachment := models.Attachment{
+			Id:          id.String(),
+			PostId:      post.Id,
+			UserId:      claims.UserId,
+			FileName:    filepath.Base(upload.header.Filename),
+			ContentType: upload.contentType,
+			Size:        upload.header.Size,
+			StorageKey:  "posts/" + post.Id + "/" + id.String(),
+		}
+		if err = s.Storage().Put(r.Context(), attachment.StorageKey, upload.body(), attachment.Size, attachment.ContentType); err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		if err = s.Repository().InsertAttachment(r.Context(), &attachment); err != nil {
+			if err := s.Storage().Delete(r.Context(), attachment.StorageKey); err != nil {
+				helpers.Logger(r.Context()).Error("deleting orphaned blob failed", "key", attachment.StorageKey, "error", err)
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		helpers.NewResponseOk(dto.NewAttachment(&attachment, attachmentURL(s, attachment.Id))).Send(w, http.StatusCreated)
+	}
+}
+
+func ListAttachmentsHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		vars := mux.Vars(r)
+		post, err := s.Repository().GetPostById(r.Context(), vars["id"])
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = PostNotFound
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		visible, err := canSeePost(r.Context(), s, post, claims.UserId)
+		if err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		if !visible {
+			helpers.SendError(w, r, PostNotFound)
+			return
+		}
+		attachments, err := s.Repository().ListAttachments(r.Context(), post.Id)
+		if err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		res := make([]dto.Attachment, 0, len(attachments))
+		for _, attachment := range attachments {
+			res = append(res, dto.NewAttachment(attachment, attachmentURL(s, attachment.Id)))
+		}
+		helpers.NewResponseOk(res).Send(w, http.StatusOK)
+	}
+}
+
+// DownloadAttachmentHandler serves attachment contents. It does not look at
+// the Authorization header: holding a valid signed URL is what grants access.
+func DownloadAttachmentHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !helpers.VerifySignedURL([]byte(s.Config().JWTSecret), r.URL.Path, r.URL.Query()) {
+			helpers.SendError(w, r, InvalidSignature)
+			return
+		}
+		vars := mux.Vars(r)
+		attachment, err := s.Repository().GetAttachmentById(r.Context(), vars["id"])
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = AttachmentNotFound
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		blob, err := s.Storage().Get(r.Context(), attachment.StorageKey)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				helpers.SendError(w, r, AttachmentNotFound)
+			} else {
+				helpers.SendError(w, r, err)
+			}
+			return
+		}
+		defer blob.Close()
+		w.Header().Set("Content-Type", attachment.ContentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.FileName}))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(http.StatusOK)
+		if _, err = io.Copy(w, blob); err != nil {
+			helpers.Logger(r.Context()).Warn("streaming attachment failed", "attachment_id", attachment.Id, "error", err)
+		}
+	}
+}
+
+func DeleteAttachmentHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		vars := mux.Vars(r)
+		attachment, err := s.Repository().GetAttachmentById(r.Context(), vars["attachmentId"])
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = AttachmentNotFound
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		if attachment.PostId != vars["id"] {
+			helpers.SendError(w, r, AttachmentNotFound)
+			return
+		}
+		if attachment.UserId != claims.UserId {
+			helpers.SendError(w, r, NotPostAuthor)
+			return
+		}
+		if err = s.Repository().DeleteAttachment(r.Context(), attachment); err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				helpers.SendError(w, r, AttachmentNotFound)
+			} else {
+				helpers.SendError(w, r, err)
+			}
+			return
+		}
+		// The row is gone, so a failure here only leaves an unreachable blob.
+		if err = s.Storage().Delete(r.Context(), attachment.StorageKey); err != nil {
+			helpers.Logger(r.Context()).Error("deleting attachment blob failed", "key", attachment.StorageKey, "error", err)
+		}
+		helpers.NewResponseOk(dto.NewAttachment(attachment, "")).Send(w, http.StatusOK)
+	}
+}
+
+type upload struct {
+	head        []byte
+	file        multipart.File
+	header      *multipart.FileHeader
+	contentType string
+}
+
+// body returns the whole uploaded file, including the bytes already read to
+// sniff its type.
+func (u *upload) body() io.Reader {
+	return io.MultiReader(bytes.NewReader(u.head), u.file)
+}
+
+// receiveUpload reads the "file" part of a multipart request, enforcing the
+// configured size limit and sniffing the content type against allowed. It
+// sends the error response itself and returns nil when the upload is
+// rejected; otherwise the caller must close the returned file.
+func receiveUpload(s server.Server, w http.ResponseWriter, r *http.Request, allowed map[string]bool) *upload {
+	maxSize := s.Config().MaxUploadSize
+	// Leave some room for the multipart framing around the file.
+	maxBody := maxSize + 1<<20
+	if r.ContentLength > maxBody {
+		helpers.SendError(w, r, AttachmentTooLarge)
+		return nil
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		helpers.SendError(w, r, models.ErrBadRequest.Wrap(err))
+		return nil
+	}
+	if header.Size > maxSize {
+		file.Close()
+		helpers.SendError(w, r, AttachmentTooLarge)
+		return nil
+	}
+
+	// Trust the bytes rather than the Content-Type sent by the client.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		file.Close()
+		helpers.SendError(w, r, models.ErrBadRequest.Wrap(err))
+		return nil
+	}
+	head = head[:n]
+	contentType := http.DetectContentType(head)
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !allowed[mediaType] {
+		file.Close()
+		helpers.SendError(w, r, UnsupportedContentType)
+		return nil
+	}
+	return &upload{head: head, file: file, header: header, contentType: contentType}
+}
+
+func attachmentURL(s server.Server, id string) string {
+	return helpers.SignURL([]byte(s.Config().JWTSecret), "/attachments/"+id, time.Now().Add(s.Config().AttachmentURLTTL))
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bocanada/rest-ws/dto"
+	"github.com/bocanada/rest-ws/helpers"
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/repository"
+	"github.com/bocanada/rest-ws/server"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+)
+
+var (
+	CannotFollowSelf = models.NewError(http.StatusBadRequest, "cannot_follow_self", "users cannot follow themselves")
+)
+
+func FollowUserHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		vars := mux.Vars(r)
+		if vars["id"] == claims.UserId {
+			helpers.SendError(w, r, CannotFollowSelf)
+			return
+		}
+		user, err := s.Repository().GetUserById(r.Context(), vars["id"])
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = UserNotFound
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		if err = s.Repository().FollowUser(r.Context(), claims.UserId, user.ID); err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		helpers.NewResponseOk(dto.Follow{UserId: user.ID, Following: true}).Send(w, http.StatusOK)
+	}
+}
+
+func UnfollowUserHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		vars := mux.Vars(r)
+		if err = s.Repository().UnfollowUser(r.Context(), claims.UserId, vars["id"]); err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		helpers.NewResponseOk(dto.Follow{UserId: vars["id"], Following: false}).Send(w, http.StatusOK)
+	}
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/bocanada/rest-ws/dto"
+	"github.com/bocanada/rest-ws/helpers"
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/repository"
+	"github.com/bocanada/rest-ws/server"
+	"github.com/golang-jwt/jwt"
+)
+
+// readinessTimeout bounds every check of /readyz and /status, so that a
+// hung database makes the instance unready instead of hanging the probe.
+const readinessTimeout = 2 * time.Second
+
+var NotAdmin = models.NewError(http.StatusForbidden, "not_admin", "only admins may see the server status")
+
+// poolStatser is implemented by repositories backed by a connection pool.
+type poolStatser interface {
+	Stats() sql.DBStats
+}
+
+// unwrapper is implemented by repositories decorating another one.
+type unwrapper interface {
+	Unwrap() repository.Repository
+}
+
+// HealthzHandler answers as long as the process serves requests.
+func HealthzHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		helpers.NewResponseOk(dto.HealthResponse{Status: "ok"}).Send(w, http.StatusOK)
+	}
+}
+
+// ReadyzHandler answers 200 when the instance can serve traffic and 503
+// otherwise, listing the result of every check either way.
+func ReadyzHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks, ready := readinessChecks(r.Context(), s, false)
+		resp := models.Response[dto.HealthResponse]{
+			Result: dto.HealthResponse{Status: "ok", Checks: checks},
+			Ok:     ready,
+		}
+		status := http.StatusOK
+		if !ready {
+			resp.Result.Status = "unavailable"
+			resp.Error = "not ready"
+			resp.Code = "not_ready"
+			status = http.StatusServiceUnavailable
+		}
+		resp.Send(w, status)
+	}
+}
+
+// StatusHandler describes the instance to the users listed in
+// Config.AdminUserIds.
+func StatusHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			if errors.Is(err, helpers.InvalidToken) {
+				err = models.ErrUnauthorized.Wrap(err)
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		if !s.Config().IsAdmin(claims.UserId) {
+			helpers.SendError(w, r, NotAdmin)
+			return
+		}
+
+		checks, _ := readinessChecks(r.Context(), s, true)
+		resp := dto.StatusResponse{
+			Version:          server.Version,
+			StartedAt:        s.StartedAt(),
+			UptimeSeconds:    int64(time.Since(s.StartedAt()).Seconds()),
+			WebSocketClients: s.Hub().Len(),
+			Checks:           checks,
+		}
+		repo := s.Repository()
+		for u, ok := repo.(unwrapper); ok; u, ok = repo.(unwrapper) {
+			repo = u.Unwrap()
+		}
+		if p, ok := repo.(poolStatser); ok {
+			stats := p.Stats()
+			resp.DBPool = &dto.DBPoolStats{
+				MaxOpenConnections: stats.MaxOpenConnections,
+				OpenConnections:    stats.OpenConnections,
+				InUse:              stats.InUse,
+				Idle:               stats.Idle,
+				WaitCount:          stats.WaitCount,
+				WaitDurationMs:     stats.WaitDuration.Milliseconds(),
+			}
+		}
+		helpers.NewResponseOk(resp).Send(w, http.StatusOK)
+	}
+}
+
+// readinessChecks runs the checks of /readyz and reports whether they all
+// passed. Failures are logged in full, but only reported in full when
+// detailed is set: /readyz is unauthenticated and must not leak them.
+func readinessChecks(ctx context.Context, s server.Server, detailed bool) (map[string]string, bool) {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	checks := map[string]string{"database": "ok", "hub": "ok"}
+	ready := true
+	if err := s.Repository().Ping(ctx); err != nil {
+		helpers.Logger(ctx).Error("database readiness check failed", "error", err)
+		checks["database"] = "unavailable"
+		if detailed {
+			checks["database"] = err.Error()
+		}
+		ready = false
+	}
+	if !s.Hub().Running() {
+		checks["hub"] = "not running"
+		ready = false
+	}
+	return checks, ready
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bocanada/rest-ws/dto"
+	"github.com/bocanada/rest-ws/helpers"
+	"github.com/bocanada/rest-ws/mail"
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/repository"
+	"github.com/bocanada/rest-ws/server"
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	LoginDelayed = models.NewError(http.StatusTooManyRequests, "login_delayed", "too many failed logins, wait before trying again")
+	LoginLocked  = models.NewError(http.StatusLocked, "login_locked", "too many failed logins, try again later")
+)
+
+const (
+	// loginBaseDelay is the wait after Config.LoginDelayAfter failed
+	// logins; it doubles with every further failure up to loginMaxDelay.
+	loginBaseDelay = time.Second
+	loginMaxDelay  = time.Minute
+)
+
+// dummyPasswordHash stands in for the password of unknown emails, so that
+// their logins cost a bcrypt comparison too and take as long as the others.
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("not the password of anybody"), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
+
+// loginKeys names the records of failed logins for an attempt at email
+// from the client of r: the account first, then the client address. Emails
+// are tracked whether or not an account exists, so that delays and lockouts
+// do not tell which do. email is normalized, so that every spelling of an
+// address shares its record.
+func loginKeys(s server.Server, r *http.Request, email string) (account string, ip string) {
+	return "email:" + helpers.NormalizeEmail(email), "ip:" + helpers.ClientIP(r, s.Config().RateLimitIPHeader)
+}
+
+// loginDelay returns how long to wait after the last of failures failed
+// logins before trying again.
+func loginDelay(failures int, after int) time.Duration {
+	n := failures - after
+	switch {
+	case n < 0:
+		return 0
+	case n >= 10:
+		return loginMaxDelay
+	}
+	return min(loginBaseDelay<<n, loginMaxDelay)
+}
+
+// checkLoginAllowed sends an error response and returns false while one of
+// keys is locked, or its last failed login was too recent.
+func checkLoginAllowed(s server.Server, w http.ResponseWriter, r *http.Request, keys ...string) bool {
+	cfg := s.Config()
+	now := time.Now()
+	for _, key := range keys {
+		failures, err := s.Repository().GetLoginFailures(r.Context(), key)
+		if errors.Is(err, repository.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			helpers.SendError(w, r, err)
+			return false
+		}
+		if failures.LockedUntil != nil && now.Before(*failures.LockedUntil) {
+			helpers.SetRetryAfter(w, failures.LockedUntil.Sub(now))
+			helpers.SendError(w, r, LoginLocked)
+			return false
+		}
+		if failures.LastFailedAt.Before(now.Add(-cfg.LoginFailureWindow)) {
+			continue
+		}
+		if next := failures.LastFailedAt.Add(loginDelay(failures.Failures, cfg.LoginDelayAfter)); now.Before(next) {
+			helpers.SetRetryAfter(w, next.Sub(now))
+			helpers.SendError(w, r, LoginDelayed)
+			return false
+		}
+	}
+	return true
+}
+
+// recordLoginFailure counts a failed login for the account and the client
+// address, and locks those that reach their threshold. The owner of a
+// locked account, when there is one, is told by email.
+func recordLoginFailure(ctx context.Context, s server.Server, user *models.User, account string, ip string) error {
+	cfg := s.Config()
+	for _, k := range []struct {
+		key       string
+		threshold int
+	}{
+		{account, cfg.LoginLockoutThreshold},
+		{ip, cfg.LoginIPLockoutThreshold},
+	} {
+		failures, err := s.Repository().RecordLoginFailure(ctx, k.key, cfg.LoginFailureWindow)
+		if err != nil {
+			return err
+		}
+		if failures.Failures < k.threshold {
+			continue
+		}
+		if err = s.Repository().LockLogin(ctx, k.key, cfg.LoginLockoutDuration); err != nil {
+			return err
+		}
+		if k.key == ip {
+			helpers.Logger(ctx).Warn("client address locked out of logins", "failures", failures.Failures)
+			continue
+		}
+		if user == nil {
+			continue
+		}
+		helpers.Logger(ctx).Warn("account locked", "user_id", user.ID, "failures", failures.Failures)
+		sendMail(s, mail.Message{
+			To:      user.Email,
+			Subject: "Your account was locked",
+			Body: fmt.Sprintf("After %d failed attempts to log in, your account is locked for %s.\n\n"+
+				"If it wasn't you, someone may be guessing your password: consider changing it at %s/password/forgot.",
+				failures.Failures, cfg.LoginLockoutDuration, cfg.PublicUrl),
+		})
+	}
+	return nil
+}
+
+// completeLogin forgets the failed logins of account and answers with an
+// access token for user.
+func completeLogin(s server.Server, w http.ResponseWriter, r *http.Request, user *models.User, account string) {
+	if err := s.Repository().ClearLoginFailures(r.Context(), account); err != nil {
+		helpers.SendError(w, r, err)
+		return
+	}
+	claims := helpers.NewAppClaims(user.ID, time.Now().Add(s.Config().TokenTTL))
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString([]byte(s.Config().JWTSecret))
+	if err != nil {
+		helpers.SendError(w, r, err)
+		return
+	}
+	resp := dto.LoginResponse{Token: tokenString}
+	helpers.NewResponseOk(resp).Send(w, http.StatusOK)
+}
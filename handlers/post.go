@@ -1,12 +1,13 @@
 package handlers
 
 import (
-	"database/sql"
-	"encoding/json"
+	"context"
 	"errors"
 	"net/http"
 	"strconv"
+	"time"
 
+	"github.com/bocanada/rest-ws/dto"
 	"github.com/bocanada/rest-ws/helpers"
 	"github.com/bocanada/rest-ws/models"
 	"github.com/bocanada/rest-ws/repository"
@@ -16,106 +17,120 @@ import (
 	"github.com/segmentio/ksuid"
 )
 
-type UpsertPostRequest struct {
-	PostContent string `json:"post_content"`
-}
+var (
+	PostNotFound     = models.NewError(http.StatusNotFound, "post_not_found", "post does not exist")
+	RevisionNotFound = models.NewError(http.StatusNotFound, "revision_not_found", "revision does not exist")
+	InvalidRevision  = models.NewError(http.StatusBadRequest, "invalid_revision", "invalid revision")
 
-type InsertPostResponse struct {
-	Id          string `json:"id"`
-	PostContent string `json:"post_content"`
-}
+	PreconditionFailed   = models.NewError(http.StatusPreconditionFailed, "precondition_failed", "post has been modified since it was fetched")
+	PreconditionRequired = models.NewError(http.StatusPreconditionRequired, "precondition_required", "this request requires an If-Match header")
 
-var (
-	PostNotFound = errors.New("post does not exist")
+	PostNotPublishable = models.NewError(http.StatusNotFound, "post_not_publishable", "post does not exist or is already published")
 )
 
 func InsertPostHandler(s server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		claims, err := helpers.ParseAppClaims(r.Header.Get("Authorization"), func(_ *jwt.Token) (interface{}, error) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
 			return []byte(s.Config().JWTSecret), nil
 		})
-		var statusCode int
 		if err != nil {
 			if errors.Is(err, helpers.InvalidToken) {
-				statusCode = http.StatusUnauthorized
-			} else {
-				statusCode = http.StatusInternalServerError
+				err = models.ErrUnauthorized.Wrap(err)
 			}
-			helpers.NewResponseError(err).Send(w, statusCode)
+			helpers.SendError(w, r, err)
 			return
 		}
 
-		var req UpsertPostRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			helpers.NewResponseError(err).Send(w, http.StatusBadRequest)
+		if !requireVerifiedEmail(s, w, r, claims.UserId) {
+			return
+		}
+
+		var req dto.UpsertPostRequest
+		if !decodeRequest(w, r, &req) {
 			return
 		}
 
 		id, err := ksuid.NewRandom()
 		if err != nil {
-			helpers.NewResponseError(err).Send(w, http.StatusInternalServerError)
+			helpers.SendError(w, r, err)
 			return
 		}
+		status, publishAt := postStatus(req.Status, req.PublishAt)
+		if req.Visibility == "" {
+			req.Visibility = models.PostVisibilityPublic
+		}
 		post := models.Post{
 			Id:          id.String(),
 			PostContent: req.PostContent,
 			UserId:      claims.UserId,
+			Status:      status,
+			PublishAt:   publishAt,
+			Visibility:  req.Visibility,
 		}
-		if err = repository.InsertPost(r.Context(), &post); err != nil {
-			helpers.NewResponseError(err).Send(w, http.StatusInternalServerError)
+		if err = s.Repository().InsertPost(r.Context(), &post); err != nil {
+			helpers.SendError(w, r, err)
 			return
 		}
-		postMessage := models.WebSocketMessage{
-			Type:    models.PostCreatedMessage,
-			Payload: post,
+		// Drafts and scheduled posts are announced once they get published.
+		if err := server.BroadcastPost(r.Context(), s, models.PostCreatedMessage, &post); err != nil {
+			helpers.Logger(r.Context()).Error("broadcasting post failed", "post_id", post.Id, "error", err)
 		}
-		s.Hub().Broadcast(postMessage, nil)
-		helpers.NewResponseOk(InsertPostResponse{Id: post.Id, PostContent: post.PostContent}).Send(w, http.StatusOK)
+		helpers.NewResponseOk(dto.InsertPostResponse{Id: post.Id, PostContent: post.PostContent}).Send(w, http.StatusOK)
 	}
 }
 
 func GetPostByIdHandler(s server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		_, err := helpers.ParseAppClaims(r.Header.Get("Authorization"), func(_ *jwt.Token) (interface{}, error) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
 			return []byte(s.Config().JWTSecret), nil
 		})
 		if err != nil {
-			helpers.NewResponseError(err).Send(w, http.StatusUnauthorized)
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
 			return
 		}
 		vars := mux.Vars(r)
-		post, err := repository.GetPostById(r.Context(), vars["id"])
+		post, err := s.Repository().GetPostById(r.Context(), vars["id"])
 		if err != nil {
-			helpers.NewResponseError(err).Send(w, http.StatusInternalServerError)
+			if errors.Is(err, repository.ErrNotFound) {
+				err = PostNotFound
+			}
+			helpers.SendError(w, r, err)
 			return
 		}
-		if post.Id == "" {
-			helpers.NewResponseError(PostNotFound).Send(w, http.StatusNotFound)
+		visible, err := canSeePost(r.Context(), s, post, claims.UserId)
+		if err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		if !visible {
+			helpers.SendError(w, r, PostNotFound)
+			return
+		}
+		etag := postETag(post)
+		w.Header().Set("ETag", etag)
+		if match := r.Header.Get("If-None-Match"); match != "" && helpers.MatchETag(match, etag, true) {
+			w.WriteHeader(http.StatusNotModified)
 			return
 		}
-		helpers.NewResponseOk(post).Send(w, http.StatusOK)
+		helpers.NewResponseOk(dto.NewPost(post)).Send(w, http.StatusOK)
 	}
 }
 
 func UpdatePostHandler(s server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		claims, err := helpers.ParseAppClaims(r.Header.Get("Authorization"), func(_ *jwt.Token) (interface{}, error) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
 			return []byte(s.Config().JWTSecret), nil
 		})
 		if err != nil {
-			var statusCode int
 			if errors.Is(err, helpers.InvalidToken) {
-				statusCode = http.StatusUnauthorized
-			} else {
-				statusCode = http.StatusInternalServerError
+				err = models.ErrUnauthorized.Wrap(err)
 			}
-			helpers.NewResponseError(err).Send(w, statusCode)
+			helpers.SendError(w, r, err)
 			return
 		}
 
-		var req UpsertPostRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			helpers.NewResponseError(err).Send(w, http.StatusBadRequest)
+		var req dto.UpsertPostRequest
+		if !decodeRequest(w, r, &req) {
 			return
 		}
 		vars := mux.Vars(r)
@@ -123,60 +138,330 @@ func UpdatePostHandler(s server.Server) http.HandlerFunc {
 			Id:          vars["id"],
 			PostContent: req.PostContent,
 			UserId:      claims.UserId,
+			Visibility:  req.Visibility,
+		}
+		ifMatch := r.Header.Get("If-Match")
+		if ifMatch == "" && s.Config().RequireIfMatch {
+			helpers.SendError(w, r, PreconditionRequired)
+			return
 		}
-		if err = repository.UpdatePost(r.Context(), &post); err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				helpers.NewResponseError(PostNotFound).Send(w, http.StatusNotFound)
+		if ifMatch != "" {
+			current, err := s.Repository().GetPostById(r.Context(), post.Id)
+			if err != nil {
+				if errors.Is(err, repository.ErrNotFound) {
+					err = PostNotFound
+				}
+				helpers.SendError(w, r, err)
+				return
+			}
+			if !helpers.MatchETag(ifMatch, postETag(current), false) {
+				helpers.SendError(w, r, PreconditionFailed)
+				return
+			}
+			post.Revision = current.Revision
+		}
+		if err = s.Repository().UpdatePost(r.Context(), &post); err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				helpers.SendError(w, r, PostNotFound)
+			} else if errors.Is(err, repository.ErrVersionMismatch) {
+				helpers.SendError(w, r, PreconditionFailed)
 			} else {
-				helpers.NewResponseError(err).Send(w, http.StatusInternalServerError)
+				helpers.SendError(w, r, err)
 			}
 			return
 		}
-		postMessage := models.WebSocketMessage{
-			Type:    models.PostUpdatedMessage,
-			Payload: post,
+		if err := server.BroadcastPost(r.Context(), s, models.PostUpdatedMessage, &post); err != nil {
+			helpers.Logger(r.Context()).Error("broadcasting post failed", "post_id", post.Id, "error", err)
 		}
-		s.Hub().Broadcast(postMessage, nil)
-		helpers.NewResponseOk(InsertPostResponse{Id: post.Id, PostContent: post.PostContent}).Send(w, http.StatusOK)
+		w.Header().Set("ETag", postETag(&post))
+		helpers.NewResponseOk(dto.InsertPostResponse{Id: post.Id, PostContent: post.PostContent}).Send(w, http.StatusOK)
 	}
 }
 
 func DeletePostHandler(s server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		claims, err := helpers.ParseAppClaims(r.Header.Get("Authorization"), func(_ *jwt.Token) (interface{}, error) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
 			return []byte(s.Config().JWTSecret), nil
 		})
 		if err != nil {
-			helpers.NewResponseError(err).Send(w, http.StatusUnauthorized)
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
 			return
 		}
 		vars := mux.Vars(r)
-		post, err := repository.GetPostById(r.Context(), vars["id"])
+		post, err := s.Repository().GetPostById(r.Context(), vars["id"])
 		if err != nil {
-			helpers.NewResponseError(err).Send(w, http.StatusInternalServerError)
+			if errors.Is(err, repository.ErrNotFound) {
+				err = PostNotFound
+			}
+			helpers.SendError(w, r, err)
 			return
 		}
 		if post.UserId != claims.UserId {
-			helpers.NewResponseError(errors.New("unauthorized DELETE")).Send(w, http.StatusUnauthorized)
+			helpers.SendError(w, r, NotPostAuthor)
+			return
+		}
+		ifMatch := r.Header.Get("If-Match")
+		if ifMatch == "" && s.Config().RequireIfMatch {
+			helpers.SendError(w, r, PreconditionRequired)
+			return
+		}
+		if ifMatch != "" && !helpers.MatchETag(ifMatch, postETag(post), false) {
+			helpers.SendError(w, r, PreconditionFailed)
+			return
+		}
+		if err = s.Repository().DeletePost(r.Context(), post); err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				helpers.SendError(w, r, PostNotFound)
+			} else if errors.Is(err, repository.ErrVersionMismatch) {
+				helpers.SendError(w, r, PreconditionFailed)
+			} else {
+				helpers.SendError(w, r, err)
+			}
+			return
+		}
+		if err := server.BroadcastPost(r.Context(), s, models.PostDeletedMessage, post); err != nil {
+			helpers.Logger(r.Context()).Error("broadcasting post failed", "post_id", post.Id, "error", err)
+		}
+		helpers.NewResponseOk(dto.NewPost(post)).Send(w, http.StatusOK)
+	}
+}
+
+func ListPostRevisionsHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		vars := mux.Vars(r)
+		post, err := s.Repository().GetPostById(r.Context(), vars["id"])
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = PostNotFound
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		visible, err := canSeePost(r.Context(), s, post, claims.UserId)
+		if err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		if !visible {
+			helpers.SendError(w, r, PostNotFound)
+			return
+		}
+		revisions, err := s.Repository().ListPostRevisions(r.Context(), post.Id)
+		if err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		helpers.NewResponseOk(dto.NewPostRevisions(revisions)).Send(w, http.StatusOK)
+	}
+}
+
+func RestorePostRevisionHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		vars := mux.Vars(r)
+		revision, err := strconv.Atoi(vars["revision"])
+		if err != nil {
+			helpers.SendError(w, r, InvalidRevision)
+			return
+		}
+		current, err := s.Repository().GetPostById(r.Context(), vars["id"])
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = PostNotFound
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		if current.UserId != claims.UserId {
+			helpers.SendError(w, r, PostNotFound)
+			return
+		}
+		ifMatch := r.Header.Get("If-Match")
+		if ifMatch == "" && s.Config().RequireIfMatch {
+			helpers.SendError(w, r, PreconditionRequired)
+			return
+		}
+		if ifMatch != "" && !helpers.MatchETag(ifMatch, postETag(current), false) {
+			helpers.SendError(w, r, PreconditionFailed)
+			return
+		}
+		rev, err := s.Repository().GetPostRevision(r.Context(), current.Id, revision)
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = RevisionNotFound
+			}
+			helpers.SendError(w, r, err)
 			return
 		}
-		if err = repository.DeletePost(r.Context(), post); err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				helpers.NewResponseError(PostNotFound).Send(w, http.StatusNotFound)
+		post := models.Post{
+			Id:          current.Id,
+			PostContent: rev.PostContent,
+			UserId:      claims.UserId,
+			Visibility:  current.Visibility,
+		}
+		if ifMatch != "" {
+			post.Revision = current.Revision
+		}
+		// Restoring is an ordinary edit: it creates a new revision on top
+		// of the history instead of rewinding it.
+		if err = s.Repository().UpdatePost(r.Context(), &post); err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				helpers.SendError(w, r, PostNotFound)
+			} else if errors.Is(err, repository.ErrVersionMismatch) {
+				helpers.SendError(w, r, PreconditionFailed)
 			} else {
-				helpers.NewResponseError(err).Send(w, http.StatusInternalServerError)
+				helpers.SendError(w, r, err)
 			}
 			return
 		}
-		postMessage := models.WebSocketMessage{
-			Type:    models.PostDeletedMessage,
-			Payload: post,
+		if err := server.BroadcastPost(r.Context(), s, models.PostUpdatedMessage, &post); err != nil {
+			helpers.Logger(r.Context()).Error("broadcasting post failed", "post_id", post.Id, "error", err)
 		}
-		s.Hub().Broadcast(postMessage, nil)
-		helpers.NewResponseOk(post).Send(w, http.StatusOK)
+		w.Header().Set("ETag", postETag(&post))
+		helpers.NewResponseOk(dto.NewPost(&post)).Send(w, http.StatusOK)
 	}
 }
 
+func PublishPostHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		if !requireVerifiedEmail(s, w, r, claims.UserId) {
+			return
+		}
+		var req dto.PublishPostRequest
+		if r.ContentLength != 0 {
+			if !decodeRequest(w, r, &req) {
+				return
+			}
+		}
+		status := models.PostStatusPublished
+		if req.PublishAt != nil && req.PublishAt.After(time.Now()) {
+			status = models.PostStatusScheduled
+		} else {
+			req.PublishAt = nil
+		}
+		vars := mux.Vars(r)
+		post := models.Post{
+			Id:        vars["id"],
+			UserId:    claims.UserId,
+			Status:    status,
+			PublishAt: utc(req.PublishAt),
+		}
+		if err = s.Repository().SetPostStatus(r.Context(), &post); err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				helpers.SendError(w, r, PostNotPublishable)
+			} else {
+				helpers.SendError(w, r, err)
+			}
+			return
+		}
+		if err := server.BroadcastPost(r.Context(), s, models.PostCreatedMessage, &post); err != nil {
+			helpers.Logger(r.Context()).Error("broadcasting post failed", "post_id", post.Id, "error", err)
+		}
+		helpers.NewResponseOk(dto.NewPost(&post)).Send(w, http.StatusOK)
+	}
+}
+
+func ListDraftsHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		params := r.URL.Query()
+		after := params.Get("after")
+		limit := stringToInt(params.Get("limit"), 100)
+		posts, err := s.Repository().ListUnpublishedPosts(r.Context(), claims.UserId, limit, after)
+		if err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		resp := helpers.NewResponseOk(dto.NewPosts(posts))
+		if length := len(posts); length > 1 {
+			last := posts[len(posts)-1].Id
+			params.Set("after", last)
+			r.URL.RawQuery = params.Encode()
+			resp.Next = r.URL.String()
+		}
+		resp.Send(w, http.StatusOK)
+	}
+}
+
+// postStatus resolves the status requested for a new post, which
+// UpsertPostRequest.Validate has already checked. An empty status means
+// published, or scheduled when a publish date is given.
+func postStatus(status string, publishAt *time.Time) (string, *time.Time) {
+	switch status {
+	case "":
+		if publishAt != nil {
+			return models.PostStatusScheduled, utc(publishAt)
+		}
+		return models.PostStatusPublished, nil
+	case models.PostStatusScheduled:
+		return status, utc(publishAt)
+	default:
+		return status, nil
+	}
+}
+
+// utc returns t in UTC, so that times sent with an offset are stored as
+// the instant they name.
+func utc(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	u := t.UTC()
+	return &u
+}
+
+// canSeePost reports whether userId may read post. Authors can always see
+// their posts; everybody else only sees published posts their visibility
+// allows.
+func canSeePost(ctx context.Context, s server.Server, post *models.Post, userId string) (bool, error) {
+	if post.UserId == userId {
+		return true, nil
+	}
+	if post.Status != models.PostStatusPublished {
+		return false, nil
+	}
+	switch post.Visibility {
+	case models.PostVisibilityPrivate:
+		return false, nil
+	case models.PostVisibilityFollowers:
+		if userId == "" {
+			return false, nil
+		}
+		return s.Repository().IsFollowing(ctx, userId, post.UserId)
+	}
+	return true, nil
+}
+
+func postETag(post *models.Post) string {
+	return helpers.ETag(post.Id, post.Revision)
+}
+
 func stringToInt(value string, def uint64) uint64 {
 	v, err := strconv.ParseUint(value, 10, 64)
 	if err != nil {
@@ -187,15 +472,21 @@ func stringToInt(value string, def uint64) uint64 {
 
 func ListPostsHandler(s server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Anonymous readers are welcome, they just only get public posts.
+		viewerId, err := optionalViewer(s, r)
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
 		params := r.URL.Query()
 		after := params.Get("after")
 		limit := stringToInt(params.Get("limit"), 100)
-		posts, err := repository.ListPosts(r.Context(), limit, after)
+		posts, err := s.Repository().ListPosts(r.Context(), viewerId, limit, after)
 		if err != nil {
-			helpers.NewResponseError(err).Send(w, http.StatusInternalServerError)
+			helpers.SendError(w, r, err)
 			return
 		}
-		resp := helpers.NewResponseOk(posts)
+		resp := helpers.NewResponseOk(dto.NewPosts(posts))
 		if length := len(posts); length > 1 {
 			last := posts[len(posts)-1].Id
 			params.Set("after", last)
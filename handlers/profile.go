@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/bocanada/rest-ws/dto"
+	"github.com/bocanada/rest-ws/helpers"
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/repository"
+	"github.com/bocanada/rest-ws/server"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+	"github.com/segmentio/ksuid"
+)
+
+var (
+	HandleTaken = models.NewError(http.StatusConflict, "handle_taken", "handle is already taken")
+
+	avatarContentTypes = map[string]bool{
+		"image/png":  true,
+		"image/jpeg": true,
+		"image/gif":  true,
+		"image/webp": true,
+	}
+)
+
+func UpdateProfileHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		var req dto.UpdateProfileRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		user, err := s.Repository().GetUserById(r.Context(), claims.UserId)
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = UserNotFound
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		if req.Handle != nil {
+			handle := strings.ToLower(strings.TrimSpace(*req.Handle))
+			owner, err := s.Repository().GetUserByHandle(r.Context(), handle)
+			if err != nil && !errors.Is(err, repository.ErrNotFound) {
+				helpers.SendError(w, r, err)
+				return
+			}
+			if err == nil && owner.ID != user.ID {
+				helpers.SendError(w, r, HandleTaken)
+				return
+			}
+			user.Handle = handle
+		}
+		if req.DisplayName != nil {
+			user.DisplayName = strings.TrimSpace(*req.DisplayName)
+		}
+		if req.Bio != nil {
+			user.Bio = *req.Bio
+		}
+		if err = s.Repository().UpdateUserProfile(r.Context(), user); err != nil {
+			// Someone may have claimed the handle since it was checked.
+			if errors.Is(err, repository.ErrConflict) {
+				err = HandleTaken
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		helpers.NewResponseOk(dto.NewMe(user, avatarURL(s, user))).Send(w, http.StatusOK)
+	}
+}
+
+func UploadAvatarHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		upload := receiveUpload(s, w, r, avatarContentTypes)
+		if upload == nil {
+			return
+		}
+		defer upload.file.Close()
+
+		id, err := ksuid.NewRandom()
+		if err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		avatar := models.Attachment{
+			Id:          id.String(),
+			UserId:      claims.UserId,
+			FileName:    filepath.Base(upload.header.Filename),
+			ContentType: upload.contentType,
+			Size:        upload.header.Size,
+			StorageKey:  "avatars/" + claims.UserId + "/" + id.String(),
+		}
+		if err = s.Storage().Put(r.Context(), avatar.StorageKey, upload.body(), avatar.Size, avatar.ContentType); err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		// The previous avatar becomes an orphan and is collected with the
+		// attachments of purged posts.
+		if err = s.Repository().SetUserAvatar(r.Context(), claims.UserId, &avatar); err != nil {
+			if err := s.Storage().Delete(r.Context(), avatar.StorageKey); err != nil {
+				helpers.Logger(r.Context()).Error("deleting orphaned blob failed", "key", avatar.StorageKey, "error", err)
+			}
+			if errors.Is(err, repository.ErrNotFound) {
+				helpers.SendError(w, r, UserNotFound)
+			} else {
+				helpers.SendError(w, r, err)
+			}
+			return
+		}
+		helpers.NewResponseOk(dto.NewAttachment(&avatar, attachmentURL(s, avatar.Id))).Send(w, http.StatusOK)
+	}
+}
+
+func GetProfileHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		user, err := s.Repository().GetUserByHandle(r.Context(), strings.ToLower(vars["handle"]))
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = UserNotFound
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		helpers.NewResponseOk(dto.NewProfile(user, avatarURL(s, user))).Send(w, http.StatusOK)
+	}
+}
+
+func ListUserPostsHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		viewerId, err := optionalViewer(s, r)
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		vars := mux.Vars(r)
+		user, err := s.Repository().GetUserById(r.Context(), vars["id"])
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = UserNotFound
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		params := r.URL.Query()
+		after := params.Get("after")
+		limit := stringToInt(params.Get("limit"), 100)
+		posts, err := s.Repository().ListPostsByUser(r.Context(), viewerId, user.ID, limit, after)
+		if err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		resp := helpers.NewResponseOk(dto.NewPosts(posts))
+		if length := len(posts); length > 1 {
+			last := posts[len(posts)-1].Id
+			params.Set("after", last)
+			r.URL.RawQuery = params.Encode()
+			resp.Next = r.URL.String()
+		}
+		resp.Send(w, http.StatusOK)
+	}
+}
+
+// avatarURL returns a signed link to the avatar of user, if they have one.
+func avatarURL(s server.Server, user *models.User) string {
+	if user.AvatarId == "" {
+		return ""
+	}
+	return attachmentURL(s, user.AvatarId)
+}
+
+// optionalViewer returns the id of the user making the request, or an empty
+// string for anonymous requests. A token that is present but invalid is an
+// error.
+func optionalViewer(s server.Server, r *http.Request) (string, error) {
+	if r.Header.Get("Authorization") == "" {
+		return "", nil
+	}
+	claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+		return []byte(s.Config().JWTSecret), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return claims.UserId, nil
+}
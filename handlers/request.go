@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/bocanada/rest-ws/helpers"
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/validation"
+)
+
+// decodeRequest decodes the JSON body of r into req and validates it. It
+// sends a 400 for malformed JSON or a 422 listing the invalid fields, and
+// returns false, when the handler must stop.
+func decodeRequest(w http.ResponseWriter, r *http.Request, req validation.Validatable) bool {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		helpers.SendError(w, r, models.ErrMalformedBody.Wrap(err))
+		return false
+	}
+	if err := req.Validate(); err != nil {
+		var errs validation.Errors
+		if errors.As(err, &errs) {
+			err = models.ErrValidation.WithFields(errs)
+		}
+		helpers.SendError(w, r, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/bocanada/rest-ws/middleware"
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/server"
+	"github.com/bocanada/rest-ws/tracing"
+	"github.com/gorilla/mux"
+)
+
+// BindRoutes registers every endpoint of the API on r. Routes wrapped in
+// scopes.Require accept personal access tokens with that scope; no other
+// route does.
+func BindRoutes(s server.Server, r *mux.Router) {
+	scopes := middleware.RouteScopes{}
+	r.Use(
+		tracing.Middleware(s.TracerProvider()),
+		middleware.RequestIdMiddleware(s),
+		middleware.AccessLogMiddleware,
+		s.Metrics().Middleware,
+		middleware.RateLimitMiddleware(s),
+		middleware.CheckAuthMiddleware(s, scopes),
+		middleware.UserRateLimitMiddleware(s),
+	)
+	api := r.PathPrefix("/api/v1").Subrouter()
+	scopes.Require(models.ScopePostsRead, r.HandleFunc("/ws", WebSocketHandler(s)))
+	r.HandleFunc("/", HomeHandler(s)).Methods(http.MethodGet)
+	r.HandleFunc("/healthz", HealthzHandler(s)).Methods(http.MethodGet)
+	r.HandleFunc("/readyz", ReadyzHandler(s)).Methods(http.MethodGet)
+	r.HandleFunc("/status", StatusHandler(s)).Methods(http.MethodGet)
+	r.Handle("/metrics", s.Metrics().Handler()).Methods(http.MethodGet)
+	r.HandleFunc("/signup", SignUpHandler(s)).Methods(http.MethodPost)
+	r.HandleFunc("/login", LoginHandler(s)).Methods(http.MethodPost)
+	r.HandleFunc("/login/2fa", LoginChallengeHandler(s)).Methods(http.MethodPost)
+	scopes.Require(models.ScopeProfileRead, r.HandleFunc("/me", MeHandler(s)).Methods(http.MethodGet))
+	r.HandleFunc("/verify-email", VerifyEmailHandler(s)).Methods(http.MethodGet)
+	r.HandleFunc("/password/forgot", ForgotPasswordHandler(s)).Methods(http.MethodPost)
+	r.HandleFunc("/password/reset", ResetPasswordHandler(s)).Methods(http.MethodPost)
+	scopes.Require(models.ScopeProfileRead, r.HandleFunc("/users/{handle}", GetProfileHandler(s)).Methods(http.MethodGet))
+	scopes.Require(models.ScopePostsRead, r.HandleFunc("/users/{id}/posts", ListUserPostsHandler(s)).Methods(http.MethodGet))
+	scopes.Require(models.ScopePostsRead, r.HandleFunc("/posts/{id}", GetPostByIdHandler(s)).Methods(http.MethodGet))
+	scopes.Require(models.ScopePostsRead, r.HandleFunc("/posts/{id}/revisions", ListPostRevisionsHandler(s)).Methods(http.MethodGet))
+	scopes.Require(models.ScopePostsRead, r.HandleFunc("/posts/{id}/attachments", ListAttachmentsHandler(s)).Methods(http.MethodGet))
+	scopes.Require(models.ScopePostsRead, r.HandleFunc("/posts", ListPostsHandler(s)).Methods(http.MethodGet))
+	scopes.Require(models.ScopePostsRead, r.HandleFunc("/attachments/{id}", DownloadAttachmentHandler(s)).Methods(http.MethodGet))
+
+	scopes.Require(models.ScopeProfileWrite, api.HandleFunc("/me", UpdateProfileHandler(s)).Methods(http.MethodPatch, http.MethodOptions))
+	scopes.Require(models.ScopeProfileWrite, api.HandleFunc("/me/verify-email", ResendVerificationHandler(s)).Methods(http.MethodPost, http.MethodOptions))
+	scopes.Require(models.ScopeProfileWrite, api.HandleFunc("/me/avatar", UploadAvatarHandler(s)).Methods(http.MethodPut, http.MethodOptions))
+	api.HandleFunc("/me/2fa", TwoFactorStatusHandler(s)).Methods(http.MethodGet)
+	api.HandleFunc("/me/2fa", EnrollTwoFactorHandler(s)).Methods(http.MethodPost, http.MethodOptions)
+	api.HandleFunc("/me/2fa", DisableTwoFactorHandler(s)).Methods(http.MethodDelete, http.MethodOptions)
+	api.HandleFunc("/me/2fa/confirm", ConfirmTwoFactorHandler(s)).Methods(http.MethodPost, http.MethodOptions)
+	api.HandleFunc("/me/tokens", ListAccessTokensHandler(s)).Methods(http.MethodGet)
+	api.HandleFunc("/me/tokens", CreateAccessTokenHandler(s)).Methods(http.MethodPost, http.MethodOptions)
+	api.HandleFunc("/me/tokens/{id}", DeleteAccessTokenHandler(s)).Methods(http.MethodDelete, http.MethodOptions)
+	scopes.Require(models.ScopePostsWrite, api.HandleFunc("/posts", InsertPostHandler(s)).Methods(http.MethodPost, http.MethodOptions))
+	scopes.Require(models.ScopePostsWrite, api.HandleFunc("/posts/{id}", UpdatePostHandler(s)).Methods(http.MethodPatch, http.MethodOptions))
+	scopes.Require(models.ScopePostsWrite, api.HandleFunc("/posts/{id}", DeletePostHandler(s)).Methods(http.MethodDelete, http.MethodOptions))
+	scopes.Require(models.ScopePostsWrite, api.HandleFunc("/posts/{id}/publish", PublishPostHandler(s)).Methods(http.MethodPost, http.MethodOptions))
+	scopes.Require(models.ScopePostsRead, api.HandleFunc("/drafts", ListDraftsHandler(s)).Methods(http.MethodGet))
+	scopes.Require(models.ScopePostsWrite, api.HandleFunc("/posts/{id}/attachments", UploadAttachmentHandler(s)).Methods(http.MethodPost, http.MethodOptions))
+	scopes.Require(models.ScopePostsWrite, api.HandleFunc("/posts/{id}/attachments/{attachmentId}", DeleteAttachmentHandler(s)).Methods(http.MethodDelete, http.MethodOptions))
+	scopes.Require(models.ScopeFollowsWrite, api.HandleFunc("/users/{id}/follow", FollowUserHandler(s)).Methods(http.MethodPost, http.MethodOptions))
+	scopes.Require(models.ScopeFollowsWrite, api.HandleFunc("/users/{id}/follow", UnfollowUserHandler(s)).Methods(http.MethodDelete, http.MethodOptions))
+	scopes.Require(models.ScopePostsRead, api.HandleFunc("/trash", ListTrashHandler(s)).Methods(http.MethodGet))
+	scopes.Require(models.ScopePostsWrite, api.HandleFunc("/trash/{id}/restore", RestorePostHandler(s)).Methods(http.MethodPost, http.MethodOptions))
+	scopes.Require(models.ScopePostsWrite, api.HandleFunc("/posts/{id}/revisions/{revision}/restore", RestorePostRevisionHandler(s)).Methods(http.MethodPost, http.MethodOptions))
+}
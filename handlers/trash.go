@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bocanada/rest-ws/dto"
+	"github.com/bocanada/rest-ws/helpers"
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/repository"
+	"github.com/bocanada/rest-ws/server"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+)
+
+var (
+	PostNotInTrash = models.NewError(http.StatusNotFound, "post_not_in_trash", "post is not in the trash")
+)
+
+func ListTrashHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		params := r.URL.Query()
+		after := params.Get("after")
+		limit := stringToInt(params.Get("limit"), 100)
+		posts, err := s.Repository().ListDeletedPosts(r.Context(), claims.UserId, limit, after)
+		if err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		resp := helpers.NewResponseOk(dto.NewPosts(posts))
+		if length := len(posts); length > 1 {
+			last := posts[len(posts)-1].Id
+			params.Set("after", last)
+			r.URL.RawQuery = params.Encode()
+			resp.Next = r.URL.String()
+		}
+		resp.Send(w, http.StatusOK)
+	}
+}
+
+func RestorePostHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		vars := mux.Vars(r)
+		post := models.Post{
+			Id:     vars["id"],
+			UserId: claims.UserId,
+		}
+		if err = s.Repository().RestorePost(r.Context(), &post); err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				helpers.SendError(w, r, PostNotInTrash)
+			} else {
+				helpers.SendError(w, r, err)
+			}
+			return
+		}
+		if err := server.BroadcastPost(r.Context(), s, models.PostRestoredMessage, &post); err != nil {
+			helpers.Logger(r.Context()).Error("broadcasting post failed", "post_id", post.Id, "error", err)
+		}
+		helpers.NewResponseOk(dto.NewPost(&post)).Send(w, http.StatusOK)
+	}
+}
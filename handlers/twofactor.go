@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bocanada/rest-ws/dto"
+	"github.com/bocanada/rest-ws/helpers"
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/repository"
+	"github.com/bocanada/rest-ws/server"
+	"github.com/bocanada/rest-ws/totp"
+	"github.com/golang-jwt/jwt"
+)
+
+var (
+	TwoFactorEnabled     = models.NewError(http.StatusConflict, "two_factor_enabled", "two-factor authentication is already enabled")
+	TwoFactorNotEnabled  = models.NewError(http.StatusConflict, "two_factor_not_enabled", "two-factor authentication is not enabled")
+	TwoFactorNotEnrolled = models.NewError(http.StatusConflict, "two_factor_not_enrolled", "start enrolling two-factor authentication first")
+	InvalidTwoFactorCode = models.NewError(http.StatusUnauthorized, "invalid_two_factor_code", "invalid two-factor code")
+)
+
+const (
+	recoveryCodeCount = 10
+	// recoveryCodeBytes makes recovery codes 16 characters long, random
+	// enough for a plain hash to keep them safe.
+	recoveryCodeBytes = 10
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func TwoFactorStatusHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		var resp dto.TwoFactorStatus
+		enrollment, err := s.Repository().GetUserTOTP(r.Context(), claims.UserId)
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			helpers.SendError(w, r, err)
+			return
+		}
+		if err == nil && enrollment.EnabledAt != nil {
+			resp.Enabled = true
+			resp.EnabledAt = enrollment.EnabledAt
+			if resp.RecoveryCodesLeft, err = s.Repository().CountRecoveryCodes(r.Context(), claims.UserId); err != nil {
+				helpers.SendError(w, r, err)
+				return
+			}
+		}
+		helpers.NewResponseOk(resp).Send(w, http.StatusOK)
+	}
+}
+
+// EnrollTwoFactorHandler hands out a new secret, which only takes effect
+// once ConfirmTwoFactorHandler gets a code from it.
+func EnrollTwoFactorHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		user, err := s.Repository().GetUserById(r.Context(), claims.UserId)
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = UserNotFound
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		enrollment, err := s.Repository().GetUserTOTP(r.Context(), user.ID)
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			helpers.SendError(w, r, err)
+			return
+		}
+		if err == nil && enrollment.EnabledAt != nil {
+			helpers.SendError(w, r, TwoFactorEnabled)
+			return
+		}
+		secret, err := totp.NewSecret()
+		if err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		if err = s.Repository().SetUserTOTP(r.Context(), &models.TOTP{UserId: user.ID, Secret: secret}); err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		resp := dto.TwoFactorEnrollment{ProvisioningURI: totp.URI(s.Config().TOTPIssuer, user.Email, secret)}
+		helpers.NewResponseOk(resp).Send(w, http.StatusOK)
+	}
+}
+
+// ConfirmTwoFactorHandler enables two-factor authentication once the user
+// proves their app has the secret, and answers with their recovery codes.
+func ConfirmTwoFactorHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		var req dto.TwoFactorCodeRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		enrollment, err := s.Repository().GetUserTOTP(r.Context(), claims.UserId)
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = TwoFactorNotEnrolled
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		if enrollment.EnabledAt != nil {
+			helpers.SendError(w, r, TwoFactorEnabled)
+			return
+		}
+		user, account, ip, ok := checkCodeAllowed(s, w, r, claims.UserId)
+		if !ok {
+			return
+		}
+		if ok, err := checkTOTPCode(r.Context(), s, enrollment, req.Code); err != nil || !ok {
+			if err == nil {
+				err = invalidCode(r.Context(), s, user, account, ip)
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			helpers.SendError(w, r, err)
+			return
+		}
+		if err = s.Repository().EnableUserTOTP(r.Context(), claims.UserId, hashes); err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = TwoFactorNotEnrolled
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		helpers.NewResponseOk(dto.RecoveryCodesResponse{RecoveryCodes: codes}).Send(w, http.StatusOK)
+	}
+}
+
+// DisableTwoFactorHandler turns two-factor authentication off given a code,
+// or a recovery code for users who lost their app.
+func DisableTwoFactorHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		var req dto.TwoFactorCodeRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		enrollment, err := s.Repository().GetUserTOTP(r.Context(), claims.UserId)
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			helpers.SendError(w, r, err)
+			return
+		}
+		if err != nil || enrollment.EnabledAt == nil {
+			helpers.SendError(w, r, TwoFactorNotEnabled)
+			return
+		}
+		user, account, ip, ok := checkCodeAllowed(s, w, r, claims.UserId)
+		if !ok {
+			return
+		}
+		if ok, err := checkSecondFactor(r.Context(), s, enrollment, req.Code); err != nil || !ok {
+			if err == nil {
+				err = invalidCode(r.Context(), s, user, account, ip)
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		if err = s.Repository().DeleteUserTOTP(r.Context(), claims.UserId); err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = TwoFactorNotEnabled
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		helpers.NewResponseOk(dto.MessageResponse{Message: "Two-factor authentication is disabled"}).Send(w, http.StatusOK)
+	}
+}
+
+// LoginChallengeHandler trades the challenge token LoginHandler gave a user
+// with two-factor authentication, and their code, for an access token. The
+// challenge works once: after a wrong code the login starts over, so every
+// guess costs a correct password and counts as a failed login.
+func LoginChallengeHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req dto.LoginChallengeRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		challenge, err := s.Repository().ConsumeUserToken(r.Context(), helpers.HashToken(req.ChallengeToken), models.TokenPurposeLoginChallenge)
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = InvalidOrExpiredToken
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		user, err := s.Repository().GetUserById(r.Context(), challenge.UserId)
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				err = UserNotFound
+			}
+			helpers.SendError(w, r, err)
+			return
+		}
+		account, ip := loginKeys(s, r, user.Email)
+		if !checkLoginAllowed(s, w, r, account, ip) {
+			return
+		}
+		enrollment, err := s.Repository().GetUserTOTP(r.Context(), user.ID)
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			helpers.SendError(w, r, err)
+			return
+		}
+		ok := false
+		// Two-factor authentication may have been disabled since the
+		// password was checked; the challenge then lets nobody in.
+		if err == nil && enrollment.EnabledAt != nil {
+			if ok, err = checkSecondFactor(r.Context(), s, enrollment, req.Code); err != nil {
+				helpers.SendError(w, r, err)
+				return
+			}
+		}
+		if !ok {
+			helpers.SendError(w, r, invalidCode(r.Context(), s, user, account, ip))
+			return
+		}
+		completeLogin(s, w, r, user, account)
+	}
+}
+
+// checkCodeAllowed looks up the user of a session sending a two-factor code
+// and, like checkLoginAllowed, sends an error response and returns false
+// while their account or address is delayed or locked. Wrong codes count as
+// failed logins, so that a stolen session cannot guess them either.
+func checkCodeAllowed(s server.Server, w http.ResponseWriter, r *http.Request, userId string) (user *models.User, account string, ip string, ok bool) {
+	user, err := s.Repository().GetUserById(r.Context(), userId)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			err = UserNotFound
+		}
+		helpers.SendError(w, r, err)
+		return nil, "", "", false
+	}
+	account, ip = loginKeys(s, r, user.Email)
+	return user, account, ip, checkLoginAllowed(s, w, r, account, ip)
+}
+
+// invalidCode records a wrong two-factor code as a failed login of user and
+// returns the error to answer with.
+func invalidCode(ctx context.Context, s server.Server, user *models.User, account string, ip string) error {
+	if err := recordLoginFailure(ctx, s, user, account, ip); err != nil {
+		return err
+	}
+	return InvalidTwoFactorCode
+}
+
+// checkSecondFactor reports whether code is a valid TOTP code of enrollment
+// or an unused recovery code of its user, which it uses up.
+func checkSecondFactor(ctx context.Context, s server.Server, enrollment *models.TOTP, code string) (bool, error) {
+	if ok, err := checkTOTPCode(ctx, s, enrollment, code); ok || err != nil {
+		return ok, err
+	}
+	err := s.Repository().ConsumeRecoveryCode(ctx, enrollment.UserId, helpers.HashToken(normalizeRecoveryCode(code)))
+	if errors.Is(err, repository.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// checkTOTPCode reports whether code is a valid TOTP code of enrollment that
+// was not used yet.
+func checkTOTPCode(ctx context.Context, s server.Server, enrollment *models.TOTP, code string) (bool, error) {
+	step, ok := totp.Verify(enrollment.Secret, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return false, nil
+	}
+	err := s.Repository().UseTOTPStep(ctx, enrollment.UserId, step)
+	if errors.Is(err, repository.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// newRecoveryCodes returns recovery codes formatted for users along with
+// the hashes to store.
+func newRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, recoveryCodeBytes)
+		if _, err = rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+		codes = append(codes, code[:4]+"-"+code[4:8]+"-"+code[8:12]+"-"+code[12:])
+		hashes = append(hashes, helpers.HashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode undoes the formatting of newRecoveryCodes, and of
+// users typing codes in.
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(code))
+}
@@ -1,11 +1,10 @@
 package handlers
 
 import (
-	"encoding/json"
 	"errors"
 	"net/http"
-	"time"
 
+	"github.com/bocanada/rest-ws/dto"
 	"github.com/bocanada/rest-ws/helpers"
 	"github.com/bocanada/rest-ws/models"
 	"github.com/bocanada/rest-ws/repository"
@@ -15,109 +14,116 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-type SignUpLoginRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
-}
-
-type SignUpResponse struct {
-	Id    string `json:"id"`
-	Email string `json:"email"`
-}
-
-type LoginResponse struct {
-	Token string `json:"token"`
-}
-
 var (
-	InvalidCredentials = errors.New("invalid credentials")
-	UserNotFound       = errors.New("user not found")
-	ExpireTime         = time.Now().Add(2 * time.Hour * 24)
+	InvalidCredentials = models.NewError(http.StatusUnauthorized, "invalid_credentials", "invalid credentials")
+	EmailTaken         = models.NewError(http.StatusConflict, "email_taken", "an account with this email already exists")
+	UserNotFound       = models.NewError(http.StatusNotFound, "user_not_found", "user not found")
 )
 
 func SignUpHandler(s server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var req SignUpLoginRequest
+		var req dto.SignUpLoginRequest
 
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			helpers.NewResponseError(err).Send(w, http.StatusBadRequest)
+		if !decodeRequest(w, r, &req) {
 			return
 		}
 		hashedPasswd, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 		if err != nil {
-			helpers.NewResponseError(err).Send(w, http.StatusInternalServerError)
+			helpers.SendError(w, r, err)
 			return
 		}
 		id, err := ksuid.NewRandom()
 		if err != nil {
-			helpers.NewResponseError(err).Send(w, http.StatusInternalServerError)
+			helpers.SendError(w, r, err)
 			return
 		}
 		user := models.User{
-			Email:    req.Email,
+			Email:    helpers.NormalizeEmail(req.Email),
 			Password: string(hashedPasswd),
 			ID:       id.String(),
 		}
-		if err = repository.InsertUser(r.Context(), &user); err != nil {
-			helpers.NewResponseError(err).Send(w, http.StatusInternalServerError)
+		if err = s.Repository().InsertUser(r.Context(), &user); err != nil {
+			if errors.Is(err, repository.ErrConflict) {
+				err = EmailTaken
+			}
+			helpers.SendError(w, r, err)
 			return
 		}
-		resp := SignUpResponse{Email: user.Email, Id: user.ID}
+		if err = sendVerificationEmail(r.Context(), s, &user); err != nil {
+			helpers.Logger(r.Context()).Error("sending verification email failed", "user_id", user.ID, "error", err)
+		}
+		resp := dto.SignUpResponse{Email: user.Email, Id: user.ID}
 		helpers.NewResponseOk(resp).Send(w, http.StatusOK)
 	}
 }
 
 func LoginHandler(s server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var req SignUpLoginRequest
+		var req dto.SignUpLoginRequest
 
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			helpers.NewResponseError(err).Send(w, http.StatusBadRequest)
+		if !decodeRequest(w, r, &req) {
 			return
 		}
-		user, err := repository.GetUserByEmail(r.Context(), req.Email)
-		if err != nil {
-			helpers.NewResponseError(err).Send(w, http.StatusInternalServerError)
+		email := helpers.NormalizeEmail(req.Email)
+		account, ip := loginKeys(s, r, email)
+		if !checkLoginAllowed(s, w, r, account, ip) {
 			return
 		}
-		if user == nil {
-			helpers.NewResponseError(InvalidCredentials).Send(w, http.StatusUnauthorized)
+		user, err := s.Repository().GetUserByEmail(r.Context(), email)
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			helpers.SendError(w, r, err)
 			return
 		}
-		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
-			helpers.NewResponseError(InvalidCredentials).Send(w, http.StatusUnauthorized)
+		hash := dummyPasswordHash()
+		if user != nil {
+			hash = []byte(user.Password)
+		}
+		if err := bcrypt.CompareHashAndPassword(hash, []byte(req.Password)); err != nil || user == nil {
+			if err = recordLoginFailure(r.Context(), s, user, account, ip); err != nil {
+				helpers.SendError(w, r, err)
+				return
+			}
+			helpers.SendError(w, r, InvalidCredentials)
 			return
 		}
-		claims := helpers.NewAppClaims(user.ID, ExpireTime)
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		tokenString, err := token.SignedString([]byte(s.Config().JWTSecret))
-		if err != nil {
-			helpers.NewResponseError(err).Send(w, http.StatusInternalServerError)
+		enrollment, err := s.Repository().GetUserTOTP(r.Context(), user.ID)
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			helpers.SendError(w, r, err)
 			return
 		}
-		resp := LoginResponse{Token: tokenString}
-		helpers.NewResponseOk(resp).Send(w, http.StatusOK)
+		// The failures are only cleared once the code is verified too, so
+		// that knowing the password does not allow guessing codes forever.
+		if err == nil && enrollment.EnabledAt != nil {
+			challenge, err := newUserToken(r.Context(), s, user.ID, models.TokenPurposeLoginChallenge, s.Config().LoginChallengeTTL)
+			if err != nil {
+				helpers.SendError(w, r, err)
+				return
+			}
+			resp := dto.LoginResponse{TwoFactorRequired: true, ChallengeToken: challenge}
+			helpers.NewResponseOk(resp).Send(w, http.StatusOK)
+			return
+		}
+		completeLogin(s, w, r, user, account)
 	}
 }
 
 func MeHandler(s server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		claims, err := helpers.ParseAppClaims(r.Header.Get("Authorization"), func(_ *jwt.Token) (interface{}, error) {
+		claims, err := helpers.RequestClaims(r, func(_ *jwt.Token) (interface{}, error) {
 			return []byte(s.Config().JWTSecret), nil
 		})
 		if err != nil {
-			helpers.NewResponseError(err).Send(w, http.StatusUnauthorized)
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
 			return
 		}
-		user, err := repository.GetUserById(r.Context(), claims.UserId)
+		user, err := s.Repository().GetUserById(r.Context(), claims.UserId)
 		if err != nil {
-			helpers.NewResponseError(err).Send(w, http.StatusInternalServerError)
-			return
-		}
-		if user.ID == "" {
-			helpers.NewResponseError(UserNotFound).Send(w, http.StatusNotFound)
+			if errors.Is(err, repository.ErrNotFound) {
+				err = UserNotFound
+			}
+			helpers.SendError(w, r, err)
 			return
 		}
-		helpers.NewResponseOk(user).Send(w, http.StatusOK)
+		helpers.NewResponseOk(dto.NewMe(user, avatarURL(s, user))).Send(w, http.StatusOK)
 	}
 }
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/bocanada/rest-ws/helpers"
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/server"
+	"github.com/golang-jwt/jwt"
+)
+
+// WebSocketHandler connects a client to the hub. Browsers cannot set headers
+// on WebSocket requests, so the token may also be passed as ?token=. Clients
+// without a token only receive events about public posts.
+func WebSocketHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keyFunc := func(_ *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		}
+		var claims *models.AppClaims
+		var err error
+		if r.Header.Get("Authorization") != "" {
+			claims, err = helpers.RequestClaims(r, keyFunc)
+		} else if token := r.URL.Query().Get("token"); token != "" {
+			claims, err = helpers.ParseAppClaims(token, keyFunc)
+		}
+		if err != nil {
+			helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
+			return
+		}
+		var userId string
+		if claims != nil {
+			userId = claims.UserId
+		}
+		s.Hub().Connect(w, r, userId)
+	}
+}
@@ -0,0 +1,26 @@
+package helpers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/bocanada/rest-ws/models"
+	"github.com/golang-jwt/jwt"
+)
+
+type claimsKey struct{}
+
+// WithClaims returns a copy of ctx carrying claims the middleware already
+// checked, such as those of a personal access token.
+func WithClaims(ctx context.Context, claims *models.AppClaims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// RequestClaims returns the claims set with WithClaims for r, or else parses
+// the JWT of its Authorization header.
+func RequestClaims(r *http.Request, keyFunc func(*jwt.Token) (interface{}, error)) (*models.AppClaims, error) {
+	if claims, ok := r.Context().Value(claimsKey{}).(*models.AppClaims); ok {
+		return claims, nil
+	}
+	return ParseAppClaims(r.Header.Get("Authorization"), keyFunc)
+}
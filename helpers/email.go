@@ -0,0 +1,10 @@
+package helpers
+
+import "strings"
+
+// NormalizeEmail returns the form emails are stored and looked up in, so
+// that addresses differing only in case or surrounding spaces are the same
+// account.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
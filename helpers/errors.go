@@ -0,0 +1,65 @@
+package helpers
+
+import (
+	"errors"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bocanada/rest-ws/models"
+)
+
+const problemContentType = "application/problem+json"
+
+// SendError answers r with err. Errors that are not a *models.Error are
+// reported as a bare internal error, and the details of every server-side
+// failure are logged rather than returned. Clients that accept
+// application/problem+json get an RFC 7807 document, everybody else the
+// usual response envelope.
+func SendError(w http.ResponseWriter, r *http.Request, err error) {
+	var appErr *models.Error
+	if !errors.As(err, &appErr) {
+		appErr = models.ErrInternal.Wrap(err)
+	}
+	if appErr.Status >= http.StatusInternalServerError {
+		Logger(r.Context()).Error("request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+	}
+	if acceptsProblem(r) {
+		models.Problem{
+			Type:     "about:blank",
+			Title:    http.StatusText(appErr.Status),
+			Status:   appErr.Status,
+			Detail:   appErr.Message,
+			Instance: r.URL.Path,
+			Code:     appErr.Code,
+			Errors:   appErr.Fields,
+		}.Send(w)
+		return
+	}
+	resp := models.Response[any]{
+		Error:  appErr.Message,
+		Code:   appErr.Code,
+		Errors: appErr.Fields,
+		Ok:     false,
+	}
+	resp.Send(w, appErr.Status)
+}
+
+func acceptsProblem(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accept)
+		if err == nil && mediaType == problemContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRetryAfter tells the client of w to wait d, rounded up to the second,
+// before trying again.
+func SetRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
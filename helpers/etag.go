@@ -0,0 +1,33 @@
+package helpers
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ETag returns a strong entity tag identifying version of the resource id.
+func ETag(id string, version int) string {
+	return fmt.Sprintf(`"%s.%d"`, id, version)
+}
+
+// MatchETag reports whether etag satisfies the If-Match or If-None-Match
+// header value. If-Match uses the strong comparison, so weak validators
+// only count when weak is true.
+func MatchETag(header string, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -32,13 +32,6 @@ func ParseAppClaims(tokenString string, keyFunc func(*jwt.Token) (interface{}, e
 	}
 }
 
-func NewResponseError(err error) *models.Response[any] {
-	return &models.Response[any]{
-		Error: err.Error(),
-		Ok:    false,
-	}
-}
-
 func NewResponseOk[T any](res T) *models.Response[T] {
 	return &models.Response[T]{
 		Error:  "",
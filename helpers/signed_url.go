@@ -0,0 +1,38 @@
+package helpers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SignURL returns path with expires and signature query parameters that
+// VerifySignedURL accepts until expiresAt.
+func SignURL(secret []byte, path string, expiresAt time.Time) string {
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", expires)
+	query.Set("signature", urlSignature(secret, path, expires))
+	return path + "?" + query.Encode()
+}
+
+// VerifySignedURL reports whether query carries a valid, unexpired signature
+// for path.
+func VerifySignedURL(secret []byte, path string, query url.Values) bool {
+	expires := query.Get("expires")
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return false
+	}
+	expected := urlSignature(secret, path, expires)
+	return hmac.Equal([]byte(expected), []byte(query.Get("signature")))
+}
+
+func urlSignature(secret []byte, path string, expires string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(path + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
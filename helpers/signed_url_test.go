@@ -0,0 +1,58 @@
+package helpers
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedURL(t *testing.T) {
+	secret := []byte("secret")
+	parse := func(signed string) (string, url.Values) {
+		t.Helper()
+		u, err := url.Parse(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.Path, u.Query()
+	}
+
+	path, query := parse(SignURL(secret, "/attachments/1", time.Now().Add(time.Minute)))
+	if !VerifySignedURL(secret, path, query) {
+		t.Fatal("valid signed url rejected")
+	}
+
+	tampered := func(change func(q url.Values)) url.Values {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = append([]string(nil), v...)
+		}
+		change(q)
+		return q
+	}
+	for name, tc := range map[string]struct {
+		secret []byte
+		path   string
+		query  url.Values
+	}{
+		"other path":   {secret, "/attachments/2", query},
+		"other secret": {[]byte("other"), path, query},
+		"later expiry": {secret, path, tampered(func(q url.Values) { q.Set("expires", "99999999999") })},
+		"flipped signature": {secret, path, tampered(func(q url.Values) {
+			sig := q.Get("signature")
+			q.Set("signature", strings.Repeat("0", len(sig)))
+		})},
+		"no signature": {secret, path, tampered(func(q url.Values) { q.Del("signature") })},
+		"no expiry":    {secret, path, tampered(func(q url.Values) { q.Del("expires") })},
+	} {
+		if VerifySignedURL(tc.secret, tc.path, tc.query) {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	path, query = parse(SignURL(secret, "/attachments/1", time.Now().Add(-time.Second)))
+	if VerifySignedURL(secret, path, query) {
+		t.Error("expired signed url accepted")
+	}
+}
@@ -0,0 +1,43 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+// LogMailer prints emails to the default slog logger instead of sending
+// them, which is all local development needs.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, msg Message) error {
+	slog.InfoContext(ctx, "mail", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+	return nil
+}
+
+// FileMailer writes every email to its own file in a directory, so tests
+// and developers can pick up the links they contain.
+type FileMailer struct {
+	dir string
+}
+
+func NewFileMailer(dir string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &FileMailer{dir: dir}, nil
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	id, err := ksuid.NewRandom()
+	if err != nil {
+		return err
+	}
+	content := fmt.Sprintf("Date: %s\nTo: %s\nSubject: %s\n\n%s\n", time.Now().Format(time.RFC1123Z), msg.To, msg.Subject, msg.Body)
+	return os.WriteFile(filepath.Join(m.dir, id.String()+".eml"), []byte(content), 0o640)
+}
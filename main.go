@@ -2,48 +2,68 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
 	"log"
-	"net/http"
+	"log/slog"
 	"os"
 
 	"github.com/bocanada/rest-ws/handlers"
-	"github.com/bocanada/rest-ws/middleware"
 	"github.com/bocanada/rest-ws/server"
-	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
 
+const usage = `Usage:
+  rest-ws [flags]               start the server
+  rest-ws config print [flags]  print the effective configuration
+
+Settings are read, by increasing precedence, from the file named by -config
+or CONFIG_FILE, from environment variables (PORT, JWT_SECRET, ...) and from
+flags. Run rest-ws -h for the list.`
+
 func main() {
-	err := godotenv.Load(".env")
-	if err != nil {
+	// .env is a convenience for development, deployments use the
+	// environment or a config file.
+	if err := godotenv.Load(".env"); err != nil && !errors.Is(err, fs.ErrNotExist) {
 		log.Fatalf("Error loading .env file: %s", err)
 	}
 
-	PORT := os.Getenv("PORT")
-	JWT_SECRET := os.Getenv("JWT_SECRET")
-	DATABASE_URL := os.Getenv("DATABASE_URL")
+	args := os.Args[1:]
+	printConfig := false
+	if len(args) > 0 && args[0] == "config" {
+		if len(args) < 2 || args[1] != "print" {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		printConfig = true
+		args = args[2:]
+	}
 
-	cfg := server.Config{JWTSecret: JWT_SECRET, Port: PORT, DatabaseUrl: DATABASE_URL}
-	s, err := server.NewServer(context.Background(), &cfg)
+	cfg, err := server.LoadConfig("rest-ws", args, os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	s.Start(BindRoutes)
-}
+	if printConfig {
+		if err = server.PrintConfig(os.Stdout, cfg); err != nil {
+			log.Fatal(err)
+		}
+		if err = cfg.Validate(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-func BindRoutes(s server.Server, r *mux.Router) {
-	r.Use(middleware.CheckAuthMiddleware(s))
-	api := r.PathPrefix("/api/v1").Subrouter()
-	r.HandleFunc("/ws", s.Hub().HandleWebSocket)
-	r.HandleFunc("/", handlers.HomeHandler(s)).Methods(http.MethodGet)
-	r.HandleFunc("/signup", handlers.SignUpHandler(s)).Methods(http.MethodPost)
-	r.HandleFunc("/login", handlers.LoginHandler(s)).Methods(http.MethodPost)
-	r.HandleFunc("/me", handlers.MeHandler(s)).Methods(http.MethodGet)
-	r.HandleFunc("/posts/{id}", handlers.GetPostByIdHandler(s)).Methods(http.MethodGet)
-	r.HandleFunc("/posts", handlers.ListPostsHandler(s)).Methods(http.MethodGet)
-
-	api.HandleFunc("/posts", handlers.InsertPostHandler(s)).Methods(http.MethodPost, http.MethodOptions)
-	api.HandleFunc("/posts/{id}", handlers.UpdatePostHandler(s)).Methods(http.MethodPatch, http.MethodOptions)
-	api.HandleFunc("/posts/{id}", handlers.DeletePostHandler(s)).Methods(http.MethodDelete, http.MethodOptions)
+	logger := server.NewLogger(os.Stderr, cfg)
+	slog.SetDefault(logger)
+	s, err := server.NewServer(context.Background(), cfg, server.WithLogger(logger))
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.Start(handlers.BindRoutes)
 }
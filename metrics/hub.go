@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"github.com/bocanada/rest-ws/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RegisterHub exports the Stats of hub, read at scrape time.
+func (m *Metrics) RegisterHub(hub *websocket.Hub) {
+	m.registry.MustRegister(newHubCollector(hub))
+}
+
+type hubCollector struct {
+	hub         *websocket.Hub
+	clients     *prometheus.Desc
+	queueDepth  *prometheus.Desc
+	broadcasts  *prometheus.Desc
+	dropped     *prometheus.Desc
+	disconnects *prometheus.Desc
+}
+
+func newHubCollector(hub *websocket.Hub) *hubCollector {
+	desc := func(name string, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "websocket", name), help, labels, nil)
+	}
+	return &hubCollector{
+		hub:         hub,
+		clients:     desc("clients", "Connected WebSocket clients."),
+		queueDepth:  desc("queue_depth", "Messages waiting in the send buffers of the clients."),
+		broadcasts:  desc("broadcasts_total", "Messages broadcast on the hub."),
+		dropped:     desc("dropped_messages_total", "Messages dropped because a client's send buffer was full."),
+		disconnects: desc("disconnects_total", "Clients disconnected by reason.", "reason"),
+	}
+}
+
+func (c *hubCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+func (c *hubCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.hub.Stats()
+	ch <- prometheus.MustNewConstMetric(c.clients, prometheus.GaugeValue, float64(s.Clients))
+	ch <- prometheus.MustNewConstMetric(c.queueDepth, prometheus.GaugeValue, float64(s.QueueDepth))
+	ch <- prometheus.MustNewConstMetric(c.broadcasts, prometheus.CounterValue, float64(s.Broadcasts))
+	ch <- prometheus.MustNewConstMetric(c.dropped, prometheus.CounterValue, float64(s.Dropped))
+	for _, reason := range websocket.DisconnectReasons {
+		ch <- prometheus.MustNewConstMetric(c.disconnects, prometheus.CounterValue, float64(s.Disconnects[reason]), reason)
+	}
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/bocanada/rest-ws/repository"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// InstrumentRepository returns repo with every call timed and every error
+// counted. When repo has a connection pool, its statistics are exported
+// too.
+func (m *Metrics) InstrumentRepository(repo repository.Repository) repository.Repository {
+	if p, ok := repo.(interface{ Stats() sql.DBStats }); ok {
+		m.registry.MustRegister(newPoolCollector(p.Stats))
+	}
+	return repository.Instrument(repo, m.observeRepository)
+}
+
+func (m *Metrics) observeRepository(ctx context.Context, method string) (context.Context, func(err error)) {
+	start := time.Now()
+	return ctx, func(err error) {
+		m.repoDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+		if err != nil {
+			m.repoErrors.WithLabelValues(method, errorKind(err)).Inc()
+		}
+	}
+}
+
+// errorKind sorts repository errors into the few kinds callers tell apart.
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		return "not_found"
+	case errors.Is(err, repository.ErrConflict):
+		return "conflict"
+	case errors.Is(err, repository.ErrVersionMismatch):
+		return "version_mismatch"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	default:
+		return "other"
+	}
+}
+
+// poolCollector exports sql.DBStats, read at scrape time.
+type poolCollector struct {
+	stats        func() sql.DBStats
+	maxOpen      *prometheus.Desc
+	open         *prometheus.Desc
+	inUse        *prometheus.Desc
+	idle         *prometheus.Desc
+	waitCount    *prometheus.Desc
+	waitDuration *prometheus.Desc
+}
+
+func newPoolCollector(stats func() sql.DBStats) *poolCollector {
+	desc := func(name string, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", name), help, nil, nil)
+	}
+	return &poolCollector{
+		stats:        stats,
+		maxOpen:      desc("max_open_connections", "Maximum number of open connections, 0 for no limit."),
+		open:         desc("open_connections", "Open connections, in use or idle."),
+		inUse:        desc("in_use_connections", "Connections in use."),
+		idle:         desc("idle_connections", "Idle connections."),
+		waitCount:    desc("wait_total", "Times a connection had to be waited for."),
+		waitDuration: desc("wait_seconds_total", "Time spent waiting for a connection."),
+	}
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.stats()
+	ch <- prometheus.MustNewConstMetric(c.maxOpen, prometheus.GaugeValue, float64(s.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.open, prometheus.GaugeValue, float64(s.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.inUse, prometheus.GaugeValue, float64(s.InUse))
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(s.Idle))
+	ch <- prometheus.MustNewConstMetric(c.waitCount, prometheus.CounterValue, float64(s.WaitCount))
+	ch <- prometheus.MustNewConstMetric(c.waitDuration, prometheus.CounterValue, s.WaitDuration.Seconds())
+}
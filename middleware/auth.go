@@ -1,10 +1,13 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
 	"strings"
 
 	"github.com/bocanada/rest-ws/helpers"
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/repository"
 	"github.com/bocanada/rest-ws/server"
 	"github.com/golang-jwt/jwt"
 	"github.com/gorilla/mux"
@@ -15,6 +18,8 @@ var (
 		"/",
 		"login",
 		"signup",
+		"verify-email",
+		"password/",
 	}
 )
 
@@ -27,9 +32,31 @@ func shouldCheckToken(route string) bool {
 	return true
 }
 
-func CheckAuthMiddleware(s server.Server) mux.MiddlewareFunc {
+// RouteScopes maps routes to the scope personal access tokens need to be
+// used on them. Access tokens are refused on every other route.
+type RouteScopes map[*mux.Route]string
+
+// Require makes route need scope from access tokens and returns it.
+func (rs RouteScopes) Require(scope string, route *mux.Route) *mux.Route {
+	rs[route] = scope
+	return route
+}
+
+// CheckAuthMiddleware checks the token of requests. Personal access tokens
+// are looked up and must hold the scope scopes gives the route; the claims
+// of their user then reach the handlers through helpers.RequestClaims.
+func CheckAuthMiddleware(s server.Server, scopes RouteScopes) mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token := strings.TrimSpace(r.Header.Get("Authorization")); strings.HasPrefix(token, models.AccessTokenPrefix) {
+				claims, err := checkAccessToken(s, scopes, r, token)
+				if err != nil {
+					helpers.SendError(w, r, err)
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(helpers.WithClaims(r.Context(), claims)))
+				return
+			}
 			if !shouldCheckToken(r.URL.Path) {
 				next.ServeHTTP(w, r)
 				return
@@ -38,10 +65,32 @@ func CheckAuthMiddleware(s server.Server) mux.MiddlewareFunc {
 				return []byte(s.Config().JWTSecret), nil
 			})
 			if err != nil {
-				helpers.NewResponseError(err).Send(w, http.StatusUnauthorized)
+				helpers.SendError(w, r, models.ErrUnauthorized.Wrap(err))
 				return
 			}
 			next.ServeHTTP(w, r)
 		})
 	}
 }
+
+// checkAccessToken returns the claims of the user of the personal access
+// token, if it is valid and holds the scope of the route of r.
+func checkAccessToken(s server.Server, scopes RouteScopes, r *http.Request, token string) (*models.AppClaims, error) {
+	accessToken, err := s.Repository().GetAccessTokenByHash(r.Context(), helpers.HashToken(token))
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, models.ErrUnauthorized.Wrap(helpers.InvalidToken)
+		}
+		return nil, err
+	}
+	scope, ok := scopes[mux.CurrentRoute(r)]
+	if !ok || !accessToken.HasScope(scope) {
+		return nil, models.ErrInsufficientScope
+	}
+	// Last use is only a hint for users cleaning up their tokens; failing to
+	// record it does not fail the request.
+	if err = s.Repository().MarkAccessTokenUsed(r.Context(), accessToken.Id); err != nil {
+		helpers.Logger(r.Context()).Warn("recording the use of an access token failed", "token_id", accessToken.Id, "error", err)
+	}
+	return helpers.NewAppClaims(accessToken.UserId, accessToken.ExpiresAt), nil
+}
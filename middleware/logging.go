@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bocanada/rest-ws/helpers"
+	"github.com/bocanada/rest-ws/server"
+	"github.com/gorilla/mux"
+	"github.com/segmentio/ksuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	RequestIdHeader = "X-Request-ID"
+	// maxRequestIdLength bounds the ids accepted from clients, which end up
+	// in every log line of the request.
+	maxRequestIdLength = 128
+)
+
+// RequestIdMiddleware gives every request an id, the one in X-Request-ID
+// when the client sent a sensible one, and echoes it in the response. The
+// context of the request carries the id and a logger of s tagged with it
+// and with the trace id, see helpers.RequestId and helpers.Logger.
+func RequestIdMiddleware(s server.Server) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIdHeader)
+			if !validRequestId(id) {
+				id = ksuid.New().String()
+			}
+			w.Header().Set(RequestIdHeader, id)
+			logger := s.Logger().With("request_id", id)
+			if span := trace.SpanContextFromContext(r.Context()); span.IsValid() {
+				logger = logger.With("trace_id", span.TraceID().String())
+			}
+			ctx := helpers.WithRequestId(r.Context(), id)
+			ctx = helpers.WithLogger(ctx, logger)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func validRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLength {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// AccessLogMiddleware logs a line for every request once it is served. It
+// relies on RequestIdMiddleware running first for the request id.
+func AccessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := helpers.NewStatusRecorder(w)
+		next.ServeHTTP(recorder, r)
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		level := slog.LevelInfo
+		if recorder.Status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		helpers.Logger(r.Context()).Log(r.Context(), level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", route,
+			"status", recorder.Status,
+			"bytes", recorder.Bytes,
+			"duration", time.Since(start),
+			"remote_addr", r.RemoteAddr,
+			"user_agent", r.UserAgent(),
+		)
+	})
+}
@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bocanada/rest-ws/helpers"
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/ratelimit"
+	"github.com/bocanada/rest-ws/server"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+)
+
+// RateLimitMiddleware draws a token for every rule of Config.RateLimits
+// keyed by client address or route that matches the route of the request,
+// and answers 429 with Retry-After once one of them runs out. The
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers describe
+// the bucket closest to running out. The limiter failing lets the request
+// through.
+func RateLimitMiddleware(s server.Server) mux.MiddlewareFunc {
+	return rateLimit(s, func(rule ratelimit.Rule) bool { return rule.Key != ratelimit.KeyUser })
+}
+
+// UserRateLimitMiddleware is RateLimitMiddleware for the rules keyed by
+// user. It goes after CheckAuthMiddleware, so that access tokens only count
+// once they are known to be valid, and then towards their user.
+func UserRateLimitMiddleware(s server.Server) mux.MiddlewareFunc {
+	return rateLimit(s, func(rule ratelimit.Rule) bool { return rule.Key == ratelimit.KeyUser })
+}
+
+func rateLimit(s server.Server, applies func(ratelimit.Rule) bool) mux.MiddlewareFunc {
+	// Config.Validate already checked the rules.
+	all, _ := ratelimit.ParseRules(s.Config().RateLimits)
+	var rules []ratelimit.Rule
+	for _, rule := range all {
+		if applies(rule) {
+			rules = append(rules, rule)
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := ""
+			if current := mux.CurrentRoute(r); current != nil {
+				route, _ = current.GetPathTemplate()
+			}
+			var closest *ratelimit.Result
+			for _, rule := range rules {
+				if !rule.Matches(r.Method, route) {
+					continue
+				}
+				key := rule.String() + "|" + rateLimitSubject(s, r, rule.Key, route)
+				res, err := s.RateLimiter().Allow(r.Context(), key, rule)
+				if err != nil {
+					helpers.Logger(r.Context()).Warn("rate limiter failed", "rule", rule.String(), "error", err)
+					continue
+				}
+				if closest == nil || !res.Allowed || res.Remaining < closest.Remaining {
+					closest = &res
+				}
+				if !res.Allowed {
+					break
+				}
+			}
+			// RateLimitMiddleware may have described a bucket closer to
+			// running out already.
+			if closest == nil || (closest.Allowed && closerBucket(w, closest.Remaining)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(closest.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(closest.Remaining))
+			w.Header().Set("RateLimit-Reset", ceilSeconds(closest.Reset))
+			if !closest.Allowed {
+				helpers.SetRetryAfter(w, closest.RetryAfter)
+				helpers.SendError(w, r, models.ErrRateLimited)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimitSubject names the bucket of the request for rules with key.
+func rateLimitSubject(s server.Server, r *http.Request, key ratelimit.Key, route string) string {
+	switch key {
+	case ratelimit.KeyRoute:
+		return "route:" + route
+	case ratelimit.KeyUser:
+		// Access tokens are checked by now, their claims are in the context.
+		claims, err := helpers.RequestClaims(r, func(t *jwt.Token) (interface{}, error) {
+			return []byte(s.Config().JWTSecret), nil
+		})
+		if err == nil {
+			return "user:" + claims.UserId
+		}
+	}
+	return "ip:" + helpers.ClientIP(r, s.Config().RateLimitIPHeader)
+}
+
+// closerBucket reports whether the RateLimit-Remaining header already set on
+// w is at most remaining.
+func closerBucket(w http.ResponseWriter, remaining int) bool {
+	set, err := strconv.Atoi(w.Header().Get("RateLimit-Remaining"))
+	return err == nil && set <= remaining
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
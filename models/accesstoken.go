@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+// Scopes of access tokens, each allowing a group of routes.
+const (
+	ScopePostsRead    = "posts:read"
+	ScopePostsWrite   = "posts:write"
+	ScopeProfileRead  = "profile:read"
+	ScopeProfileWrite = "profile:write"
+	ScopeFollowsWrite = "follows:write"
+)
+
+// Scopes lists every scope an access token may be given.
+var Scopes = []string{ScopePostsRead, ScopePostsWrite, ScopeProfileRead, ScopeProfileWrite, ScopeFollowsWrite}
+
+// AccessTokenPrefix starts every personal access token, which tells them
+// apart from the JWTs of logins.
+const AccessTokenPrefix = "rwpat_"
+
+// AccessToken is a personal access token, a long-lived credential users
+// create for scripts and bots. Only the hash of the token is stored.
+type AccessToken struct {
+	Id         string     `json:"id"`
+	UserId     string     `json:"user_id"`
+	Name       string     `json:"name"`
+	TokenHash  string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// HasScope reports whether the token was given scope.
+func (t *AccessToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
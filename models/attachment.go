@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+type Attachment struct {
+	Id          string    `json:"id"`
+	PostId      string    `json:"post_id"`
+	UserId      string    `json:"user_id"`
+	FileName    string    `json:"file_name"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	StorageKey  string    `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+}
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error is an application error clients can act on: an HTTP status, a stable
+// machine-readable code and a message that is safe to show. The error that
+// caused it, if any, is kept for logging and never sent.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	Fields  []FieldError
+	Err     error
+}
+
+func NewError(status int, code string, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is match copies made by Wrap and WithFields against the
+// sentinel they came from.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Wrap returns a copy of e caused by err.
+func (e *Error) Wrap(err error) *Error {
+	c := *e
+	c.Err = err
+	return &c
+}
+
+// WithFields returns a copy of e listing the invalid fields of a request.
+func (e *Error) WithFields(fields []FieldError) *Error {
+	c := *e
+	c.Fields = fields
+	return &c
+}
+
+var (
+	ErrInternal          = NewError(http.StatusInternalServerError, "internal_error", "internal server error")
+	ErrBadRequest        = NewError(http.StatusBadRequest, "bad_request", "request could not be read")
+	ErrMalformedBody     = NewError(http.StatusBadRequest, "malformed_body", "request body is not valid JSON")
+	ErrUnauthorized      = NewError(http.StatusUnauthorized, "unauthorized", "missing or invalid token")
+	ErrValidation        = NewError(http.StatusUnprocessableEntity, "validation_failed", "request has invalid fields")
+	ErrRateLimited       = NewError(http.StatusTooManyRequests, "rate_limited", "too many requests, slow down")
+	ErrInsufficientScope = NewError(http.StatusForbidden, "insufficient_scope", "the access token is not allowed on this route")
+)
+
+// Problem is an RFC 7807 problem details document.
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     string       `json:"code"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+func (p Problem) Send(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// LoginFailures counts the failed logins made since FirstFailedAt for a key,
+// which names an email address or a client address.
+type LoginFailures struct {
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	FirstFailedAt time.Time  `json:"first_failed_at"`
+	LastFailedAt  time.Time  `json:"last_failed_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
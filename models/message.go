@@ -1,9 +1,10 @@
 package models
 
 var (
-	PostCreatedMessage = "PostCreated"
-	PostUpdatedMessage = "PostUpdated"
-	PostDeletedMessage = "PostDeleted"
+	PostCreatedMessage  = "PostCreated"
+	PostUpdatedMessage  = "PostUpdated"
+	PostDeletedMessage  = "PostDeleted"
+	PostRestoredMessage = "PostRestored"
 )
 
 type WebSocketMessage struct {
@@ -2,9 +2,33 @@ package models
 
 import "time"
 
+const (
+	PostStatusDraft     = "draft"
+	PostStatusScheduled = "scheduled"
+	PostStatusPublished = "published"
+
+	PostVisibilityPublic    = "public"
+	PostVisibilityFollowers = "followers"
+	PostVisibilityPrivate   = "private"
+)
+
 type Post struct {
-	Id          string    `json:"id"`
+	Id          string     `json:"id"`
+	PostContent string     `json:"post_content"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	Revision    int        `json:"revision"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	Status      string     `json:"status"`
+	PublishAt   *time.Time `json:"publish_at,omitempty"`
+	Visibility  string     `json:"visibility"`
+	UserId      string     `json:"user_id"`
+}
+
+type PostRevision struct {
+	PostId      string    `json:"post_id"`
+	Revision    int       `json:"revision"`
 	PostContent string    `json:"post_content"`
+	EditorId    string    `json:"editor_id"`
 	CreatedAt   time.Time `json:"created_at"`
-	UserId      string    `json:"user_id"`
 }
@@ -5,11 +5,20 @@ import (
 	"net/http"
 )
 
+// FieldError describes why one field of a request was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
 type Response[T any] struct {
-	Error  string `json:"error,omitempty"`
-	Result T      `json:"result,omitempty"`
-	Next   string `json:"next,omitempty"`
-	Ok     bool   `json:"ok"`
+	Error  string       `json:"error,omitempty"`
+	Code   string       `json:"code,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+	Result T            `json:"result,omitempty"`
+	Next   string       `json:"next,omitempty"`
+	Ok     bool         `json:"ok"`
 }
 
 func (r Response[T]) Send(w http.ResponseWriter, statusCode int) {
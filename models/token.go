@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+const (
+	TokenPurposeVerifyEmail   = "verify_email"
+	TokenPurposePasswordReset = "password_reset"
+	// TokenPurposeLoginChallenge is handed out by the login of users with
+	// two-factor authentication, to be traded for an access token along
+	// with their code.
+	TokenPurposeLoginChallenge = "login_challenge"
+)
+
+// UserToken is a single-use token mailed to a user. Only the hash of the
+// token is stored.
+type UserToken struct {
+	TokenHash string    `json:"-"`
+	UserId    string    `json:"user_id"`
+	Purpose   string    `json:"purpose"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// TOTP is the two-factor authentication of a user. It is only enforced once
+// EnabledAt is set, after the user proved their authenticator app has the
+// secret. LastStep is the step of the last code accepted, so that no code
+// works twice.
+type TOTP struct {
+	UserId    string     `json:"user_id"`
+	Secret    string     `json:"-"`
+	EnabledAt *time.Time `json:"enabled_at"`
+	LastStep  int64      `json:"-"`
+}
@@ -1,7 +1,16 @@
 package models
 
+import "time"
+
 type User struct {
-	ID       string  `json:"id"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	ID          string    `json:"id"`
+	Email       string    `json:"email"`
+	Password    string    `json:"-"`
+	Handle      string    `json:"handle"`
+	DisplayName string    `json:"display_name"`
+	Bio         string    `json:"bio"`
+	AvatarId    string    `json:"avatar_id"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
 }
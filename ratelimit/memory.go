@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often a MemoryLimiter forgets the buckets that have
+// filled up again.
+const sweepInterval = time.Minute
+
+// MemoryLimiter keeps its buckets in the memory of the process, so every
+// instance enforces its limits on its own.
+type MemoryLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket holds Limit tokens again.
+	full time.Time
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+func (l *MemoryLimiter) Allow(ctx context.Context, key string, rule Rule) (Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rule.Limit), updated: now}
+		l.buckets[key] = b
+	}
+	allowed := b.take(now, rule)
+	return rule.result(allowed, b.tokens), nil
+}
+
+// take refills b for the time elapsed since its last use and takes a token
+// from it if there is one.
+func (b *bucket) take(now time.Time, rule Rule) bool {
+	elapsed := now.Sub(b.updated).Seconds()
+	b.tokens = math.Min(float64(rule.Limit), b.tokens+elapsed*rule.rate())
+	b.updated = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	b.full = now.Add(seconds((float64(rule.Limit) - b.tokens) / rule.rate()))
+	return allowed
+}
+
+func (l *MemoryLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if !now.Before(b.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Bucket is a token bucket for a single client, such as a WebSocket
+// connection, that needs no key. It is not safe for concurrent use.
+type Bucket struct {
+	rule Rule
+	b    bucket
+}
+
+// NewBucket returns a full bucket of limit tokens refilled every period.
+func NewBucket(limit int, period time.Duration) *Bucket {
+	return &Bucket{
+		rule: Rule{Limit: limit, Period: period},
+		b:    bucket{tokens: float64(limit), updated: time.Now()},
+	}
+}
+
+// Take reports whether a token was left, and takes it.
+func (b *Bucket) Take() bool {
+	return b.b.take(time.Now(), b.rule)
+}
@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// refilled is the content of the bucket b of rate_limits once refilled,
+// with $2 the limit and $3 the rate per second.
+const refilled = "LEAST($2, b.tokens + EXTRACT(EPOCH FROM NOW() - b.updated_at) * $3)"
+
+const allowQuery = `INSERT INTO rate_limits AS b (key, tokens, allowed, updated_at)
+VALUES ($1, $2 - 1, TRUE, NOW())
+ON CONFLICT (key) DO UPDATE SET
+    tokens = ` + refilled + ` - CASE WHEN ` + refilled + ` >= 1 THEN 1 ELSE 0 END,
+    allowed = ` + refilled + ` >= 1,
+    updated_at = NOW()
+RETURNING tokens, allowed`
+
+// PostgresLimiter keeps its buckets in the rate_limits table, so that every
+// instance sharing the database enforces the same limits.
+type PostgresLimiter struct {
+	db *sql.DB
+}
+
+func NewPostgresLimiter(db *sql.DB) *PostgresLimiter {
+	return &PostgresLimiter{db: db}
+}
+
+func (l *PostgresLimiter) Allow(ctx context.Context, key string, rule Rule) (Result, error) {
+	var tokens float64
+	var allowed bool
+	if err := l.db.QueryRowContext(ctx, allowQuery, key, rule.Limit, rule.rate()).Scan(&tokens, &allowed); err != nil {
+		return Result{}, err
+	}
+	return rule.result(allowed, tokens), nil
+}
+
+// Sweep deletes the buckets unused for longer than olderThan, which must be
+// at least the longest period of the rules for the deleted buckets to be
+// full anyway.
+func (l *PostgresLimiter) Sweep(ctx context.Context, olderThan time.Duration) (int64, error) {
+	res, err := l.db.ExecContext(ctx, "DELETE FROM rate_limits WHERE updated_at < NOW() - $1 * INTERVAL '1 second'", olderThan.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,138 @@
+// Package ratelimit implements token buckets, kept in memory or in a store
+// shared by several instances, and the rules deciding which requests draw
+// from which bucket.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limiter takes a token from the bucket called key, which holds up to
+// rule.Limit tokens and refills completely every rule.Period.
+type Limiter interface {
+	Allow(ctx context.Context, key string, rule Rule) (Result, error)
+}
+
+// Result describes a bucket after a call to Allow.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long the bucket takes to fill up again.
+	Reset time.Duration
+	// RetryAfter is how long to wait for the next token when the call was
+	// not allowed.
+	RetryAfter time.Duration
+}
+
+// Key tells which requests share a bucket.
+type Key string
+
+const (
+	// KeyIP gives every client address a bucket.
+	KeyIP Key = "ip"
+	// KeyUser gives every authenticated user a bucket; anonymous requests
+	// fall back to their address.
+	KeyUser Key = "user"
+	// KeyRoute makes every request of the route share one bucket.
+	KeyRoute Key = "route"
+)
+
+// Any matches every method or route in a Rule.
+const Any = "*"
+
+// Rule limits the requests whose method and mux route template match to
+// Limit per Period for each Key.
+type Rule struct {
+	Method string
+	Route  string
+	Key    Key
+	Limit  int
+	Period time.Duration
+}
+
+// ParseRule reads a rule written as "METHOD ROUTE=KEY:LIMIT/PERIOD", for
+// instance "POST /login=ip:10/1m" or "* *=user:600/1m".
+func ParseRule(s string) (Rule, error) {
+	var rule Rule
+	target, limit, ok := strings.Cut(s, "=")
+	if !ok {
+		return rule, fmt.Errorf("rate limit %q: missing =", s)
+	}
+	fields := strings.Fields(target)
+	if len(fields) != 2 {
+		return rule, fmt.Errorf("rate limit %q: want METHOD ROUTE before =", s)
+	}
+	rule.Method, rule.Route = strings.ToUpper(fields[0]), fields[1]
+	key, rate, ok := strings.Cut(strings.TrimSpace(limit), ":")
+	if !ok {
+		return rule, fmt.Errorf("rate limit %q: want KEY:LIMIT/PERIOD after =", s)
+	}
+	switch rule.Key = Key(key); rule.Key {
+	case KeyIP, KeyUser, KeyRoute:
+	default:
+		return rule, fmt.Errorf("rate limit %q: key must be ip, user or route", s)
+	}
+	count, period, ok := strings.Cut(rate, "/")
+	if !ok {
+		return rule, fmt.Errorf("rate limit %q: want LIMIT/PERIOD", s)
+	}
+	var err error
+	if rule.Limit, err = strconv.Atoi(count); err != nil || rule.Limit <= 0 {
+		return rule, fmt.Errorf("rate limit %q: limit must be a positive integer", s)
+	}
+	if rule.Period, err = time.ParseDuration(period); err != nil || rule.Period <= 0 {
+		return rule, fmt.Errorf("rate limit %q: period must be a positive duration", s)
+	}
+	return rule, nil
+}
+
+func (r Rule) String() string {
+	return fmt.Sprintf("%s %s=%s:%d/%s", r.Method, r.Route, r.Key, r.Limit, r.Period)
+}
+
+// Matches reports whether the rule applies to requests for method on the
+// route with the given template.
+func (r Rule) Matches(method string, route string) bool {
+	return (r.Method == Any || r.Method == method) && (r.Route == Any || r.Route == route)
+}
+
+// rate is the number of tokens the bucket of r gains per second.
+func (r Rule) rate() float64 {
+	return float64(r.Limit) / r.Period.Seconds()
+}
+
+// result describes a bucket of rule holding tokens after a call to Allow.
+func (r Rule) result(allowed bool, tokens float64) Result {
+	res := Result{
+		Allowed:   allowed,
+		Limit:     r.Limit,
+		Remaining: int(math.Max(0, math.Floor(tokens))),
+		Reset:     seconds((float64(r.Limit) - tokens) / r.rate()),
+	}
+	if !allowed {
+		res.RetryAfter = seconds((1 - tokens) / r.rate())
+	}
+	return res
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(math.Max(0, s) * float64(time.Second)))
+}
+
+// ParseRules parses every rule of rules with ParseRule.
+func ParseRules(rules []string) ([]Rule, error) {
+	parsed := make([]Rule, len(rules))
+	for i, s := range rules {
+		var err error
+		if parsed[i], err = ParseRule(s); err != nil {
+			return nil, err
+		}
+	}
+	return parsed, nil
+}
@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule("post /login=ip:10/1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Rule{Method: "POST", Route: "/login", Key: KeyIP, Limit: 10, Period: time.Minute}
+	if rule != want {
+		t.Errorf("ParseRule = %+v, want %+v", rule, want)
+	}
+	if !rule.Matches("POST", "/login") || rule.Matches("GET", "/login") || rule.Matches("POST", "/signup") {
+		t.Errorf("%s matches the wrong requests", rule)
+	}
+	if all, _ := ParseRule("* *=route:1/1s"); !all.Matches("GET", "/posts/{id}") {
+		t.Errorf("%s does not match every request", all)
+	}
+	for _, bad := range []string{
+		"POST /login",
+		"/login=ip:10/1m",
+		"POST /login=ip",
+		"POST /login=host:10/1m",
+		"POST /login=ip:10",
+		"POST /login=ip:0/1m",
+		"POST /login=ip:10/soon",
+	} {
+		if _, err := ParseRule(bad); err == nil {
+			t.Errorf("ParseRule(%q): no error", bad)
+		}
+	}
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewMemoryLimiter()
+	l.now = func() time.Time { return now }
+	rule := Rule{Key: KeyIP, Limit: 2, Period: 10 * time.Second}
+	ctx := context.Background()
+
+	for i, remaining := range []int{1, 0} {
+		res, _ := l.Allow(ctx, "a", rule)
+		if !res.Allowed || res.Remaining != remaining {
+			t.Fatalf("call %d = %+v, want allowed with %d remaining", i, res, remaining)
+		}
+	}
+	res, _ := l.Allow(ctx, "a", rule)
+	if res.Allowed || res.RetryAfter != 5*time.Second || res.Reset != 10*time.Second {
+		t.Errorf("over the limit = %+v, want denied, retry after 5s and reset after 10s", res)
+	}
+	if res, _ := l.Allow(ctx, "b", rule); !res.Allowed {
+		t.Errorf("another key = %+v, want its own bucket", res)
+	}
+
+	now = now.Add(5 * time.Second)
+	if res, _ := l.Allow(ctx, "a", rule); !res.Allowed || res.Remaining != 0 {
+		t.Errorf("after a refill = %+v, want one token", res)
+	}
+
+	now = now.Add(time.Hour)
+	l.Allow(ctx, "c", rule)
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("full bucket not swept")
+	}
+}
+
+func TestBucket(t *testing.T) {
+	b := NewBucket(3, time.Hour)
+	for i := 0; i < 3; i++ {
+		if !b.Take() {
+			t.Fatalf("take %d denied", i)
+		}
+	}
+	if b.Take() {
+		t.Error("take over the limit allowed")
+	}
+}
@@ -0,0 +1,26 @@
+package repository
+
+import "errors"
+
+var (
+	ErrNotFound        = errors.New("resource not found")
+	ErrVersionMismatch = errors.New("resource was modified concurrently")
+	ErrConflict        = errors.New("resource conflicts with an existing one")
+	// ErrNoRepository is returned by the deprecated package-level functions
+	// until SetRepository is called.
+	ErrNoRepository = errors.New("repository: SetRepository has not been called")
+)
+
+// ConflictError is returned when a write would break a uniqueness rule, such
+// as two accounts sharing an email address. It matches ErrConflict.
+type ConflictError struct {
+	Field string
+}
+
+func (e *ConflictError) Error() string {
+	return e.Field + " is already in use"
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
@@ -0,0 +1,339 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/bocanada/rest-ws/models"
+)
+
+// Hook observes the calls of an instrumented Repository. It runs before
+// each call with the name of the method and returns the context the call
+// runs with, along with a function to run with the error of the call once
+// it returns.
+type Hook func(ctx context.Context, method string) (context.Context, func(err error))
+
+// Instrument returns a Repository forwarding every call to next through
+// hook. The result implements Unwrap, which returns next.
+func Instrument(next Repository, hook Hook) Repository {
+	return &instrumented{next: next, hook: hook}
+}
+
+type instrumented struct {
+	next Repository
+	hook Hook
+}
+
+func (r *instrumented) Unwrap() Repository {
+	return r.next
+}
+
+func (r *instrumented) InsertUser(ctx context.Context, user *models.User) (err error) {
+	ctx, done := r.hook(ctx, "InsertUser")
+	defer func() { done(err) }()
+	return r.next.InsertUser(ctx, user)
+}
+
+func (r *instrumented) GetUserById(ctx context.Context, id string) (_ *models.User, err error) {
+	ctx, done := r.hook(ctx, "GetUserById")
+	defer func() { done(err) }()
+	return r.next.GetUserById(ctx, id)
+}
+
+func (r *instrumented) GetUserByEmail(ctx context.Context, email string) (_ *models.User, err error) {
+	ctx, done := r.hook(ctx, "GetUserByEmail")
+	defer func() { done(err) }()
+	return r.next.GetUserByEmail(ctx, email)
+}
+
+func (r *instrumented) GetUserByHandle(ctx context.Context, handle string) (_ *models.User, err error) {
+	ctx, done := r.hook(ctx, "GetUserByHandle")
+	defer func() { done(err) }()
+	return r.next.GetUserByHandle(ctx, handle)
+}
+
+func (r *instrumented) UpdateUserProfile(ctx context.Context, user *models.User) (err error) {
+	ctx, done := r.hook(ctx, "UpdateUserProfile")
+	defer func() { done(err) }()
+	return r.next.UpdateUserProfile(ctx, user)
+}
+
+func (r *instrumented) SetUserAvatar(ctx context.Context, userId string, avatar *models.Attachment) (err error) {
+	ctx, done := r.hook(ctx, "SetUserAvatar")
+	defer func() { done(err) }()
+	return r.next.SetUserAvatar(ctx, userId, avatar)
+}
+
+func (r *instrumented) MarkEmailVerified(ctx context.Context, userId string) (err error) {
+	ctx, done := r.hook(ctx, "MarkEmailVerified")
+	defer func() { done(err) }()
+	return r.next.MarkEmailVerified(ctx, userId)
+}
+
+func (r *instrumented) UpdateUserPassword(ctx context.Context, userId string, password string) (err error) {
+	ctx, done := r.hook(ctx, "UpdateUserPassword")
+	defer func() { done(err) }()
+	return r.next.UpdateUserPassword(ctx, userId, password)
+}
+
+func (r *instrumented) InsertUserToken(ctx context.Context, token *models.UserToken, ttl time.Duration) (err error) {
+	ctx, done := r.hook(ctx, "InsertUserToken")
+	defer func() { done(err) }()
+	return r.next.InsertUserToken(ctx, token, ttl)
+}
+
+func (r *instrumented) ConsumeUserToken(ctx context.Context, tokenHash string, purpose string) (_ *models.UserToken, err error) {
+	ctx, done := r.hook(ctx, "ConsumeUserToken")
+	defer func() { done(err) }()
+	return r.next.ConsumeUserToken(ctx, tokenHash, purpose)
+}
+
+func (r *instrumented) InsertPost(ctx context.Context, post *models.Post) (err error) {
+	ctx, done := r.hook(ctx, "InsertPost")
+	defer func() { done(err) }()
+	return r.next.InsertPost(ctx, post)
+}
+
+func (r *instrumented) GetPostById(ctx context.Context, id string) (_ *models.Post, err error) {
+	ctx, done := r.hook(ctx, "GetPostById")
+	defer func() { done(err) }()
+	return r.next.GetPostById(ctx, id)
+}
+
+func (r *instrumented) UpdatePost(ctx context.Context, post *models.Post) (err error) {
+	ctx, done := r.hook(ctx, "UpdatePost")
+	defer func() { done(err) }()
+	return r.next.UpdatePost(ctx, post)
+}
+
+func (r *instrumented) DeletePost(ctx context.Context, post *models.Post) (err error) {
+	ctx, done := r.hook(ctx, "DeletePost")
+	defer func() { done(err) }()
+	return r.next.DeletePost(ctx, post)
+}
+
+func (r *instrumented) ListPosts(ctx context.Context, viewerId string, limit uint64, after string) (_ []*models.Post, err error) {
+	ctx, done := r.hook(ctx, "ListPosts")
+	defer func() { done(err) }()
+	return r.next.ListPosts(ctx, viewerId, limit, after)
+}
+
+func (r *instrumented) ListPostsByUser(ctx context.Context, viewerId string, userId string, limit uint64, after string) (_ []*models.Post, err error) {
+	ctx, done := r.hook(ctx, "ListPostsByUser")
+	defer func() { done(err) }()
+	return r.next.ListPostsByUser(ctx, viewerId, userId, limit, after)
+}
+
+func (r *instrumented) GetPostRevision(ctx context.Context, postId string, revision int) (_ *models.PostRevision, err error) {
+	ctx, done := r.hook(ctx, "GetPostRevision")
+	defer func() { done(err) }()
+	return r.next.GetPostRevision(ctx, postId, revision)
+}
+
+func (r *instrumented) ListPostRevisions(ctx context.Context, postId string) (_ []*models.PostRevision, err error) {
+	ctx, done := r.hook(ctx, "ListPostRevisions")
+	defer func() { done(err) }()
+	return r.next.ListPostRevisions(ctx, postId)
+}
+
+func (r *instrumented) ListDeletedPosts(ctx context.Context, userId string, limit uint64, after string) (_ []*models.Post, err error) {
+	ctx, done := r.hook(ctx, "ListDeletedPosts")
+	defer func() { done(err) }()
+	return r.next.ListDeletedPosts(ctx, userId, limit, after)
+}
+
+func (r *instrumented) RestorePost(ctx context.Context, post *models.Post) (err error) {
+	ctx, done := r.hook(ctx, "RestorePost")
+	defer func() { done(err) }()
+	return r.next.RestorePost(ctx, post)
+}
+
+func (r *instrumented) PurgeDeletedPosts(ctx context.Context, olderThan time.Duration) (_ int64, err error) {
+	ctx, done := r.hook(ctx, "PurgeDeletedPosts")
+	defer func() { done(err) }()
+	return r.next.PurgeDeletedPosts(ctx, olderThan)
+}
+
+func (r *instrumented) ListUnpublishedPosts(ctx context.Context, userId string, limit uint64, after string) (_ []*models.Post, err error) {
+	ctx, done := r.hook(ctx, "ListUnpublishedPosts")
+	defer func() { done(err) }()
+	return r.next.ListUnpublishedPosts(ctx, userId, limit, after)
+}
+
+func (r *instrumented) SetPostStatus(ctx context.Context, post *models.Post) (err error) {
+	ctx, done := r.hook(ctx, "SetPostStatus")
+	defer func() { done(err) }()
+	return r.next.SetPostStatus(ctx, post)
+}
+
+func (r *instrumented) PublishDuePosts(ctx context.Context, limit uint64) (_ []*models.Post, err error) {
+	ctx, done := r.hook(ctx, "PublishDuePosts")
+	defer func() { done(err) }()
+	return r.next.PublishDuePosts(ctx, limit)
+}
+
+func (r *instrumented) FollowUser(ctx context.Context, followerId string, followeeId string) (err error) {
+	ctx, done := r.hook(ctx, "FollowUser")
+	defer func() { done(err) }()
+	return r.next.FollowUser(ctx, followerId, followeeId)
+}
+
+func (r *instrumented) UnfollowUser(ctx context.Context, followerId string, followeeId string) (err error) {
+	ctx, done := r.hook(ctx, "UnfollowUser")
+	defer func() { done(err) }()
+	return r.next.UnfollowUser(ctx, followerId, followeeId)
+}
+
+func (r *instrumented) IsFollowing(ctx context.Context, followerId string, followeeId string) (_ bool, err error) {
+	ctx, done := r.hook(ctx, "IsFollowing")
+	defer func() { done(err) }()
+	return r.next.IsFollowing(ctx, followerId, followeeId)
+}
+
+func (r *instrumented) ListFollowerIds(ctx context.Context, userId string) (_ []string, err error) {
+	ctx, done := r.hook(ctx, "ListFollowerIds")
+	defer func() { done(err) }()
+	return r.next.ListFollowerIds(ctx, userId)
+}
+
+func (r *instrumented) InsertAttachment(ctx context.Context, attachment *models.Attachment) (err error) {
+	ctx, done := r.hook(ctx, "InsertAttachment")
+	defer func() { done(err) }()
+	return r.next.InsertAttachment(ctx, attachment)
+}
+
+func (r *instrumented) GetAttachmentById(ctx context.Context, id string) (_ *models.Attachment, err error) {
+	ctx, done := r.hook(ctx, "GetAttachmentById")
+	defer func() { done(err) }()
+	return r.next.GetAttachmentById(ctx, id)
+}
+
+func (r *instrumented) ListAttachments(ctx context.Context, postId string) (_ []*models.Attachment, err error) {
+	ctx, done := r.hook(ctx, "ListAttachments")
+	defer func() { done(err) }()
+	return r.next.ListAttachments(ctx, postId)
+}
+
+func (r *instrumented) ListOrphanedAttachments(ctx context.Context, limit uint64) (_ []*models.Attachment, err error) {
+	ctx, done := r.hook(ctx, "ListOrphanedAttachments")
+	defer func() { done(err) }()
+	return r.next.ListOrphanedAttachments(ctx, limit)
+}
+
+func (r *instrumented) DeleteAttachment(ctx context.Context, attachment *models.Attachment) (err error) {
+	ctx, done := r.hook(ctx, "DeleteAttachment")
+	defer func() { done(err) }()
+	return r.next.DeleteAttachment(ctx, attachment)
+}
+
+func (r *instrumented) GetLoginFailures(ctx context.Context, key string) (_ *models.LoginFailures, err error) {
+	ctx, done := r.hook(ctx, "GetLoginFailures")
+	defer func() { done(err) }()
+	return r.next.GetLoginFailures(ctx, key)
+}
+
+func (r *instrumented) RecordLoginFailure(ctx context.Context, key string, window time.Duration) (_ *models.LoginFailures, err error) {
+	ctx, done := r.hook(ctx, "RecordLoginFailure")
+	defer func() { done(err) }()
+	return r.next.RecordLoginFailure(ctx, key, window)
+}
+
+func (r *instrumented) LockLogin(ctx context.Context, key string, lockout time.Duration) (err error) {
+	ctx, done := r.hook(ctx, "LockLogin")
+	defer func() { done(err) }()
+	return r.next.LockLogin(ctx, key, lockout)
+}
+
+func (r *instrumented) ClearLoginFailures(ctx context.Context, key string) (err error) {
+	ctx, done := r.hook(ctx, "ClearLoginFailures")
+	defer func() { done(err) }()
+	return r.next.ClearLoginFailures(ctx, key)
+}
+
+func (r *instrumented) PurgeLoginFailures(ctx context.Context, olderThan time.Duration) (_ int64, err error) {
+	ctx, done := r.hook(ctx, "PurgeLoginFailures")
+	defer func() { done(err) }()
+	return r.next.PurgeLoginFailures(ctx, olderThan)
+}
+
+func (r *instrumented) SetUserTOTP(ctx context.Context, totp *models.TOTP) (err error) {
+	ctx, done := r.hook(ctx, "SetUserTOTP")
+	defer func() { done(err) }()
+	return r.next.SetUserTOTP(ctx, totp)
+}
+
+func (r *instrumented) GetUserTOTP(ctx context.Context, userId string) (_ *models.TOTP, err error) {
+	ctx, done := r.hook(ctx, "GetUserTOTP")
+	defer func() { done(err) }()
+	return r.next.GetUserTOTP(ctx, userId)
+}
+
+func (r *instrumented) EnableUserTOTP(ctx context.Context, userId string, recoveryCodeHashes []string) (err error) {
+	ctx, done := r.hook(ctx, "EnableUserTOTP")
+	defer func() { done(err) }()
+	return r.next.EnableUserTOTP(ctx, userId, recoveryCodeHashes)
+}
+
+func (r *instrumented) UseTOTPStep(ctx context.Context, userId string, step int64) (err error) {
+	ctx, done := r.hook(ctx, "UseTOTPStep")
+	defer func() { done(err) }()
+	return r.next.UseTOTPStep(ctx, userId, step)
+}
+
+func (r *instrumented) DeleteUserTOTP(ctx context.Context, userId string) (err error) {
+	ctx, done := r.hook(ctx, "DeleteUserTOTP")
+	defer func() { done(err) }()
+	return r.next.DeleteUserTOTP(ctx, userId)
+}
+
+func (r *instrumented) ConsumeRecoveryCode(ctx context.Context, userId string, codeHash string) (err error) {
+	ctx, done := r.hook(ctx, "ConsumeRecoveryCode")
+	defer func() { done(err) }()
+	return r.next.ConsumeRecoveryCode(ctx, userId, codeHash)
+}
+
+func (r *instrumented) CountRecoveryCodes(ctx context.Context, userId string) (_ int, err error) {
+	ctx, done := r.hook(ctx, "CountRecoveryCodes")
+	defer func() { done(err) }()
+	return r.next.CountRecoveryCodes(ctx, userId)
+}
+
+func (r *instrumented) InsertAccessToken(ctx context.Context, token *models.AccessToken, ttl time.Duration) (err error) {
+	ctx, done := r.hook(ctx, "InsertAccessToken")
+	defer func() { done(err) }()
+	return r.next.InsertAccessToken(ctx, token, ttl)
+}
+
+func (r *instrumented) GetAccessTokenByHash(ctx context.Context, tokenHash string) (_ *models.AccessToken, err error) {
+	ctx, done := r.hook(ctx, "GetAccessTokenByHash")
+	defer func() { done(err) }()
+	return r.next.GetAccessTokenByHash(ctx, tokenHash)
+}
+
+func (r *instrumented) ListAccessTokens(ctx context.Context, userId string) (_ []*models.AccessToken, err error) {
+	ctx, done := r.hook(ctx, "ListAccessTokens")
+	defer func() { done(err) }()
+	return r.next.ListAccessTokens(ctx, userId)
+}
+
+func (r *instrumented) MarkAccessTokenUsed(ctx context.Context, id string) (err error) {
+	ctx, done := r.hook(ctx, "MarkAccessTokenUsed")
+	defer func() { done(err) }()
+	return r.next.MarkAccessTokenUsed(ctx, id)
+}
+
+func (r *instrumented) DeleteAccessToken(ctx context.Context, userId string, id string) (err error) {
+	ctx, done := r.hook(ctx, "DeleteAccessToken")
+	defer func() { done(err) }()
+	return r.next.DeleteAccessToken(ctx, userId, id)
+}
+
+func (r *instrumented) Ping(ctx context.Context) (err error) {
+	ctx, done := r.hook(ctx, "Ping")
+	defer func() { done(err) }()
+	return r.next.Ping(ctx)
+}
+
+func (r *instrumented) Close() error {
+	return r.next.Close()
+}
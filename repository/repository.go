@@ -2,55 +2,400 @@ package repository
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/bocanada/rest-ws/models"
 )
 
+// Repository is the storage backend used by the handlers. The
+// repositorytest package holds the contract every implementation honours.
 type Repository interface {
 	InsertUser(ctx context.Context, user *models.User) error
 	GetUserById(ctx context.Context, id string) (*models.User, error)
 	GetUserByEmail(ctx context.Context, email string) (*models.User, error)
+	GetUserByHandle(ctx context.Context, handle string) (*models.User, error)
+	UpdateUserProfile(ctx context.Context, user *models.User) error
+	SetUserAvatar(ctx context.Context, userId string, avatar *models.Attachment) error
+	MarkEmailVerified(ctx context.Context, userId string) error
+	UpdateUserPassword(ctx context.Context, userId string, password string) error
+	InsertUserToken(ctx context.Context, token *models.UserToken, ttl time.Duration) error
+	// ConsumeUserToken marks an unexpired, unused token as used and returns it.
+	ConsumeUserToken(ctx context.Context, tokenHash string, purpose string) (*models.UserToken, error)
 	InsertPost(ctx context.Context, post *models.Post) error
 	GetPostById(ctx context.Context, id string) (*models.Post, error)
+	// UpdatePost and DeletePost fail with ErrVersionMismatch when
+	// post.Revision is set and no longer matches the stored one.
 	UpdatePost(ctx context.Context, post *models.Post) error
 	DeletePost(ctx context.Context, post *models.Post) error
-	ListPosts(ctx context.Context, limit uint64, after string) ([]*models.Post, error)
+	ListPosts(ctx context.Context, viewerId string, limit uint64, after string) ([]*models.Post, error)
+	ListPostsByUser(ctx context.Context, viewerId string, userId string, limit uint64, after string) ([]*models.Post, error)
+	GetPostRevision(ctx context.Context, postId string, revision int) (*models.PostRevision, error)
+	ListPostRevisions(ctx context.Context, postId string) ([]*models.PostRevision, error)
+	ListDeletedPosts(ctx context.Context, userId string, limit uint64, after string) ([]*models.Post, error)
+	RestorePost(ctx context.Context, post *models.Post) error
+	// PurgeDeletedPosts removes for good the posts trashed before olderThan.
+	PurgeDeletedPosts(ctx context.Context, olderThan time.Duration) (int64, error)
+	ListUnpublishedPosts(ctx context.Context, userId string, limit uint64, after string) ([]*models.Post, error)
+	SetPostStatus(ctx context.Context, post *models.Post) error
+	// PublishDuePosts must be safe to call from several instances at once.
+	PublishDuePosts(ctx context.Context, limit uint64) ([]*models.Post, error)
+	FollowUser(ctx context.Context, followerId string, followeeId string) error
+	UnfollowUser(ctx context.Context, followerId string, followeeId string) error
+	IsFollowing(ctx context.Context, followerId string, followeeId string) (bool, error)
+	ListFollowerIds(ctx context.Context, userId string) ([]string, error)
+	InsertAttachment(ctx context.Context, attachment *models.Attachment) error
+	GetAttachmentById(ctx context.Context, id string) (*models.Attachment, error)
+	ListAttachments(ctx context.Context, postId string) ([]*models.Attachment, error)
+	ListOrphanedAttachments(ctx context.Context, limit uint64) ([]*models.Attachment, error)
+	DeleteAttachment(ctx context.Context, attachment *models.Attachment) error
+	GetLoginFailures(ctx context.Context, key string) (*models.LoginFailures, error)
+	// RecordLoginFailure starts the count over once its first failure is
+	// older than window.
+	RecordLoginFailure(ctx context.Context, key string, window time.Duration) (*models.LoginFailures, error)
+	LockLogin(ctx context.Context, key string, lockout time.Duration) error
+	ClearLoginFailures(ctx context.Context, key string) error
+	PurgeLoginFailures(ctx context.Context, olderThan time.Duration) (int64, error)
+	SetUserTOTP(ctx context.Context, totp *models.TOTP) error
+	GetUserTOTP(ctx context.Context, userId string) (*models.TOTP, error)
+	EnableUserTOTP(ctx context.Context, userId string, recoveryCodeHashes []string) error
+	// UseTOTPStep fails with ErrNotFound unless step is later than the last one.
+	UseTOTPStep(ctx context.Context, userId string, step int64) error
+	DeleteUserTOTP(ctx context.Context, userId string) error
+	ConsumeRecoveryCode(ctx context.Context, userId string, codeHash string) error
+	CountRecoveryCodes(ctx context.Context, userId string) (int, error)
+	InsertAccessToken(ctx context.Context, token *models.AccessToken, ttl time.Duration) error
+	GetAccessTokenByHash(ctx context.Context, tokenHash string) (*models.AccessToken, error)
+	ListAccessTokens(ctx context.Context, userId string) ([]*models.AccessToken, error)
+	MarkAccessTokenUsed(ctx context.Context, id string) error
+	DeleteAccessToken(ctx context.Context, userId string, id string) error
+	// Ping fails unless the store is reachable and has the expected schema.
+	Ping(ctx context.Context) error
 	Close() error
 }
 
-var implementation Repository
+// The package-level functions below forward to the Repository given to
+// SetRepository, and fail with ErrNoRepository until it is called. They
+// predate server.Server.Repository and only remain for existing callers;
+// server.NewServer does not set it.
 
+var (
+	implementationMu sync.RWMutex
+	implementation   Repository
+)
+
+// SetRepository sets the Repository the package-level functions forward to.
+//
+// Deprecated: pass the Repository to server.NewServer with
+// server.WithRepository and reach it through server.Server.Repository.
 func SetRepository(repository Repository) {
+	implementationMu.Lock()
+	defer implementationMu.Unlock()
 	implementation = repository
 }
 
+func current() (Repository, error) {
+	implementationMu.RLock()
+	defer implementationMu.RUnlock()
+	if implementation == nil {
+		return nil, ErrNoRepository
+	}
+	return implementation, nil
+}
+
+// Deprecated: call InsertUser on server.Server.Repository() instead.
 func InsertUser(ctx context.Context, user *models.User) error {
-	return implementation.InsertUser(ctx, user)
+	repo, err := current()
+	if err != nil {
+		return err
+	}
+	return repo.InsertUser(ctx, user)
 }
 
+// Deprecated: call GetUserById on server.Server.Repository() instead.
 func GetUserById(ctx context.Context, id string) (*models.User, error) {
-	return implementation.GetUserById(ctx, id)
+	repo, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return repo.GetUserById(ctx, id)
 }
 
+// Deprecated: call GetUserByEmail on server.Server.Repository() instead.
 func GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
-	return implementation.GetUserByEmail(ctx, email)
+	repo, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return repo.GetUserByEmail(ctx, email)
 }
+
+// Deprecated: call GetPostById on server.Server.Repository() instead.
 func GetPostById(ctx context.Context, id string) (*models.Post, error) {
-	return implementation.GetPostById(ctx, id)
+	repo, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return repo.GetPostById(ctx, id)
 }
 
+// Deprecated: call InsertPost on server.Server.Repository() instead.
 func InsertPost(ctx context.Context, post *models.Post) error {
-	return implementation.InsertPost(ctx, post)
+	repo, err := current()
+	if err != nil {
+		return err
+	}
+	return repo.InsertPost(ctx, post)
 }
 
+// Deprecated: call UpdatePost on server.Server.Repository() instead.
 func UpdatePost(ctx context.Context, post *models.Post) error {
-	return implementation.UpdatePost(ctx, post)
+	repo, err := current()
+	if err != nil {
+		return err
+	}
+	return repo.UpdatePost(ctx, post)
 }
 
+// Deprecated: call DeletePost on server.Server.Repository() instead.
 func DeletePost(ctx context.Context, post *models.Post) error {
-	return implementation.DeletePost(ctx, post)
+	repo, err := current()
+	if err != nil {
+		return err
+	}
+	return repo.DeletePost(ctx, post)
+}
+
+// Deprecated: call ListPosts on server.Server.Repository() instead.
+func ListPosts(ctx context.Context, viewerId string, limit uint64, after string) ([]*models.Post, error) {
+	repo, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return repo.ListPosts(ctx, viewerId, limit, after)
+}
+
+// Deprecated: call GetPostRevision on server.Server.Repository() instead.
+func GetPostRevision(ctx context.Context, postId string, revision int) (*models.PostRevision, error) {
+	repo, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return repo.GetPostRevision(ctx, postId, revision)
+}
+
+// Deprecated: call ListPostRevisions on server.Server.Repository() instead.
+func ListPostRevisions(ctx context.Context, postId string) ([]*models.PostRevision, error) {
+	repo, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return repo.ListPostRevisions(ctx, postId)
+}
+
+// Deprecated: call ListDeletedPosts on server.Server.Repository() instead.
+func ListDeletedPosts(ctx context.Context, userId string, limit uint64, after string) ([]*models.Post, error) {
+	repo, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return repo.ListDeletedPosts(ctx, userId, limit, after)
+}
+
+// Deprecated: call RestorePost on server.Server.Repository() instead.
+func RestorePost(ctx context.Context, post *models.Post) error {
+	repo, err := current()
+	if err != nil {
+		return err
+	}
+	return repo.RestorePost(ctx, post)
+}
+
+// Deprecated: call PurgeDeletedPosts on server.Server.Repository() instead.
+func PurgeDeletedPosts(ctx context.Context, olderThan time.Duration) (int64, error) {
+	repo, err := current()
+	if err != nil {
+		return 0, err
+	}
+	return repo.PurgeDeletedPosts(ctx, olderThan)
+}
+
+// Deprecated: call ListUnpublishedPosts on server.Server.Repository() instead.
+func ListUnpublishedPosts(ctx context.Context, userId string, limit uint64, after string) ([]*models.Post, error) {
+	repo, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return repo.ListUnpublishedPosts(ctx, userId, limit, after)
+}
+
+// Deprecated: call SetPostStatus on server.Server.Repository() instead.
+func SetPostStatus(ctx context.Context, post *models.Post) error {
+	repo, err := current()
+	if err != nil {
+		return err
+	}
+	return repo.SetPostStatus(ctx, post)
+}
+
+// Deprecated: call PublishDuePosts on server.Server.Repository() instead.
+func PublishDuePosts(ctx context.Context, limit uint64) ([]*models.Post, error) {
+	repo, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return repo.PublishDuePosts(ctx, limit)
+}
+
+// Deprecated: call FollowUser on server.Server.Repository() instead.
+func FollowUser(ctx context.Context, followerId string, followeeId string) error {
+	repo, err := current()
+	if err != nil {
+		return err
+	}
+	return repo.FollowUser(ctx, followerId, followeeId)
+}
+
+// Deprecated: call UnfollowUser on server.Server.Repository() instead.
+func UnfollowUser(ctx context.Context, followerId string, followeeId string) error {
+	repo, err := current()
+	if err != nil {
+		return err
+	}
+	return repo.UnfollowUser(ctx, followerId, followeeId)
+}
+
+// Deprecated: call IsFollowing on server.Server.Repository() instead.
+func IsFollowing(ctx context.Context, followerId string, followeeId string) (bool, error) {
+	repo, err := current()
+	if err != nil {
+		return false, err
+	}
+	return repo.IsFollowing(ctx, followerId, followeeId)
+}
+
+// Deprecated: call ListFollowerIds on server.Server.Repository() instead.
+func ListFollowerIds(ctx context.Context, userId string) ([]string, error) {
+	repo, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return repo.ListFollowerIds(ctx, userId)
+}
+
+// Deprecated: call InsertAttachment on server.Server.Repository() instead.
+func InsertAttachment(ctx context.Context, attachment *models.Attachment) error {
+	repo, err := current()
+	if err != nil {
+		return err
+	}
+	return repo.InsertAttachment(ctx, attachment)
+}
+
+// Deprecated: call GetAttachmentById on server.Server.Repository() instead.
+func GetAttachmentById(ctx context.Context, id string) (*models.Attachment, error) {
+	repo, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return repo.GetAttachmentById(ctx, id)
+}
+
+// Deprecated: call ListAttachments on server.Server.Repository() instead.
+func ListAttachments(ctx context.Context, postId string) ([]*models.Attachment, error) {
+	repo, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return repo.ListAttachments(ctx, postId)
+}
+
+// Deprecated: call ListOrphanedAttachments on server.Server.Repository() instead.
+func ListOrphanedAttachments(ctx context.Context, limit uint64) ([]*models.Attachment, error) {
+	repo, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return repo.ListOrphanedAttachments(ctx, limit)
+}
+
+// Deprecated: call DeleteAttachment on server.Server.Repository() instead.
+func DeleteAttachment(ctx context.Context, attachment *models.Attachment) error {
+	repo, err := current()
+	if err != nil {
+		return err
+	}
+	return repo.DeleteAttachment(ctx, attachment)
+}
+
+// Deprecated: call GetUserByHandle on server.Server.Repository() instead.
+func GetUserByHandle(ctx context.Context, handle string) (*models.User, error) {
+	repo, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return repo.GetUserByHandle(ctx, handle)
+}
+
+// Deprecated: call UpdateUserProfile on server.Server.Repository() instead.
+func UpdateUserProfile(ctx context.Context, user *models.User) error {
+	repo, err := current()
+	if err != nil {
+		return err
+	}
+	return repo.UpdateUserProfile(ctx, user)
+}
+
+// Deprecated: call SetUserAvatar on server.Server.Repository() instead.
+func SetUserAvatar(ctx context.Context, userId string, avatar *models.Attachment) error {
+	repo, err := current()
+	if err != nil {
+		return err
+	}
+	return repo.SetUserAvatar(ctx, userId, avatar)
+}
+
+// Deprecated: call ListPostsByUser on server.Server.Repository() instead.
+func ListPostsByUser(ctx context.Context, viewerId string, userId string, limit uint64, after string) ([]*models.Post, error) {
+	repo, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return repo.ListPostsByUser(ctx, viewerId, userId, limit, after)
+}
+
+// Deprecated: call MarkEmailVerified on server.Server.Repository() instead.
+func MarkEmailVerified(ctx context.Context, userId string) error {
+	repo, err := current()
+	if err != nil {
+		return err
+	}
+	return repo.MarkEmailVerified(ctx, userId)
+}
+
+// Deprecated: call UpdateUserPassword on server.Server.Repository() instead.
+func UpdateUserPassword(ctx context.Context, userId string, password string) error {
+	repo, err := current()
+	if err != nil {
+		return err
+	}
+	return repo.UpdateUserPassword(ctx, userId, password)
+}
+
+// Deprecated: call InsertUserToken on server.Server.Repository() instead.
+func InsertUserToken(ctx context.Context, token *models.UserToken, ttl time.Duration) error {
+	repo, err := current()
+	if err != nil {
+		return err
+	}
+	return repo.InsertUserToken(ctx, token, ttl)
 }
 
-func ListPosts(ctx context.Context, limit uint64, after string) ([]*models.Post, error) {
-	return implementation.ListPosts(ctx, limit, after)
+// Deprecated: call ConsumeUserToken on server.Server.Repository() instead.
+func ConsumeUserToken(ctx context.Context, tokenHash string, purpose string) (*models.UserToken, error) {
+	repo, err := current()
+	if err != nil {
+		return nil, err
+	}
+	return repo.ConsumeUserToken(ctx, tokenHash, purpose)
 }
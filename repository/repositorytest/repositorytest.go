@@ -0,0 +1,847 @@
+// Package repositorytest is the contract every repository.Repository must
+// honour, written as a test suite that each backend runs against itself.
+package repositorytest
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/repository"
+	"github.com/segmentio/ksuid"
+)
+
+// Factory returns an empty repository for a single test. Backends that need
+// to clean up register it with t.Cleanup.
+type Factory func(t *testing.T) repository.Repository
+
+// Run runs the whole contract against the repositories made by newRepo.
+// Every subtest gets a repository of its own.
+func Run(t *testing.T, newRepo Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, repo repository.Repository)
+	}{
+		{"Ping", testPing},
+		{"Users", testUsers},
+		{"UserConflicts", testUserConflicts},
+		{"UserTokens", testUserTokens},
+		{"LoginFailures", testLoginFailures},
+		{"TOTP", testTOTP},
+		{"AccessTokens", testAccessTokens},
+		{"Posts", testPosts},
+		{"ConditionalWrites", testConditionalWrites},
+		{"Ownership", testOwnership},
+		{"Pagination", testPagination},
+		{"Trash", testTrash},
+		{"Status", testStatus},
+		{"Visibility", testVisibility},
+		{"Attachments", testAttachments},
+		{"NotFound", testNotFound},
+		{"ConcurrentInserts", testConcurrentInserts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newRepo(t))
+		})
+	}
+}
+
+func testPing(t *testing.T, repo repository.Repository) {
+	must(t, "Ping", repo.Ping(context.Background()))
+}
+
+func testUsers(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := newUser(t, repo)
+
+	got, err := repo.GetUserById(ctx, user.ID)
+	must(t, "GetUserById", err)
+	if got.ID != user.ID || got.Email != user.Email {
+		t.Errorf("GetUserById = %+v, want %+v", got, user)
+	}
+	if got.Password != "" {
+		t.Error("GetUserById returned the password hash")
+	}
+
+	got, err = repo.GetUserByEmail(ctx, strings.ToUpper(user.Email))
+	must(t, "GetUserByEmail", err)
+	if got.ID != user.ID {
+		t.Errorf("GetUserByEmail ignoring case = %q, want %q", got.ID, user.ID)
+	}
+	if got.Password != user.Password {
+		t.Error("GetUserByEmail must return the password hash")
+	}
+
+	update := &models.User{ID: user.ID, Handle: "handle_" + user.ID[:8], DisplayName: "Name", Bio: "Bio"}
+	must(t, "UpdateUserProfile", repo.UpdateUserProfile(ctx, update))
+	if update.Email != user.Email {
+		t.Errorf("UpdateUserProfile left email %q, want %q", update.Email, user.Email)
+	}
+	got, err = repo.GetUserByHandle(ctx, update.Handle)
+	must(t, "GetUserByHandle", err)
+	if got.ID != user.ID || got.DisplayName != "Name" || got.Bio != "Bio" {
+		t.Errorf("GetUserByHandle = %+v, want the updated profile", got)
+	}
+
+	must(t, "MarkEmailVerified", repo.MarkEmailVerified(ctx, user.ID))
+	got, err = repo.GetUserById(ctx, user.ID)
+	must(t, "GetUserById", err)
+	if got.EmailVerifiedAt == nil {
+		t.Fatal("MarkEmailVerified did not set EmailVerifiedAt")
+	}
+	verifiedAt := *got.EmailVerifiedAt
+	must(t, "MarkEmailVerified again", repo.MarkEmailVerified(ctx, user.ID))
+	got, err = repo.GetUserById(ctx, user.ID)
+	must(t, "GetUserById", err)
+	if !got.EmailVerifiedAt.Equal(verifiedAt) {
+		t.Error("MarkEmailVerified changed the verification date of a verified user")
+	}
+
+	must(t, "UpdateUserPassword", repo.UpdateUserPassword(ctx, user.ID, "new password"))
+	got, err = repo.GetUserByEmail(ctx, user.Email)
+	must(t, "GetUserByEmail", err)
+	if got.Password != "new password" {
+		t.Errorf("password = %q after UpdateUserPassword", got.Password)
+	}
+}
+
+func testUserConflicts(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := newUser(t, repo)
+
+	err := repo.InsertUser(ctx, &models.User{ID: newId(), Email: strings.ToUpper(user.Email), Password: "password"})
+	expectConflict(t, "InsertUser with a taken email", err, "email")
+
+	handle := "handle_" + user.ID[:8]
+	must(t, "UpdateUserProfile", repo.UpdateUserProfile(ctx, &models.User{ID: user.ID, Handle: handle}))
+	other := newUser(t, repo)
+	err = repo.UpdateUserProfile(ctx, &models.User{ID: other.ID, Handle: handle})
+	expectConflict(t, "UpdateUserProfile with a taken handle", err, "handle")
+	// Keeping one's own handle is not a conflict.
+	must(t, "UpdateUserProfile", repo.UpdateUserProfile(ctx, &models.User{ID: user.ID, Handle: handle, Bio: "Bio"}))
+}
+
+func testUserTokens(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := newUser(t, repo)
+
+	token := &models.UserToken{TokenHash: newId(), UserId: user.ID, Purpose: models.TokenPurposeVerifyEmail}
+	must(t, "InsertUserToken", repo.InsertUserToken(ctx, token, time.Hour))
+	if token.ExpiresAt.IsZero() {
+		t.Error("InsertUserToken did not set ExpiresAt")
+	}
+	_, err := repo.ConsumeUserToken(ctx, token.TokenHash, models.TokenPurposePasswordReset)
+	expectNotFound(t, "ConsumeUserToken with another purpose", err)
+	got, err := repo.ConsumeUserToken(ctx, token.TokenHash, models.TokenPurposeVerifyEmail)
+	must(t, "ConsumeUserToken", err)
+	if got.UserId != user.ID {
+		t.Errorf("ConsumeUserToken user = %q, want %q", got.UserId, user.ID)
+	}
+	_, err = repo.ConsumeUserToken(ctx, token.TokenHash, models.TokenPurposeVerifyEmail)
+	expectNotFound(t, "ConsumeUserToken twice", err)
+
+	expired := &models.UserToken{TokenHash: newId(), UserId: user.ID, Purpose: models.TokenPurposePasswordReset}
+	must(t, "InsertUserToken", repo.InsertUserToken(ctx, expired, -time.Minute))
+	_, err = repo.ConsumeUserToken(ctx, expired.TokenHash, models.TokenPurposePasswordReset)
+	expectNotFound(t, "ConsumeUserToken of an expired token", err)
+
+	err = repo.InsertUserToken(ctx, &models.UserToken{TokenHash: newId(), UserId: newId(), Purpose: models.TokenPurposeVerifyEmail}, time.Hour)
+	expectNotFound(t, "InsertUserToken for a missing user", err)
+}
+
+func testLoginFailures(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	key := "email:" + newId() + "@example.com"
+
+	_, err := repo.GetLoginFailures(ctx, key)
+	expectNotFound(t, "GetLoginFailures before a failure", err)
+	expectNotFound(t, "LockLogin before a failure", repo.LockLogin(ctx, key, time.Hour))
+	for i := 1; i <= 3; i++ {
+		failures, err := repo.RecordLoginFailure(ctx, key, time.Hour)
+		must(t, "RecordLoginFailure", err)
+		if failures.Failures != i || failures.LastFailedAt.IsZero() {
+			t.Errorf("RecordLoginFailure %d = %+v", i, failures)
+		}
+	}
+	must(t, "LockLogin", repo.LockLogin(ctx, key, time.Hour))
+	failures, err := repo.GetLoginFailures(ctx, key)
+	must(t, "GetLoginFailures", err)
+	if failures.Failures != 3 || failures.LockedUntil == nil || !failures.LockedUntil.After(failures.LastFailedAt) {
+		t.Errorf("GetLoginFailures = %+v, want 3 failures and a lock", failures)
+	}
+
+	// A window that ended before the first failure starts the count over,
+	// and keeps the lock.
+	failures, err = repo.RecordLoginFailure(ctx, key, -time.Minute)
+	must(t, "RecordLoginFailure", err)
+	if failures.Failures != 1 || failures.LockedUntil == nil {
+		t.Errorf("RecordLoginFailure after the window = %+v, want 1 failure and the lock", failures)
+	}
+
+	n, err := repo.PurgeLoginFailures(ctx, time.Minute)
+	must(t, "PurgeLoginFailures", err)
+	if n != 0 {
+		t.Errorf("PurgeLoginFailures of recent failures = %d, want 0", n)
+	}
+	other := "ip:" + newId()
+	_, err = repo.RecordLoginFailure(ctx, other, time.Hour)
+	must(t, "RecordLoginFailure", err)
+	if n, err = repo.PurgeLoginFailures(ctx, -time.Minute); err != nil || n != 1 {
+		t.Errorf("PurgeLoginFailures = %d, %v, want the unlocked record only", n, err)
+	}
+
+	must(t, "ClearLoginFailures", repo.ClearLoginFailures(ctx, key))
+	must(t, "ClearLoginFailures twice", repo.ClearLoginFailures(ctx, key))
+	_, err = repo.GetLoginFailures(ctx, key)
+	expectNotFound(t, "GetLoginFailures after ClearLoginFailures", err)
+}
+
+func testTOTP(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := newUser(t, repo)
+
+	_, err := repo.GetUserTOTP(ctx, user.ID)
+	expectNotFound(t, "GetUserTOTP before SetUserTOTP", err)
+	expectNotFound(t, "EnableUserTOTP before SetUserTOTP", repo.EnableUserTOTP(ctx, user.ID, nil))
+	expectNotFound(t, "SetUserTOTP for a missing user", repo.SetUserTOTP(ctx, &models.TOTP{UserId: newId(), Secret: "SECRET"}))
+
+	must(t, "SetUserTOTP", repo.SetUserTOTP(ctx, &models.TOTP{UserId: user.ID, Secret: "SECRET"}))
+	got, err := repo.GetUserTOTP(ctx, user.ID)
+	must(t, "GetUserTOTP", err)
+	if got.Secret != "SECRET" || got.EnabledAt != nil {
+		t.Errorf("GetUserTOTP = %+v, want the secret, not enabled", got)
+	}
+	codes := []string{newId(), newId()}
+	must(t, "EnableUserTOTP", repo.EnableUserTOTP(ctx, user.ID, codes))
+	if got, err = repo.GetUserTOTP(ctx, user.ID); err != nil || got.EnabledAt == nil {
+		t.Errorf("GetUserTOTP after EnableUserTOTP = %+v, %v, want it enabled", got, err)
+	}
+
+	must(t, "UseTOTPStep", repo.UseTOTPStep(ctx, user.ID, 100))
+	expectNotFound(t, "UseTOTPStep of the same step", repo.UseTOTPStep(ctx, user.ID, 100))
+	expectNotFound(t, "UseTOTPStep of an earlier step", repo.UseTOTPStep(ctx, user.ID, 99))
+	must(t, "UseTOTPStep of a later step", repo.UseTOTPStep(ctx, user.ID, 101))
+
+	other := newUser(t, repo)
+	expectNotFound(t, "ConsumeRecoveryCode of another user", repo.ConsumeRecoveryCode(ctx, other.ID, codes[0]))
+	must(t, "ConsumeRecoveryCode", repo.ConsumeRecoveryCode(ctx, user.ID, codes[0]))
+	expectNotFound(t, "ConsumeRecoveryCode twice", repo.ConsumeRecoveryCode(ctx, user.ID, codes[0]))
+	if n, err := repo.CountRecoveryCodes(ctx, user.ID); err != nil || n != 1 {
+		t.Errorf("CountRecoveryCodes = %d, %v, want 1", n, err)
+	}
+
+	// Starting over drops the recovery codes and disables the old secret.
+	must(t, "SetUserTOTP again", repo.SetUserTOTP(ctx, &models.TOTP{UserId: user.ID, Secret: "OTHER"}))
+	if got, err = repo.GetUserTOTP(ctx, user.ID); err != nil || got.EnabledAt != nil || got.LastStep != 0 {
+		t.Errorf("GetUserTOTP after SetUserTOTP again = %+v, %v, want a fresh secret", got, err)
+	}
+	expectNotFound(t, "ConsumeRecoveryCode after SetUserTOTP again", repo.ConsumeRecoveryCode(ctx, user.ID, codes[1]))
+
+	must(t, "DeleteUserTOTP", repo.DeleteUserTOTP(ctx, user.ID))
+	expectNotFound(t, "DeleteUserTOTP twice", repo.DeleteUserTOTP(ctx, user.ID))
+	_, err = repo.CountRecoveryCodes(ctx, user.ID)
+	expectNotFound(t, "CountRecoveryCodes after DeleteUserTOTP", err)
+}
+
+func testAccessTokens(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := newUser(t, repo)
+	newToken := func(ttl time.Duration) *models.AccessToken {
+		t.Helper()
+		token := &models.AccessToken{Id: newId(), UserId: user.ID, Name: "ci", TokenHash: newId(), Scopes: []string{models.ScopePostsRead, models.ScopePostsWrite}}
+		must(t, "InsertAccessToken", repo.InsertAccessToken(ctx, token, ttl))
+		return token
+	}
+	token := newToken(time.Hour)
+	if token.CreatedAt.IsZero() || !token.ExpiresAt.After(token.CreatedAt) {
+		t.Errorf("InsertAccessToken = %+v, want created_at and expires_at set", token)
+	}
+	expired := newToken(-time.Hour)
+
+	got, err := repo.GetAccessTokenByHash(ctx, token.TokenHash)
+	must(t, "GetAccessTokenByHash", err)
+	if got.Id != token.Id || got.UserId != user.ID || !got.HasScope(models.ScopePostsWrite) || got.LastUsedAt != nil {
+		t.Errorf("GetAccessTokenByHash = %+v, want %+v", got, token)
+	}
+	_, err = repo.GetAccessTokenByHash(ctx, expired.TokenHash)
+	expectNotFound(t, "GetAccessTokenByHash of an expired token", err)
+	expectConflict(t, "InsertAccessToken with a taken hash", repo.InsertAccessToken(ctx, &models.AccessToken{Id: newId(), UserId: user.ID, Name: "ci", TokenHash: token.TokenHash, Scopes: []string{}}, time.Hour), "token")
+	expectNotFound(t, "InsertAccessToken for a missing user", repo.InsertAccessToken(ctx, &models.AccessToken{Id: newId(), UserId: newId(), Name: "ci", TokenHash: newId(), Scopes: []string{}}, time.Hour))
+
+	must(t, "MarkAccessTokenUsed", repo.MarkAccessTokenUsed(ctx, token.Id))
+	if got, err = repo.GetAccessTokenByHash(ctx, token.TokenHash); err != nil || got.LastUsedAt == nil {
+		t.Errorf("GetAccessTokenByHash after MarkAccessTokenUsed = %+v, %v, want last_used_at set", got, err)
+	}
+	expectNotFound(t, "MarkAccessTokenUsed of a missing token", repo.MarkAccessTokenUsed(ctx, newId()))
+
+	tokens, err := repo.ListAccessTokens(ctx, user.ID)
+	must(t, "ListAccessTokens", err)
+	if len(tokens) != 2 || tokens[0].Id != token.Id || tokens[1].Id != expired.Id {
+		t.Errorf("ListAccessTokens = %+v, want both tokens oldest first", tokens)
+	}
+	if tokens, err = repo.ListAccessTokens(ctx, newId()); err != nil || len(tokens) != 0 {
+		t.Errorf("ListAccessTokens of another user = %+v, %v, want none", tokens, err)
+	}
+
+	other := newUser(t, repo)
+	expectNotFound(t, "DeleteAccessToken of another user", repo.DeleteAccessToken(ctx, other.ID, token.Id))
+	must(t, "DeleteAccessToken", repo.DeleteAccessToken(ctx, user.ID, token.Id))
+	expectNotFound(t, "DeleteAccessToken twice", repo.DeleteAccessToken(ctx, user.ID, token.Id))
+	_, err = repo.GetAccessTokenByHash(ctx, token.TokenHash)
+	expectNotFound(t, "GetAccessTokenByHash after DeleteAccessToken", err)
+}
+
+func testPosts(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := newUser(t, repo)
+	post := newPost(t, repo, user.ID)
+	if post.Revision != 1 {
+		t.Errorf("InsertPost revision = %d, want 1", post.Revision)
+	}
+
+	got, err := repo.GetPostById(ctx, post.Id)
+	must(t, "GetPostById", err)
+	if got.PostContent != post.PostContent || got.UserId != user.ID || got.Status != models.PostStatusPublished {
+		t.Errorf("GetPostById = %+v, want %+v", got, post)
+	}
+
+	update := &models.Post{Id: post.Id, UserId: user.ID, PostContent: "edited", Visibility: models.PostVisibilityPrivate}
+	must(t, "UpdatePost", repo.UpdatePost(ctx, update))
+	if update.Revision != 2 || update.PostContent != "edited" || update.Visibility != models.PostVisibilityPrivate {
+		t.Errorf("UpdatePost = %+v, want revision 2 with the new content and visibility", update)
+	}
+	// An empty visibility keeps the stored one.
+	update = &models.Post{Id: post.Id, UserId: user.ID, PostContent: "edited again"}
+	must(t, "UpdatePost", repo.UpdatePost(ctx, update))
+	if update.Visibility != models.PostVisibilityPrivate {
+		t.Errorf("UpdatePost without visibility set it to %q", update.Visibility)
+	}
+
+	revisions, err := repo.ListPostRevisions(ctx, post.Id)
+	must(t, "ListPostRevisions", err)
+	var numbers []int
+	for _, rev := range revisions {
+		numbers = append(numbers, rev.Revision)
+	}
+	if !equal(numbers, []int{3, 2, 1}) {
+		t.Errorf("ListPostRevisions revisions = %v, want [3 2 1]", numbers)
+	}
+	rev, err := repo.GetPostRevision(ctx, post.Id, 1)
+	must(t, "GetPostRevision", err)
+	if rev.PostContent != post.PostContent || rev.EditorId != user.ID {
+		t.Errorf("GetPostRevision = %+v, want the original content by %s", rev, user.ID)
+	}
+}
+
+func testConditionalWrites(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := newUser(t, repo)
+	post := newPost(t, repo, user.ID)
+
+	must(t, "UpdatePost at the current revision", repo.UpdatePost(ctx, &models.Post{Id: post.Id, UserId: user.ID, PostContent: "edited", Revision: 1}))
+	err := repo.UpdatePost(ctx, &models.Post{Id: post.Id, UserId: user.ID, PostContent: "stale", Revision: 1})
+	if !errors.Is(err, repository.ErrVersionMismatch) {
+		t.Errorf("UpdatePost at a stale revision: got %v, want ErrVersionMismatch", err)
+	}
+	err = repo.DeletePost(ctx, &models.Post{Id: post.Id, UserId: user.ID, Revision: 1})
+	if !errors.Is(err, repository.ErrVersionMismatch) {
+		t.Errorf("DeletePost at a stale revision: got %v, want ErrVersionMismatch", err)
+	}
+	must(t, "DeletePost at the current revision", repo.DeletePost(ctx, &models.Post{Id: post.Id, UserId: user.ID, Revision: 2}))
+	err = repo.UpdatePost(ctx, &models.Post{Id: post.Id, UserId: user.ID, PostContent: "gone", Revision: 2})
+	expectNotFound(t, "UpdatePost of a deleted post at its revision", err)
+}
+
+func testOwnership(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	author := newUser(t, repo)
+	other := newUser(t, repo)
+	post := newPost(t, repo, author.ID)
+
+	err := repo.UpdatePost(ctx, &models.Post{Id: post.Id, UserId: other.ID, PostContent: "hijacked"})
+	expectNotFound(t, "UpdatePost by another user", err)
+	err = repo.UpdatePost(ctx, &models.Post{Id: post.Id, UserId: other.ID, PostContent: "hijacked", Revision: post.Revision})
+	expectNotFound(t, "conditional UpdatePost by another user", err)
+	err = repo.DeletePost(ctx, &models.Post{Id: post.Id, UserId: other.ID})
+	expectNotFound(t, "DeletePost by another user", err)
+	err = repo.SetPostStatus(ctx, &models.Post{Id: post.Id, UserId: other.ID, Status: models.PostStatusDraft})
+	expectNotFound(t, "SetPostStatus by another user", err)
+
+	got, err := repo.GetPostById(ctx, post.Id)
+	must(t, "GetPostById", err)
+	if got.PostContent != post.PostContent || got.Revision != post.Revision {
+		t.Errorf("post changed by another user: %+v", got)
+	}
+
+	must(t, "DeletePost", repo.DeletePost(ctx, &models.Post{Id: post.Id, UserId: author.ID}))
+	err = repo.RestorePost(ctx, &models.Post{Id: post.Id, UserId: other.ID})
+	expectNotFound(t, "RestorePost by another user", err)
+}
+
+func testPagination(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := newUser(t, repo)
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ids = append(ids, newPost(t, repo, user.ID).Id)
+	}
+	sort.Strings(ids)
+
+	tests := []struct {
+		name  string
+		limit uint64
+		after string
+		want  []string
+	}{
+		{"first page", 2, "", ids[:2]},
+		{"next page", 2, ids[1], ids[2:4]},
+		{"last partial page", 2, ids[3], ids[4:]},
+		{"after the last post", 2, ids[4], nil},
+		{"limit larger than the result", 100, "", ids},
+		{"zero limit", 0, "", nil},
+	}
+	for _, tt := range tests {
+		posts, err := repo.ListPosts(ctx, "", tt.limit, tt.after)
+		must(t, "ListPosts", err)
+		if got := postIds(posts); !equal(got, tt.want) {
+			t.Errorf("ListPosts %s = %v, want %v", tt.name, got, tt.want)
+		}
+		posts, err = repo.ListPostsByUser(ctx, "", user.ID, tt.limit, tt.after)
+		must(t, "ListPostsByUser", err)
+		if got := postIds(posts); !equal(got, tt.want) {
+			t.Errorf("ListPostsByUser %s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	posts, err := repo.ListPostsByUser(ctx, "", newUser(t, repo).ID, 100, "")
+	must(t, "ListPostsByUser", err)
+	if len(posts) != 0 {
+		t.Errorf("ListPostsByUser of a user without posts = %v", postIds(posts))
+	}
+}
+
+func testTrash(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := newUser(t, repo)
+	kept := newPost(t, repo, user.ID)
+	trashed := newPost(t, repo, user.ID)
+
+	must(t, "DeletePost", repo.DeletePost(ctx, &models.Post{Id: trashed.Id, UserId: user.ID}))
+	posts, err := repo.ListPosts(ctx, user.ID, 100, "")
+	must(t, "ListPosts", err)
+	if got := postIds(posts); !equal(got, []string{kept.Id}) {
+		t.Errorf("ListPosts with a trashed post = %v, want %v", got, []string{kept.Id})
+	}
+	deleted, err := repo.ListDeletedPosts(ctx, user.ID, 100, "")
+	must(t, "ListDeletedPosts", err)
+	if got := postIds(deleted); !equal(got, []string{trashed.Id}) || deleted[0].DeletedAt == nil {
+		t.Errorf("ListDeletedPosts = %v, want %v with DeletedAt set", got, []string{trashed.Id})
+	}
+
+	restored := &models.Post{Id: trashed.Id, UserId: user.ID}
+	must(t, "RestorePost", repo.RestorePost(ctx, restored))
+	if restored.DeletedAt != nil || restored.PostContent != trashed.PostContent {
+		t.Errorf("RestorePost = %+v, want the live post", restored)
+	}
+	_, err = repo.GetPostById(ctx, trashed.Id)
+	must(t, "GetPostById of a restored post", err)
+	err = repo.RestorePost(ctx, &models.Post{Id: trashed.Id, UserId: user.ID})
+	expectNotFound(t, "RestorePost of a live post", err)
+
+	must(t, "DeletePost", repo.DeletePost(ctx, &models.Post{Id: trashed.Id, UserId: user.ID}))
+	n, err := repo.PurgeDeletedPosts(ctx, time.Hour)
+	must(t, "PurgeDeletedPosts", err)
+	if n != 0 {
+		t.Errorf("PurgeDeletedPosts purged %d recent posts", n)
+	}
+	n, err = repo.PurgeDeletedPosts(ctx, 0)
+	must(t, "PurgeDeletedPosts", err)
+	if n != 1 {
+		t.Errorf("PurgeDeletedPosts purged %d posts, want 1", n)
+	}
+	err = repo.RestorePost(ctx, &models.Post{Id: trashed.Id, UserId: user.ID})
+	expectNotFound(t, "RestorePost of a purged post", err)
+	_, err = repo.GetPostById(ctx, kept.Id)
+	must(t, "GetPostById of a live post after a purge", err)
+}
+
+func testStatus(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := newUser(t, repo)
+	past := time.Now().Add(-48 * time.Hour)
+	future := time.Now().Add(48 * time.Hour)
+	draft := newPost(t, repo, user.ID, func(p *models.Post) { p.Status = models.PostStatusDraft })
+	due := newPost(t, repo, user.ID, func(p *models.Post) { p.Status = models.PostStatusScheduled; p.PublishAt = &past })
+	later := newPost(t, repo, user.ID, func(p *models.Post) { p.Status = models.PostStatusScheduled; p.PublishAt = &future })
+	published := newPost(t, repo, user.ID)
+
+	posts, err := repo.ListPosts(ctx, user.ID, 100, "")
+	must(t, "ListPosts", err)
+	if got := postIds(posts); !equal(got, []string{published.Id}) {
+		t.Errorf("ListPosts = %v, want only the published post %s", got, published.Id)
+	}
+	unpublished, err := repo.ListUnpublishedPosts(ctx, user.ID, 100, "")
+	must(t, "ListUnpublishedPosts", err)
+	want := []string{draft.Id, due.Id, later.Id}
+	sort.Strings(want)
+	if got := postIds(unpublished); !equal(got, want) {
+		t.Errorf("ListUnpublishedPosts = %v, want %v", got, want)
+	}
+
+	publishedNow, err := repo.PublishDuePosts(ctx, 100)
+	must(t, "PublishDuePosts", err)
+	if got := postIds(publishedNow); !equal(got, []string{due.Id}) || publishedNow[0].Status != models.PostStatusPublished {
+		t.Errorf("PublishDuePosts = %v, want %s published", got, due.Id)
+	}
+	publishedNow, err = repo.PublishDuePosts(ctx, 100)
+	must(t, "PublishDuePosts", err)
+	if len(publishedNow) != 0 {
+		t.Errorf("PublishDuePosts published %v twice", postIds(publishedNow))
+	}
+
+	status := &models.Post{Id: draft.Id, UserId: user.ID, Status: models.PostStatusPublished}
+	must(t, "SetPostStatus", repo.SetPostStatus(ctx, status))
+	if status.Status != models.PostStatusPublished || status.PostContent != draft.PostContent {
+		t.Errorf("SetPostStatus = %+v, want the published draft", status)
+	}
+	err = repo.SetPostStatus(ctx, &models.Post{Id: published.Id, UserId: user.ID, Status: models.PostStatusDraft})
+	expectNotFound(t, "SetPostStatus of a published post", err)
+}
+
+func testVisibility(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	author := newUser(t, repo)
+	follower := newUser(t, repo)
+	stranger := newUser(t, repo)
+	public := newPost(t, repo, author.ID)
+	followers := newPost(t, repo, author.ID, func(p *models.Post) { p.Visibility = models.PostVisibilityFollowers })
+	private := newPost(t, repo, author.ID, func(p *models.Post) { p.Visibility = models.PostVisibilityPrivate })
+
+	must(t, "FollowUser", repo.FollowUser(ctx, follower.ID, author.ID))
+	must(t, "FollowUser twice", repo.FollowUser(ctx, follower.ID, author.ID))
+	following, err := repo.IsFollowing(ctx, follower.ID, author.ID)
+	must(t, "IsFollowing", err)
+	if !following {
+		t.Error("IsFollowing = false after FollowUser")
+	}
+	ids, err := repo.ListFollowerIds(ctx, author.ID)
+	must(t, "ListFollowerIds", err)
+	if !equal(ids, []string{follower.ID}) {
+		t.Errorf("ListFollowerIds = %v, want %v", ids, []string{follower.ID})
+	}
+	expectNotFound(t, "FollowUser of a missing user", repo.FollowUser(ctx, follower.ID, newId()))
+
+	sorted := func(ids ...string) []string {
+		sort.Strings(ids)
+		return ids
+	}
+	tests := []struct {
+		name   string
+		viewer string
+		want   []string
+	}{
+		{"anonymous", "", sorted(public.Id)},
+		{"stranger", stranger.ID, sorted(public.Id)},
+		{"follower", follower.ID, sorted(public.Id, followers.Id)},
+		{"author", author.ID, sorted(public.Id, followers.Id, private.Id)},
+	}
+	for _, tt := range tests {
+		posts, err := repo.ListPosts(ctx, tt.viewer, 100, "")
+		must(t, "ListPosts", err)
+		if got := postIds(posts); !equal(got, tt.want) {
+			t.Errorf("ListPosts as %s = %v, want %v", tt.name, got, tt.want)
+		}
+		posts, err = repo.ListPostsByUser(ctx, tt.viewer, author.ID, 100, "")
+		must(t, "ListPostsByUser", err)
+		if got := postIds(posts); !equal(got, tt.want) {
+			t.Errorf("ListPostsByUser as %s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	must(t, "UnfollowUser", repo.UnfollowUser(ctx, follower.ID, author.ID))
+	following, err = repo.IsFollowing(ctx, follower.ID, author.ID)
+	must(t, "IsFollowing", err)
+	if following {
+		t.Error("IsFollowing = true after UnfollowUser")
+	}
+	posts, err := repo.ListPosts(ctx, follower.ID, 100, "")
+	must(t, "ListPosts", err)
+	if got := postIds(posts); !equal(got, []string{public.Id}) {
+		t.Errorf("ListPosts as a former follower = %v, want %v", got, []string{public.Id})
+	}
+}
+
+func testAttachments(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := newUser(t, repo)
+	post := newPost(t, repo, user.ID)
+	first := newAttachment(t, repo, user.ID, post.Id)
+	second := newAttachment(t, repo, user.ID, post.Id)
+
+	got, err := repo.GetAttachmentById(ctx, first.Id)
+	must(t, "GetAttachmentById", err)
+	if got.PostId != post.Id || got.StorageKey != first.StorageKey || got.Size != first.Size {
+		t.Errorf("GetAttachmentById = %+v, want %+v", got, first)
+	}
+	attachments, err := repo.ListAttachments(ctx, post.Id)
+	must(t, "ListAttachments", err)
+	want := []string{first.Id, second.Id}
+	sort.Strings(want)
+	if got := attachmentIds(attachments); !equal(got, want) {
+		t.Errorf("ListAttachments = %v, want %v", got, want)
+	}
+
+	avatar := &models.Attachment{Id: newId(), UserId: user.ID, FileName: "avatar.png", ContentType: "image/png", Size: 1, StorageKey: newId()}
+	must(t, "SetUserAvatar", repo.SetUserAvatar(ctx, user.ID, avatar))
+	replaced := &models.Attachment{Id: newId(), UserId: user.ID, FileName: "avatar.png", ContentType: "image/png", Size: 1, StorageKey: newId()}
+	must(t, "SetUserAvatar", repo.SetUserAvatar(ctx, user.ID, replaced))
+	me, err := repo.GetUserById(ctx, user.ID)
+	must(t, "GetUserById", err)
+	if me.AvatarId != replaced.Id {
+		t.Errorf("AvatarId = %q, want %q", me.AvatarId, replaced.Id)
+	}
+
+	// Attachments survive their post in the trash and become orphans once it
+	// is purged. The current avatar never does.
+	must(t, "DeletePost", repo.DeletePost(ctx, &models.Post{Id: post.Id, UserId: user.ID}))
+	orphans, err := repo.ListOrphanedAttachments(ctx, 100)
+	must(t, "ListOrphanedAttachments", err)
+	if got := attachmentIds(orphans); !equal(got, []string{avatar.Id}) {
+		t.Errorf("ListOrphanedAttachments with the post in the trash = %v, want the old avatar %s", got, avatar.Id)
+	}
+	_, err = repo.PurgeDeletedPosts(ctx, 0)
+	must(t, "PurgeDeletedPosts", err)
+	orphans, err = repo.ListOrphanedAttachments(ctx, 100)
+	must(t, "ListOrphanedAttachments", err)
+	want = []string{avatar.Id, first.Id, second.Id}
+	sort.Strings(want)
+	if got := attachmentIds(orphans); !equal(got, want) {
+		t.Errorf("ListOrphanedAttachments after the purge = %v, want %v", got, want)
+	}
+	orphans, err = repo.ListOrphanedAttachments(ctx, 1)
+	must(t, "ListOrphanedAttachments", err)
+	if len(orphans) != 1 {
+		t.Errorf("ListOrphanedAttachments with limit 1 returned %d attachments", len(orphans))
+	}
+
+	for _, orphan := range []*models.Attachment{avatar, first, second} {
+		must(t, "DeleteAttachment", repo.DeleteAttachment(ctx, orphan))
+	}
+	orphans, err = repo.ListOrphanedAttachments(ctx, 100)
+	must(t, "ListOrphanedAttachments", err)
+	if len(orphans) != 0 {
+		t.Errorf("ListOrphanedAttachments after deleting them = %v", attachmentIds(orphans))
+	}
+	expectNotFound(t, "DeleteAttachment twice", repo.DeleteAttachment(ctx, first))
+}
+
+func testNotFound(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	user := newUser(t, repo)
+	missing := newId()
+
+	_, err := repo.GetUserById(ctx, missing)
+	expectNotFound(t, "GetUserById", err)
+	_, err = repo.GetUserByEmail(ctx, missing+"@example.com")
+	expectNotFound(t, "GetUserByEmail", err)
+	_, err = repo.GetUserByHandle(ctx, "missing_handle")
+	expectNotFound(t, "GetUserByHandle", err)
+	expectNotFound(t, "UpdateUserProfile", repo.UpdateUserProfile(ctx, &models.User{ID: missing}))
+	expectNotFound(t, "MarkEmailVerified", repo.MarkEmailVerified(ctx, missing))
+	expectNotFound(t, "UpdateUserPassword", repo.UpdateUserPassword(ctx, missing, "password"))
+	_, err = repo.ConsumeUserToken(ctx, missing, models.TokenPurposeVerifyEmail)
+	expectNotFound(t, "ConsumeUserToken", err)
+
+	_, err = repo.GetPostById(ctx, missing)
+	expectNotFound(t, "GetPostById", err)
+	expectNotFound(t, "InsertPost for a missing user", repo.InsertPost(ctx, &models.Post{
+		Id:          newId(),
+		PostContent: "content",
+		UserId:      missing,
+		Status:      models.PostStatusPublished,
+		Visibility:  models.PostVisibilityPublic,
+	}))
+	expectNotFound(t, "UpdatePost", repo.UpdatePost(ctx, &models.Post{Id: missing, UserId: user.ID, PostContent: "content"}))
+	expectNotFound(t, "DeletePost", repo.DeletePost(ctx, &models.Post{Id: missing, UserId: user.ID}))
+	expectNotFound(t, "RestorePost", repo.RestorePost(ctx, &models.Post{Id: missing, UserId: user.ID}))
+	expectNotFound(t, "SetPostStatus", repo.SetPostStatus(ctx, &models.Post{Id: missing, UserId: user.ID, Status: models.PostStatusPublished}))
+	_, err = repo.GetPostRevision(ctx, missing, 1)
+	expectNotFound(t, "GetPostRevision", err)
+
+	_, err = repo.GetAttachmentById(ctx, missing)
+	expectNotFound(t, "GetAttachmentById", err)
+	expectNotFound(t, "DeleteAttachment", repo.DeleteAttachment(ctx, &models.Attachment{Id: missing}))
+	expectNotFound(t, "SetUserAvatar", repo.SetUserAvatar(ctx, missing, &models.Attachment{
+		Id:          newId(),
+		UserId:      user.ID,
+		FileName:    "avatar.png",
+		ContentType: "image/png",
+		StorageKey:  newId(),
+	}))
+
+	// Posts in the trash count as missing too.
+	post := newPost(t, repo, user.ID)
+	must(t, "DeletePost", repo.DeletePost(ctx, &models.Post{Id: post.Id, UserId: user.ID}))
+	_, err = repo.GetPostById(ctx, post.Id)
+	expectNotFound(t, "GetPostById of a deleted post", err)
+	expectNotFound(t, "DeletePost of a deleted post", repo.DeletePost(ctx, &models.Post{Id: post.Id, UserId: user.ID}))
+	expectNotFound(t, "UpdatePost of a deleted post", repo.UpdatePost(ctx, &models.Post{Id: post.Id, UserId: user.ID, PostContent: "content"}))
+}
+
+func testConcurrentInserts(t *testing.T, repo repository.Repository) {
+	ctx := context.Background()
+	const n = 10
+	email := "user-" + newId() + "@example.com"
+
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = repo.InsertUser(ctx, &models.User{ID: newId(), Email: email, Password: "password"})
+		}(i)
+	}
+	wg.Wait()
+	var inserted int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			inserted++
+		case !errors.Is(err, repository.ErrConflict):
+			t.Errorf("concurrent InsertUser: got %v, want nil or ErrConflict", err)
+		}
+	}
+	if inserted != 1 {
+		t.Errorf("%d concurrent InsertUser calls with the same email succeeded, want 1", inserted)
+	}
+
+	user := newUser(t, repo)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = repo.InsertPost(ctx, &models.Post{
+				Id:          newId(),
+				PostContent: "content",
+				UserId:      user.ID,
+				Status:      models.PostStatusPublished,
+				Visibility:  models.PostVisibilityPublic,
+			})
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		must(t, "concurrent InsertPost", err)
+	}
+	posts, err := repo.ListPostsByUser(ctx, user.ID, user.ID, 100, "")
+	must(t, "ListPostsByUser", err)
+	if len(posts) != n {
+		t.Errorf("ListPostsByUser after %d concurrent inserts returned %d posts", n, len(posts))
+	}
+}
+
+// newId returns a lowercase ksuid, so that ids sort the same way whatever
+// the collation of the backend.
+func newId() string {
+	return strings.ToLower(ksuid.New().String())
+}
+
+func newUser(t *testing.T, repo repository.Repository) *models.User {
+	t.Helper()
+	id := newId()
+	user := &models.User{ID: id, Email: "user-" + id + "@example.com", Password: "password"}
+	must(t, "InsertUser", repo.InsertUser(context.Background(), user))
+	return user
+}
+
+func newPost(t *testing.T, repo repository.Repository, userId string, options ...func(*models.Post)) *models.Post {
+	t.Helper()
+	post := &models.Post{
+		Id:          newId(),
+		PostContent: "content " + newId(),
+		UserId:      userId,
+		Status:      models.PostStatusPublished,
+		Visibility:  models.PostVisibilityPublic,
+	}
+	for _, option := range options {
+		option(post)
+	}
+	must(t, "InsertPost", repo.InsertPost(context.Background(), post))
+	return post
+}
+
+func newAttachment(t *testing.T, repo repository.Repository, userId string, postId string) *models.Attachment {
+	t.Helper()
+	attachment := &models.Attachment{
+		Id:          newId(),
+		PostId:      postId,
+		UserId:      userId,
+		FileName:    "file.txt",
+		ContentType: "text/plain",
+		Size:        42,
+		StorageKey:  newId(),
+	}
+	must(t, "InsertAttachment", repo.InsertAttachment(context.Background(), attachment))
+	return attachment
+}
+
+func must(t *testing.T, name string, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+}
+
+func expectNotFound(t *testing.T, name string, err error) {
+	t.Helper()
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("%s: got error %v, want ErrNotFound", name, err)
+	}
+}
+
+func expectConflict(t *testing.T, name string, err error, field string) {
+	t.Helper()
+	var conflict *repository.ConflictError
+	if !errors.As(err, &conflict) || !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("%s: got error %v, want a ConflictError", name, err)
+		return
+	}
+	if conflict.Field != field {
+		t.Errorf("%s: conflicting field = %q, want %q", name, conflict.Field, field)
+	}
+}
+
+func postIds(posts []*models.Post) []string {
+	var ids []string
+	for _, post := range posts {
+		ids = append(ids, post.Id)
+	}
+	return ids
+}
+
+func attachmentIds(attachments []*models.Attachment) []string {
+	var ids []string
+	for _, attachment := range attachments {
+		ids = append(ids, attachment.Id)
+	}
+	return ids
+}
+
+func equal[T comparable](a []T, b []T) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
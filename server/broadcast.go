@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+
+	"github.com/bocanada/rest-ws/dto"
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// BroadcastPost announces a post event on the hub of s to the users allowed
+// to read the post. Posts that are not published yet are never announced.
+func BroadcastPost(ctx context.Context, s Server, messageType string, post *models.Post) (err error) {
+	if post.Status != models.PostStatusPublished {
+		return nil
+	}
+	ctx, span := tracing.Tracer(s.TracerProvider()).Start(ctx, "hub.broadcast", trace.WithAttributes(
+		attribute.String("websocket.message_type", messageType),
+		attribute.String("post.id", post.Id),
+		attribute.String("post.visibility", post.Visibility),
+	))
+	var recipients int
+	defer func() {
+		span.SetAttributes(attribute.Int("websocket.recipients", recipients))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	message := models.WebSocketMessage{
+		Type:    messageType,
+		Payload: dto.NewPost(post),
+	}
+	hub := s.Hub()
+	switch post.Visibility {
+	case models.PostVisibilityPrivate:
+		recipients = hub.BroadcastTo(message, func(userId string) bool {
+			return userId == post.UserId
+		})
+	case models.PostVisibilityFollowers:
+		followers, err := s.Repository().ListFollowerIds(ctx, post.UserId)
+		if err != nil {
+			return err
+		}
+		audience := map[string]bool{post.UserId: true}
+		for _, id := range followers {
+			audience[id] = true
+		}
+		recipients = hub.BroadcastTo(message, func(userId string) bool {
+			return audience[userId]
+		})
+	default:
+		recipients = hub.Broadcast(message, nil)
+	}
+	return nil
+}
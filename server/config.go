@@ -0,0 +1,432 @@
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bocanada/rest-ws/ratelimit"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Port           string
+	JWTSecret      string
+	DatabaseUrl    string
+	RequireIfMatch bool
+	TrashRetention time.Duration
+	StorageUrl     string
+	MaxUploadSize  int64
+	MailerUrl      string
+	PublicUrl      string
+
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	CORSOrigins  []string
+
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+
+	TokenTTL         time.Duration
+	VerifyEmailTTL   time.Duration
+	PasswordResetTTL time.Duration
+	AttachmentURLTTL time.Duration
+	// LoginChallengeTTL is how long users with two-factor authentication
+	// have to send their code after their password.
+	LoginChallengeTTL time.Duration
+	TOTPIssuer        string
+
+	HubReadBufferSize  int
+	HubWriteBufferSize int
+	HubSendBufferSize  int
+
+	LogLevel  string
+	LogFormat string
+
+	AdminUserIds []string
+
+	OTLPEndpoint     string
+	TraceSampleRatio float64
+
+	RateLimits        []string
+	RateLimitStore    string
+	RateLimitIPHeader string
+	RateLimitDBConns  int
+	HubMessageLimit   int
+	HubMessagePeriod  time.Duration
+
+	LoginFailureWindow      time.Duration
+	LoginDelayAfter         int
+	LoginLockoutThreshold   int
+	LoginIPLockoutThreshold int
+	LoginLockoutDuration    time.Duration
+}
+
+// LogLevels are the accepted values of Config.LogLevel, from the most to the
+// least verbose.
+var LogLevels = []string{"debug", "info", "warn", "error"}
+
+// LogFormats are the accepted values of Config.LogFormat.
+var LogFormats = []string{"text", "json"}
+
+// RateLimitStores are the accepted values of Config.RateLimitStore: buckets
+// kept by each instance, or in the database and shared by all of them.
+var RateLimitStores = []string{"memory", "postgres"}
+
+// secretSettings are redacted entirely by PrintConfig. URLs of the other
+// settings only have their password redacted.
+var secretSettings = map[string]bool{"jwt-secret": true}
+
+// DefaultConfig returns the configuration used for every setting no source
+// sets. JWTSecret and DatabaseUrl have no default.
+func DefaultConfig() *Config {
+	return &Config{
+		Port:           ":5050",
+		TrashRetention: 30 * 24 * time.Hour,
+		StorageUrl:     "file://attachments",
+		MaxUploadSize:  10 << 20,
+		MailerUrl:      "log://",
+
+		ReadTimeout:  time.Minute,
+		WriteTimeout: time.Minute,
+		IdleTimeout:  2 * time.Minute,
+		CORSOrigins:  []string{"*"},
+
+		DBMaxOpenConns:    25,
+		DBMaxIdleConns:    5,
+		DBConnMaxLifetime: 30 * time.Minute,
+
+		TokenTTL:         48 * time.Hour,
+		VerifyEmailTTL:   24 * time.Hour,
+		PasswordResetTTL: time.Hour,
+		AttachmentURLTTL: 15 * time.Minute,
+
+		LoginChallengeTTL: 5 * time.Minute,
+		TOTPIssuer:        "rest-ws",
+
+		HubReadBufferSize:  1024,
+		HubWriteBufferSize: 1024,
+		HubSendBufferSize:  16,
+
+		LogLevel:  "info",
+		LogFormat: "text",
+
+		TraceSampleRatio: 1,
+
+		RateLimits: []string{
+			"POST /login=ip:10/1m",
+			"POST /login/2fa=ip:10/1m",
+			"POST /signup=ip:10/1h",
+			"POST /password/forgot=ip:5/1h",
+			"POST /api/v1/posts=user:30/1m",
+			"* *=ip:600/1m",
+		},
+		RateLimitStore:   "memory",
+		RateLimitDBConns: 10,
+		HubMessageLimit:  20,
+		HubMessagePeriod: 10 * time.Second,
+
+		LoginFailureWindow:      15 * time.Minute,
+		LoginDelayAfter:         3,
+		LoginLockoutThreshold:   10,
+		LoginIPLockoutThreshold: 100,
+		LoginLockoutDuration:    15 * time.Minute,
+	}
+}
+
+// bind registers a flag for every setting of cfg on fs, with the current
+// values of cfg as defaults. The same names are the keys of the config file
+// and, upper-cased with dashes turned into underscores, the environment
+// variables.
+func (cfg *Config) bind(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.Port, "port", cfg.Port, "address to listen on")
+	fs.StringVar(&cfg.JWTSecret, "jwt-secret", cfg.JWTSecret, "secret signing the access tokens")
+	fs.StringVar(&cfg.DatabaseUrl, "database-url", cfg.DatabaseUrl, "Postgres connection string")
+	fs.BoolVar(&cfg.RequireIfMatch, "require-if-match", cfg.RequireIfMatch, "reject post updates, deletes and revision restores without an If-Match header")
+	fs.DurationVar(&cfg.TrashRetention, "trash-retention", cfg.TrashRetention, "how long deleted posts stay in the trash")
+	fs.StringVar(&cfg.StorageUrl, "storage-url", cfg.StorageUrl, "where attachments are stored, file:// or s3://")
+	fs.Int64Var(&cfg.MaxUploadSize, "max-upload-size", cfg.MaxUploadSize, "largest accepted attachment, in bytes")
+	fs.StringVar(&cfg.MailerUrl, "mailer-url", cfg.MailerUrl, "how emails are sent, smtp://, file:// or log://")
+	fs.StringVar(&cfg.PublicUrl, "public-url", cfg.PublicUrl, "base URL of the links in emails, http://localhost<port> by default")
+
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", cfg.ReadTimeout, "time allowed to read a request, body included")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", cfg.WriteTimeout, "time allowed to write a response")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", cfg.IdleTimeout, "how long idle keep-alive connections are kept")
+	fs.Var((*listValue)(&cfg.CORSOrigins), "cors-origins", "comma-separated origins allowed by CORS")
+
+	fs.IntVar(&cfg.DBMaxOpenConns, "db-max-open-conns", cfg.DBMaxOpenConns, "maximum open database connections, 0 for no limit")
+	fs.IntVar(&cfg.DBMaxIdleConns, "db-max-idle-conns", cfg.DBMaxIdleConns, "maximum idle database connections")
+	fs.DurationVar(&cfg.DBConnMaxLifetime, "db-conn-max-lifetime", cfg.DBConnMaxLifetime, "how long a database connection is reused, 0 for ever")
+
+	fs.DurationVar(&cfg.TokenTTL, "token-ttl", cfg.TokenTTL, "lifetime of the access tokens")
+	fs.DurationVar(&cfg.VerifyEmailTTL, "verify-email-ttl", cfg.VerifyEmailTTL, "lifetime of email verification links")
+	fs.DurationVar(&cfg.PasswordResetTTL, "password-reset-ttl", cfg.PasswordResetTTL, "lifetime of password reset links")
+	fs.DurationVar(&cfg.AttachmentURLTTL, "attachment-url-ttl", cfg.AttachmentURLTTL, "lifetime of signed attachment URLs")
+	fs.DurationVar(&cfg.LoginChallengeTTL, "login-challenge-ttl", cfg.LoginChallengeTTL, "time users with two-factor authentication have to send their code after their password")
+	fs.StringVar(&cfg.TOTPIssuer, "totp-issuer", cfg.TOTPIssuer, "name authenticator apps show for the accounts of this server")
+
+	fs.IntVar(&cfg.HubReadBufferSize, "hub-read-buffer-size", cfg.HubReadBufferSize, "WebSocket read buffer, in bytes")
+	fs.IntVar(&cfg.HubWriteBufferSize, "hub-write-buffer-size", cfg.HubWriteBufferSize, "WebSocket write buffer, in bytes")
+	fs.IntVar(&cfg.HubSendBufferSize, "hub-send-buffer-size", cfg.HubSendBufferSize, "messages queued for each WebSocket client")
+
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "one of "+strings.Join(LogLevels, ", "))
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "one of "+strings.Join(LogFormats, ", "))
+
+	fs.Var((*listValue)(&cfg.AdminUserIds), "admin-user-ids", "comma-separated ids of the users allowed to see /status")
+
+	fs.StringVar(&cfg.OTLPEndpoint, "otlp-endpoint", cfg.OTLPEndpoint, "OTLP/HTTP collector to export traces to, such as http://localhost:4318; traces are not exported when empty")
+	fs.Float64Var(&cfg.TraceSampleRatio, "trace-sample-ratio", cfg.TraceSampleRatio, "share of new traces that are sampled, from 0 to 1")
+
+	fs.Var((*listValue)(&cfg.RateLimits), "rate-limits", `comma-separated request limits, each "METHOD ROUTE=KEY:LIMIT/PERIOD" with KEY one of ip, user or route and * for any method or route`)
+	fs.StringVar(&cfg.RateLimitStore, "rate-limit-store", cfg.RateLimitStore, "where rate limits are counted, one of "+strings.Join(RateLimitStores, ", "))
+	fs.IntVar(&cfg.RateLimitDBConns, "rate-limit-db-conns", cfg.RateLimitDBConns, "maximum open database connections of the postgres rate limit store, 0 for no limit")
+	fs.StringVar(&cfg.RateLimitIPHeader, "rate-limit-ip-header", cfg.RateLimitIPHeader, "header holding the client address when behind a proxy, such as X-Forwarded-For")
+	fs.IntVar(&cfg.HubMessageLimit, "hub-message-limit", cfg.HubMessageLimit, "WebSocket messages a client may send per hub-message-period, 0 for no limit")
+	fs.DurationVar(&cfg.HubMessagePeriod, "hub-message-period", cfg.HubMessagePeriod, "period of hub-message-limit")
+
+	fs.DurationVar(&cfg.LoginFailureWindow, "login-failure-window", cfg.LoginFailureWindow, "how long failed logins count towards delays and lockouts")
+	fs.IntVar(&cfg.LoginDelayAfter, "login-delay-after", cfg.LoginDelayAfter, "failed logins for an account or address before each further attempt must wait, from 1s doubling up to 1m")
+	fs.IntVar(&cfg.LoginLockoutThreshold, "login-lockout-threshold", cfg.LoginLockoutThreshold, "failed logins that lock an account")
+	fs.IntVar(&cfg.LoginIPLockoutThreshold, "login-ip-lockout-threshold", cfg.LoginIPLockoutThreshold, "failed logins that lock a client address out of every account")
+	fs.DurationVar(&cfg.LoginLockoutDuration, "login-lockout-duration", cfg.LoginLockoutDuration, "how long lockouts last")
+}
+
+// LoadConfig builds the configuration from, by increasing precedence, the
+// defaults, the YAML file named by -config or CONFIG_FILE, the environment
+// as read by getenv, and the command-line flags in args. It only fails on
+// values that cannot be parsed; NewServer validates the result.
+func LoadConfig(name string, args []string, getenv func(string) string) (*Config, error) {
+	cfg := DefaultConfig()
+	settings := flag.NewFlagSet(name, flag.ContinueOnError)
+	cfg.bind(settings)
+
+	// Flags are parsed into a copy first: they must win over the file and the
+	// environment, which are only known once -config has been read.
+	cli := flag.NewFlagSet(name, flag.ContinueOnError)
+	DefaultConfig().bind(cli)
+	file := cli.String("config", getenv("CONFIG_FILE"), "YAML file (.yaml or .yml) to read settings from")
+	if err := cli.Parse(args); err != nil {
+		return nil, err
+	}
+	if cli.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", cli.Arg(0))
+	}
+
+	if *file != "" {
+		if err := loadConfigFile(settings, *file); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	settings.VisitAll(func(f *flag.Flag) {
+		if v := getenv(envName(f.Name)); v != "" && err == nil {
+			if err = f.Value.Set(v); err != nil {
+				err = fmt.Errorf("invalid %s: %w", envName(f.Name), err)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	cli.Visit(func(f *flag.Flag) {
+		if s := settings.Lookup(f.Name); s != nil && err == nil {
+			err = s.Value.Set(f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.PublicUrl == "" {
+		cfg.PublicUrl = "http://localhost" + cfg.Port
+	}
+	return cfg, nil
+}
+
+// loadConfigFile reads the settings of a YAML file. TOML is not supported:
+// other extensions are rejected rather than read as YAML.
+func loadConfigFile(settings *flag.FlagSet, path string) error {
+	if ext := strings.ToLower(filepath.Ext(path)); ext != ".yaml" && ext != ".yml" {
+		return fmt.Errorf("%s: unsupported config file format %q, only YAML (.yaml or .yml) is supported", path, ext)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]any
+	if err = yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for key, value := range values {
+		f := settings.Lookup(key)
+		if f == nil {
+			return fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+		var s string
+		switch v := value.(type) {
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			s = strings.Join(items, ",")
+		case nil:
+		default:
+			s = fmt.Sprint(v)
+		}
+		if err = f.Value.Set(s); err != nil {
+			return fmt.Errorf("%s: invalid %s: %w", path, key, err)
+		}
+	}
+	return nil
+}
+
+func envName(flagName string) string {
+	return strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// IsAdmin reports whether userId is one of AdminUserIds.
+func (cfg *Config) IsAdmin(userId string) bool {
+	for _, id := range cfg.AdminUserIds {
+		if userId != "" && id == userId {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate reports the first setting that cannot work. DatabaseUrl is not
+// checked, since a server given a repository does not need one.
+func (cfg *Config) Validate() error {
+	switch {
+	case cfg.Port == "":
+		return errors.New("port is required")
+	case cfg.JWTSecret == "":
+		return errors.New("jwt secret is required")
+	case cfg.TrashRetention <= 0:
+		return errors.New("trash retention must be positive")
+	case cfg.MaxUploadSize <= 0:
+		return errors.New("max upload size must be positive")
+	case cfg.PublicUrl == "":
+		return errors.New("public url is required")
+	case cfg.ReadTimeout <= 0 || cfg.WriteTimeout <= 0 || cfg.IdleTimeout <= 0:
+		return errors.New("timeouts must be positive")
+	case len(cfg.CORSOrigins) == 0:
+		return errors.New("at least one CORS origin is required")
+	case cfg.DBMaxOpenConns < 0 || cfg.DBMaxIdleConns < 0 || cfg.DBConnMaxLifetime < 0 || cfg.RateLimitDBConns < 0:
+		return errors.New("database pool settings must not be negative")
+	case cfg.TokenTTL <= 0 || cfg.VerifyEmailTTL <= 0 || cfg.PasswordResetTTL <= 0 || cfg.AttachmentURLTTL <= 0 || cfg.LoginChallengeTTL <= 0:
+		return errors.New("token lifetimes must be positive")
+	case cfg.HubReadBufferSize < 0 || cfg.HubWriteBufferSize < 0 || cfg.HubSendBufferSize < 0:
+		return errors.New("hub buffer sizes must not be negative")
+	case !oneOf(cfg.LogLevel, LogLevels):
+		return fmt.Errorf("log level must be one of %s", strings.Join(LogLevels, ", "))
+	case !oneOf(cfg.LogFormat, LogFormats):
+		return fmt.Errorf("log format must be one of %s", strings.Join(LogFormats, ", "))
+	case cfg.TraceSampleRatio < 0 || cfg.TraceSampleRatio > 1:
+		return errors.New("trace sample ratio must be between 0 and 1")
+	case cfg.TOTPIssuer == "" || strings.Contains(cfg.TOTPIssuer, ":"):
+		return errors.New("totp issuer is required and must not contain a colon")
+	case !oneOf(cfg.RateLimitStore, RateLimitStores):
+		return fmt.Errorf("rate limit store must be one of %s", strings.Join(RateLimitStores, ", "))
+	case cfg.HubMessageLimit < 0 || cfg.HubMessagePeriod <= 0:
+		return errors.New("hub message limit must not be negative and its period must be positive")
+	case cfg.LoginFailureWindow <= 0 || cfg.LoginLockoutDuration <= 0:
+		return errors.New("login failure window and lockout duration must be positive")
+	case cfg.LoginDelayAfter < 0 || cfg.LoginLockoutThreshold <= 0 || cfg.LoginIPLockoutThreshold <= 0:
+		return errors.New("login delay threshold must not be negative and lockout thresholds must be positive")
+	}
+	if _, err := url.Parse(cfg.PublicUrl); err != nil {
+		return fmt.Errorf("invalid public url: %w", err)
+	}
+	if _, err := ratelimit.ParseRules(cfg.RateLimits); err != nil {
+		return err
+	}
+	return nil
+}
+
+func oneOf(value string, choices []string) bool {
+	for _, c := range choices {
+		if value == c {
+			return true
+		}
+	}
+	return false
+}
+
+// PrintConfig writes cfg to w in the format of the config file, with
+// secrets and the passwords of URLs redacted.
+func PrintConfig(w io.Writer, cfg *Config) error {
+	copied := *cfg
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	copied.bind(fs)
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretSettings[f.Name] && value != "" {
+			value = redacted
+		} else {
+			value = redactPassword(value)
+		}
+		if _, werr := fmt.Fprintf(w, "%s: %s\n", f.Name, yamlScalar(value)); werr != nil && err == nil {
+			err = werr
+		}
+	})
+	return err
+}
+
+const redacted = "REDACTED"
+
+// yamlScalar returns value as is when YAML reads it back the same, and
+// quoted otherwise.
+func yamlScalar(value string) string {
+	var decoded any
+	if err := yaml.Unmarshal([]byte(value), &decoded); err == nil && decoded != nil && fmt.Sprint(decoded) == value {
+		return value
+	}
+	quoted, _ := yaml.Marshal(value)
+	return strings.TrimSpace(string(quoted))
+}
+
+var dsnPassword = regexp.MustCompile(`(password=)('[^']*'|\S+)`)
+
+// redactPassword hides the password of URLs and key=value connection
+// strings, and returns anything else unchanged.
+func redactPassword(value string) string {
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			return u.String()
+		}
+	}
+	return dsnPassword.ReplaceAllString(value, "${1}"+redacted)
+}
+
+// listValue is a flag.Value for comma-separated lists.
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+)
+
+// NewLogger returns a logger writing to w at Config.LogLevel, as text or
+// JSON according to Config.LogFormat.
+func NewLogger(w io.Writer, cfg *Config) *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	if cfg.LogFormat == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/bocanada/rest-ws/repository"
+)
+
+const loginPurgeInterval = time.Hour
+
+// purgeLoginFailures forgets the failed logins that no longer delay or lock
+// anybody out, so that guessing at many addresses does not grow the table
+// for good. It runs every loginPurgeInterval.
+func (b *Broker) purgeLoginFailures(repo repository.Repository) {
+	olderThan := b.config.LoginFailureWindow
+	if b.config.LoginLockoutDuration > olderThan {
+		olderThan = b.config.LoginLockoutDuration
+	}
+	ticker := time.NewTicker(loginPurgeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n, err := repo.PurgeLoginFailures(context.Background(), olderThan)
+		if err != nil {
+			b.logger.Error("purging failed logins failed", "error", err)
+		} else if n > 0 {
+			b.logger.Debug("purged failed logins", "records", n)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/bocanada/rest-ws/ratelimit"
+)
+
+const rateLimitSweepInterval = time.Hour
+
+// newRateLimiter counts the requests of the rate limits where
+// Config.RateLimitStore says.
+func newRateLimiter(cfg *Config) (ratelimit.Limiter, error) {
+	if cfg.RateLimitStore != "postgres" {
+		return ratelimit.NewMemoryLimiter(), nil
+	}
+	db, err := sql.Open("postgres", cfg.DatabaseUrl)
+	if err != nil {
+		return nil, err
+	}
+	// The limiter makes one short query per request and matching rule, so
+	// its pool needs to keep up with the requests served at once.
+	db.SetMaxOpenConns(cfg.RateLimitDBConns)
+	db.SetMaxIdleConns(cfg.RateLimitDBConns)
+	return ratelimit.NewPostgresLimiter(db), nil
+}
+
+// sweepRateLimits deletes the buckets of a shared limiter once they are full
+// again. It runs every rateLimitSweepInterval.
+func (b *Broker) sweepRateLimits(limiter *ratelimit.PostgresLimiter) {
+	rules, _ := ratelimit.ParseRules(b.config.RateLimits)
+	olderThan := rateLimitSweepInterval
+	for _, rule := range rules {
+		if rule.Period > olderThan {
+			olderThan = rule.Period
+		}
+	}
+	ticker := time.NewTicker(rateLimitSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n, err := limiter.Sweep(context.Background(), olderThan)
+		if err != nil {
+			b.logger.Error("sweeping the rate limits failed", "error", err)
+		} else if n > 0 {
+			b.logger.Debug("swept the rate limits", "buckets", n)
+		}
+	}
+}
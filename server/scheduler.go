@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/repository"
+)
+
+const (
+	schedulerInterval  = 10 * time.Second
+	schedulerBatchSize = 100
+)
+
+// publishScheduledPosts publishes scheduled posts once their publish_at has
+// passed and announces them on the hub, the same way InsertPostHandler does
+// for posts published right away.
+func (b *Broker) publishScheduledPosts(repo repository.Repository) {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for {
+			posts, err := repo.PublishDuePosts(context.Background(), schedulerBatchSize)
+			if err != nil {
+				b.logger.Error("publishing scheduled posts failed", "error", err)
+				break
+			}
+			for _, post := range posts {
+				if err := BroadcastPost(context.Background(), b, models.PostCreatedMessage, post); err != nil {
+					b.logger.Error("broadcasting post failed", "post_id", post.Id, "error", err)
+				}
+			}
+			if len(posts) < schedulerBatchSize {
+				break
+			}
+		}
+	}
+}
@@ -3,31 +3,103 @@ package server
 import (
 	"context"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/bocanada/rest-ws/database"
+	"github.com/bocanada/rest-ws/mail"
+	"github.com/bocanada/rest-ws/metrics"
+	"github.com/bocanada/rest-ws/ratelimit"
 	"github.com/bocanada/rest-ws/repository"
+	"github.com/bocanada/rest-ws/storage"
+	"github.com/bocanada/rest-ws/tracing"
 	"github.com/bocanada/rest-ws/websocket"
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
-type Config struct {
-	Port        string
-	JWTSecret   string
-	DatabaseUrl string
-}
+// Version identifies the build in /status. Release builds set it with
+// -ldflags "-X github.com/bocanada/rest-ws/server.Version=v1.2.3".
+var Version = "dev"
+
+// startupPingTimeout bounds the check NewServer makes that the repository
+// is usable.
+const startupPingTimeout = 10 * time.Second
 
 type Server interface {
 	Config() *Config
 	Hub() *websocket.Hub
+	Storage() storage.BlobStore
+	Mailer() mail.Mailer
+	Repository() repository.Repository
+	StartedAt() time.Time
+	Metrics() *metrics.Metrics
+	Logger() *slog.Logger
+	TracerProvider() trace.TracerProvider
+	RateLimiter() ratelimit.Limiter
 }
 
 type Broker struct {
-	config *Config
-	router *mux.Router
-	hub    *websocket.Hub
+	config  *Config
+	router  *mux.Router
+	hub     *websocket.Hub
+	storage storage.BlobStore
+	mailer  mail.Mailer
+	repo    repository.Repository
+	started time.Time
+	metrics *metrics.Metrics
+	logger  *slog.Logger
+	tracer  trace.TracerProvider
+	limiter ratelimit.Limiter
+}
+
+// Option replaces a dependency NewServer would otherwise build from the
+// Config.
+type Option func(b *Broker)
+
+// WithRepository makes the server use repo instead of connecting to
+// Config.DatabaseUrl.
+func WithRepository(repo repository.Repository) Option {
+	return func(b *Broker) {
+		b.repo = repo
+	}
+}
+
+// WithMailer makes the server send emails through mailer instead of the one
+// at Config.MailerUrl.
+func WithMailer(mailer mail.Mailer) Option {
+	return func(b *Broker) {
+		b.mailer = mailer
+	}
+}
+
+// WithLogger makes the server log through logger instead of one built from
+// the Config that writes to stderr.
+func WithLogger(logger *slog.Logger) Option {
+	return func(b *Broker) {
+		b.logger = logger
+	}
+}
+
+// WithTracerProvider makes the server record its spans with tp instead of
+// exporting them to Config.OTLPEndpoint.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(b *Broker) {
+		b.tracer = tp
+	}
+}
+
+// WithRateLimiter makes the server count requests against its rate limits
+// with limiter instead of the store named by Config.RateLimitStore.
+func WithRateLimiter(limiter ratelimit.Limiter) Option {
+	return func(b *Broker) {
+		b.limiter = limiter
+	}
 }
 
 func (b *Broker) Config() *Config {
@@ -38,32 +110,154 @@ func (b *Broker) Hub() *websocket.Hub {
 	return b.hub
 }
 
-func NewServer(ctx context.Context, cfg *Config) (*Broker, error) {
-	if cfg.Port == "" {
-		return nil, errors.New("port is required")
+func (b *Broker) Storage() storage.BlobStore {
+	return b.storage
+}
+
+func (b *Broker) Mailer() mail.Mailer {
+	return b.mailer
+}
+
+func (b *Broker) Repository() repository.Repository {
+	return b.repo
+}
+
+func (b *Broker) StartedAt() time.Time {
+	return b.started
+}
+
+func (b *Broker) Metrics() *metrics.Metrics {
+	return b.metrics
+}
+
+func (b *Broker) Logger() *slog.Logger {
+	return b.logger
+}
+
+func (b *Broker) TracerProvider() trace.TracerProvider {
+	return b.tracer
+}
+
+func (b *Broker) RateLimiter() ratelimit.Limiter {
+	return b.limiter
+}
+
+func NewServer(ctx context.Context, cfg *Config, opts ...Option) (*Broker, error) {
+	b := &Broker{
+		config:  cfg,
+		router:  mux.NewRouter(),
+		started: time.Now(),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
-	if cfg.JWTSecret == "" {
-		return nil, errors.New("jwt secret is required")
+	if b.logger == nil {
+		b.logger = NewLogger(os.Stderr, cfg)
 	}
-	if cfg.DatabaseUrl == "" {
+	b.hub = websocket.NewHub(websocket.Options{
+		ReadBufferSize:  cfg.HubReadBufferSize,
+		WriteBufferSize: cfg.HubWriteBufferSize,
+		SendBufferSize:  cfg.HubSendBufferSize,
+		MessageLimit:    cfg.HubMessageLimit,
+		MessagePeriod:   cfg.HubMessagePeriod,
+		Logger:          b.logger,
+	})
+	b.metrics = metrics.New()
+	b.metrics.RegisterHub(b.hub)
+	if cfg.DatabaseUrl == "" && b.repo == nil {
 		return nil, errors.New("database url is required")
 	}
+	var err error
+	if b.tracer == nil {
+		if b.tracer, err = newTracerProvider(ctx, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if b.limiter == nil {
+		if b.limiter, err = newRateLimiter(cfg); err != nil {
+			return nil, err
+		}
+	}
+	// Every outbound HTTP call carries the trace context. The blob store is
+	// the only client making them: mailers speak SMTP.
+	if b.storage, err = storage.Open(cfg.StorageUrl, tracing.Transport(http.DefaultTransport, b.tracer)); err != nil {
+		return nil, err
+	}
+	if b.mailer == nil {
+		if b.mailer, err = mail.Open(cfg.MailerUrl); err != nil {
+			return nil, err
+		}
+	}
+	if b.repo == nil {
+		repo, err := database.NewPostgresRepository(cfg.DatabaseUrl)
+		if err != nil {
+			return nil, err
+		}
+		repo.ConfigurePool(cfg.DBMaxOpenConns, cfg.DBMaxIdleConns, cfg.DBConnMaxLifetime)
+		b.repo = repo
+	}
+	b.repo = tracing.InstrumentRepository(b.metrics.InstrumentRepository(b.repo), b.tracer)
+	pingCtx, cancel := context.WithTimeout(ctx, startupPingTimeout)
+	defer cancel()
+	if err = b.repo.Ping(pingCtx); err != nil {
+		return nil, fmt.Errorf("database: %w", err)
+	}
+	return b, nil
+}
 
-	return &Broker{config: cfg, router: mux.NewRouter(), hub: websocket.NewHub()}, nil
+// newTracerProvider exports spans to Config.OTLPEndpoint, or drops them when
+// there is none.
+func newTracerProvider(ctx context.Context, cfg *Config) (trace.TracerProvider, error) {
+	if cfg.OTLPEndpoint == "" {
+		return noop.NewTracerProvider(), nil
+	}
+	return tracing.NewOTLPProvider(ctx, cfg.OTLPEndpoint, cfg.TraceSampleRatio, Version)
 }
 
-func (b *Broker) Start(binder func(s Server, r *mux.Router)) {
+// Handler binds the routes with binder and returns the handler serving
+// them, CORS included.
+func (b *Broker) Handler(binder func(s Server, r *mux.Router)) http.Handler {
 	b.router = mux.NewRouter()
-	handler := cors.AllowAll().Handler(b.router)
+	handler := cors.New(cors.Options{
+		AllowedOrigins: b.config.CORSOrigins,
+		AllowedMethods: []string{
+			http.MethodHead,
+			http.MethodGet,
+			http.MethodPost,
+			http.MethodPut,
+			http.MethodPatch,
+			http.MethodDelete,
+		},
+		AllowedHeaders: []string{"*"},
+		ExposedHeaders: []string{"ETag", "X-Request-ID", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"},
+	}).Handler(b.router)
 	binder(b, b.router)
-	repo, err := database.NewPostgresRepository(b.config.DatabaseUrl)
-	if err != nil {
-		log.Fatal(err)
-	}
+	return handler
+}
+
+func (b *Broker) Start(binder func(s Server, r *mux.Router)) {
+	handler := b.Handler(binder)
 	go b.hub.Run()
-	repository.SetRepository(repo)
-	log.Println("Starting server on port", b.Config().Port)
-	if err := http.ListenAndServe(b.config.Port, handler); err != nil {
-		log.Fatal("ListenAndServe:", err.Error())
+	go b.purgeTrash(b.repo)
+	go b.publishScheduledPosts(b.repo)
+	go b.purgeLoginFailures(b.repo)
+	if limiter, ok := b.limiter.(*ratelimit.PostgresLimiter); ok {
+		go b.sweepRateLimits(limiter)
+	}
+	b.logger.Info("starting server", "addr", b.config.Port, "version", Version)
+	srv := &http.Server{
+		Addr:         b.config.Port,
+		Handler:      handler,
+		ReadTimeout:  b.config.ReadTimeout,
+		WriteTimeout: b.config.WriteTimeout,
+		IdleTimeout:  b.config.IdleTimeout,
+		ErrorLog:     slog.NewLogLogger(b.logger.Handler(), slog.LevelError),
+	}
+	if err := srv.ListenAndServe(); err != nil {
+		b.logger.Error("server stopped", "error", err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bocanada/rest-ws/database"
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/repository"
+	"github.com/bocanada/rest-ws/storage"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func newTestBroker(t *testing.T) *Broker {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.JWTSecret = "test-secret"
+	cfg.StorageUrl = "file://" + t.TempDir()
+	cfg.PublicUrl = "http://localhost"
+	b, err := NewServer(context.Background(), cfg,
+		WithRepository(database.NewMemoryRepository()),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDeprecatedRepositoryFunctions(t *testing.T) {
+	b := newTestBroker(t)
+	ctx := context.Background()
+	user := &models.User{ID: "deprecated", Email: "deprecated@example.com", Password: "password"}
+	// NewServer leaves the global alone, so that servers never share it.
+	if err := repository.InsertUser(ctx, user); !errors.Is(err, repository.ErrNoRepository) {
+		t.Fatalf("repository.InsertUser before SetRepository: %v, want ErrNoRepository", err)
+	}
+	repository.SetRepository(b.Repository())
+	t.Cleanup(func() { repository.SetRepository(nil) })
+	if err := repository.InsertUser(ctx, user); err != nil {
+		t.Fatalf("repository.InsertUser: %v", err)
+	}
+	if _, err := b.Repository().GetUserById(ctx, user.ID); err != nil {
+		t.Errorf("user inserted through repository.InsertUser is not in the server's repository: %v", err)
+	}
+}
+
+func TestCollectAttachments(t *testing.T) {
+	b := newTestBroker(t)
+	ctx := context.Background()
+	repo := b.Repository()
+	user := &models.User{ID: "author", Email: "author@example.com", Password: "password"}
+	if err := repo.InsertUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	attach := func(id string, postId string) *models.Attachment {
+		t.Helper()
+		attachment := &models.Attachment{Id: id, PostId: postId, UserId: user.ID, FileName: id, ContentType: "text/plain", Size: 2, StorageKey: "blobs/" + id}
+		if err := b.Storage().Put(ctx, attachment.StorageKey, strings.NewReader(id), attachment.Size, attachment.ContentType); err != nil {
+			t.Fatal(err)
+		}
+		return attachment
+	}
+	var kept []*models.Attachment
+	for _, id := range []string{"purged", "live"} {
+		post := &models.Post{Id: id, PostContent: id, UserId: user.ID}
+		if err := repo.InsertPost(ctx, post); err != nil {
+			t.Fatal(err)
+		}
+		attachment := attach(id+"-file", post.Id)
+		if err := repo.InsertAttachment(ctx, attachment); err != nil {
+			t.Fatal(err)
+		}
+		if id == "live" {
+			kept = append(kept, attachment)
+			continue
+		}
+		if err := repo.DeletePost(ctx, post); err != nil {
+			t.Fatal(err)
+		}
+	}
+	avatar := attach("avatar", "")
+	if err := repo.SetUserAvatar(ctx, user.ID, avatar); err != nil {
+		t.Fatal(err)
+	}
+	kept = append(kept, avatar)
+	if _, err := repo.PurgeDeletedPosts(ctx, -time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	b.collectAttachments(repo)
+
+	if _, err := repo.GetAttachmentById(ctx, "purged-file"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("attachment of a purged post: got error %v, want it collected", err)
+	}
+	if _, err := b.Storage().Get(ctx, "blobs/purged-file"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("blob of a purged post: got error %v, want it deleted", err)
+	}
+	for _, attachment := range kept {
+		if _, err := repo.GetAttachmentById(ctx, attachment.Id); err != nil {
+			t.Errorf("attachment %s collected: %v", attachment.Id, err)
+		}
+		blob, err := b.Storage().Get(ctx, attachment.StorageKey)
+		if err != nil {
+			t.Errorf("blob of %s deleted: %v", attachment.Id, err)
+			continue
+		}
+		blob.Close()
+	}
+}
+
+func TestBlobStoreRequestsCarryTraceContext(t *testing.T) {
+	traceparents := make(chan string, 1)
+	blobs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Get("traceparent")
+	}))
+	t.Cleanup(blobs.Close)
+	u, _ := url.Parse(blobs.URL)
+
+	cfg := DefaultConfig()
+	cfg.JWTSecret = "test-secret"
+	cfg.StorageUrl = "s3://key:secret@" + u.Host + "/bucket?secure=false"
+	cfg.PublicUrl = "http://localhost"
+	tp := sdktrace.NewTracerProvider()
+	b, err := NewServer(context.Background(), cfg,
+		WithRepository(database.NewMemoryRepository()),
+		WithTracerProvider(tp),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, span := tp.Tracer("test").Start(context.Background(), "upload")
+	defer span.End()
+	if err := b.Storage().Put(ctx, "key", strings.NewReader("blob"), 4, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-traceparents; !strings.Contains(got, span.SpanContext().TraceID().String()) {
+		t.Errorf("traceparent = %q, want trace %s", got, span.SpanContext().TraceID())
+	}
+}
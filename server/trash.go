@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bocanada/rest-ws/repository"
+)
+
+const (
+	trashPurgeInterval  = time.Hour
+	attachmentBatchSize = 100
+)
+
+// purgeTrash permanently removes posts that have been in the trash for longer
+// than the configured retention, along with their attachments. It runs once
+// at startup and then every trashPurgeInterval.
+func (b *Broker) purgeTrash(repo repository.Repository) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		n, err := repo.PurgeDeletedPosts(context.Background(), b.config.TrashRetention)
+		if err != nil {
+			b.logger.Error("purging the trash failed", "error", err)
+		} else if n > 0 {
+			b.logger.Info("purged the trash", "posts", n)
+		}
+		b.collectAttachments(repo)
+		<-ticker.C
+	}
+}
+
+// collectAttachments deletes the blobs of attachments whose post is gone.
+func (b *Broker) collectAttachments(repo repository.Repository) {
+	ctx := context.Background()
+	for {
+		attachments, err := repo.ListOrphanedAttachments(ctx, attachmentBatchSize)
+		if err != nil {
+			b.logger.Error("collecting attachments failed", "error", err)
+			return
+		}
+		for _, attachment := range attachments {
+			if err = b.storage.Delete(ctx, attachment.StorageKey); err != nil {
+				b.logger.Error("collecting attachments failed", "error", err)
+				return
+			}
+			// Another instance may have collected it in the meantime.
+			if err = repo.DeleteAttachment(ctx, attachment); err != nil && !errors.Is(err, repository.ErrNotFound) {
+				b.logger.Error("collecting attachments failed", "error", err)
+				return
+			}
+		}
+		if len(attachments) < attachmentBatchSize {
+			return
+		}
+	}
+}
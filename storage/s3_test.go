@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKey = "access"
+	testSecretKey = "secret"
+)
+
+// fakeS3 is a stand-in for an S3-compatible service that keeps objects in
+// memory and only accepts requests signed with testSecretKey.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string]fakeObject
+	rejected []error
+}
+
+type fakeObject struct {
+	body        []byte
+	contentType string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.verify(r); err != nil {
+		f.rejected = append(f.rejected, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	path := r.URL.Path
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil || int64(len(body)) != r.ContentLength {
+			http.Error(w, "short body", http.StatusBadRequest)
+			return
+		}
+		f.objects[path] = fakeObject{body: body, contentType: r.Header.Get("Content-Type")}
+	case http.MethodGet:
+		obj, ok := f.objects[path]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(obj.body)
+	case http.MethodDelete:
+		delete(f.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// verify checks the Signature Version 4 of r the way S3 does, from the
+// request as received.
+func (f *fakeS3) verify(r *http.Request) error {
+	auth := r.Header.Get("Authorization")
+	fields := map[string]string{}
+	for _, field := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ", ") {
+		name, value, _ := strings.Cut(field, "=")
+		fields[name] = value
+	}
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || credential[0] != testAccessKey || credential[3] != "s3" || credential[4] != "aws4_request" {
+		return errors.New("bad credential " + fields["Credential"])
+	}
+	date, region := credential[1], credential[2]
+	amzDate := r.Header.Get("X-Amz-Date")
+	if !strings.HasPrefix(amzDate, date) {
+		return errors.New("x-amz-date does not match the credential")
+	}
+	var headers []string
+	for _, name := range strings.Split(fields["SignedHeaders"], ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers = append(headers, name+":"+value)
+	}
+	canonical := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.RawQuery,
+		strings.Join(headers, "\n"),
+		"",
+		fields["SignedHeaders"],
+		r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + date + "/" + region + "/s3/aws4_request\n" + hex.EncodeToString(sum[:])
+	key := []byte("AWS4" + testSecretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if !hmac.Equal([]byte(hex.EncodeToString(key)), []byte(fields["Signature"])) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+func newTestS3Store(t *testing.T) (*S3Store, *fakeS3) {
+	t.Helper()
+	fake := &fakeS3{objects: map[string]fakeObject{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	store, err := Open("s3://"+testAccessKey+":"+testSecretKey+"@"+u.Host+"/uploads?secure=false&region=eu-west-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.(*S3Store), fake
+}
+
+func TestS3Store(t *testing.T) {
+	store, fake := newTestS3Store(t)
+	ctx := context.Background()
+	key := "posts/1/a file+name"
+	body := "hello, s3"
+
+	if err := store.Put(ctx, key, strings.NewReader(body), int64(len(body)), "text/plain"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	fake.mu.Lock()
+	obj, ok := fake.objects["/uploads/"+key]
+	fake.mu.Unlock()
+	if !ok || string(obj.body) != body || obj.contentType != "text/plain" {
+		t.Fatalf("stored objects = %v, want %q in bucket uploads", fake.objects, key)
+	}
+	blob, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, _ := io.ReadAll(blob)
+	blob.Close()
+	if string(got) != body {
+		t.Errorf("Get = %q, want %q", got, body)
+	}
+
+	if err = store.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err = store.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete: got error %v, want ErrNotFound", err)
+	}
+	if err = store.Delete(ctx, key); err != nil {
+		t.Errorf("Delete of a missing blob: %v", err)
+	}
+	if len(fake.rejected) > 0 {
+		t.Errorf("requests with a bad signature: %v", fake.rejected)
+	}
+}
+
+func TestS3StoreWrongSecret(t *testing.T) {
+	store, fake := newTestS3Store(t)
+	store.secretKey = "wrong"
+	if err := store.Put(context.Background(), "key", strings.NewReader("x"), 1, "text/plain"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Put with a wrong secret: got error %v, want a 403", err)
+	}
+	if len(fake.rejected) != 1 {
+		t.Errorf("rejected requests = %v, want the Put", fake.rejected)
+	}
+}
+
+func TestS3Sign(t *testing.T) {
+	store := &S3Store{host: "s3.example.com", region: "us-east-1", accessKey: testAccessKey, secretKey: testSecretKey}
+	req := httptest.NewRequest(http.MethodGet, "http://s3.example.com/bucket/key", nil)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	store.sign(req, now)
+	if got := req.Header.Get("X-Amz-Date"); got != "20240102T030405Z" {
+		t.Errorf("X-Amz-Date = %q", got)
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=access/20240102/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+		t.Errorf("Authorization = %q", auth)
+	}
+	// Signing is deterministic, and depends on the secret.
+	again := httptest.NewRequest(http.MethodGet, "http://s3.example.com/bucket/key", nil)
+	store.sign(again, now)
+	store.secretKey = "other"
+	other := httptest.NewRequest(http.MethodGet, "http://s3.example.com/bucket/key", nil)
+	store.sign(other, now)
+	if again.Header.Get("Authorization") != auth || other.Header.Get("Authorization") == auth {
+		t.Error("signature is not a function of the request and the secret")
+	}
+}
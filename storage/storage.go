@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+var (
+	ErrNotFound = errors.New("blob does not exist")
+)
+
+// BlobStore keeps the contents of uploaded files. Keys are opaque,
+// slash-separated names chosen by the caller.
+type BlobStore interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Open returns the BlobStore described by rawUrl, either
+// file://path/to/dir or s3://access:secret@host/bucket?region=...&secure=...
+// Stores reached over HTTP send their requests through transport, or
+// http.DefaultTransport when it is nil.
+func Open(rawUrl string, transport http.RoundTripper) (BlobStore, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		return NewLocalStore(u.Host + u.Path)
+	case "s3":
+		return NewS3Store(u, transport)
+	default:
+		return nil, fmt.Errorf("unsupported storage scheme %q", u.Scheme)
+	}
+}
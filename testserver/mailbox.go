@@ -0,0 +1,49 @@
+package testserver
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bocanada/rest-ws/mail"
+)
+
+// Mailbox is a mail.Mailer that keeps every message for tests to read.
+type Mailbox struct {
+	mu       sync.Mutex
+	messages []mail.Message
+}
+
+func (m *Mailbox) Send(ctx context.Context, msg mail.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns the messages sent so far.
+func (m *Mailbox) Messages() []mail.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]mail.Message(nil), m.messages...)
+}
+
+// WaitFor returns the last message sent to address, waiting up to Timeout
+// for one since the handlers send emails in the background.
+func (m *Mailbox) WaitFor(t testing.TB, address string) mail.Message {
+	t.Helper()
+	deadline := time.Now().Add(Timeout)
+	for {
+		messages := m.Messages()
+		for i := len(messages) - 1; i >= 0; i-- {
+			if messages[i].To == address {
+				return messages[i]
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no email sent to %s", address)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
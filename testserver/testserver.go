@@ -0,0 +1,202 @@
+// Package testserver runs the whole API in-process for tests: the routes of
+// handlers.BindRoutes served by an httptest.Server, backed by an in-memory
+// repository, a temporary blob store, a Mailbox, a LogBuffer and an
+// in-memory span exporter, with helpers to authenticate, call endpoints and
+// listen on the WebSocket.
+package testserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bocanada/rest-ws/database"
+	"github.com/bocanada/rest-ws/handlers"
+	"github.com/bocanada/rest-ws/helpers"
+	"github.com/bocanada/rest-ws/models"
+	"github.com/bocanada/rest-ws/server"
+	"github.com/golang-jwt/jwt"
+	"github.com/segmentio/ksuid"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password is the password of the users made by NewUser.
+const Password = "password"
+
+// Timeout bounds every wait on asynchronous events, such as WebSocket
+// messages and emails.
+var Timeout = 2 * time.Second
+
+type Server struct {
+	URL    string
+	Config *server.Config
+	Broker *server.Broker
+	Repo   *database.MemoryRepository
+	Mail   *Mailbox
+	Logs   *LogBuffer
+	Spans  *tracetest.InMemoryExporter
+
+	t testing.TB
+}
+
+// New starts a server that is shut down when the test ends. configure may
+// change the default configuration before the server is built.
+func New(t testing.TB, configure ...func(cfg *server.Config)) *Server {
+	t.Helper()
+	cfg := server.DefaultConfig()
+	cfg.Port = ":0"
+	cfg.JWTSecret = "test-secret"
+	cfg.TrashRetention = time.Hour
+	cfg.StorageUrl = "file://" + t.TempDir()
+	cfg.MaxUploadSize = 1 << 20
+	cfg.PublicUrl = "http://localhost"
+	for _, c := range configure {
+		c(cfg)
+	}
+	repo := database.NewMemoryRepository()
+	mailbox := &Mailbox{}
+	logs := &LogBuffer{}
+	cfg.LogFormat = "json"
+	spans := tracetest.NewInMemoryExporter()
+	b, err := server.NewServer(context.Background(), cfg,
+		server.WithRepository(repo),
+		server.WithMailer(mailbox),
+		server.WithLogger(server.NewLogger(logs, cfg)),
+		server.WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := b.Handler(handlers.BindRoutes)
+	go b.Hub().Run()
+	for deadline := time.Now().Add(Timeout); !b.Hub().Running(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("hub did not start")
+		}
+	}
+
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+	cfg.PublicUrl = ts.URL
+	return &Server{URL: ts.URL, Config: cfg, Broker: b, Repo: repo, Mail: mailbox, Logs: logs, Spans: spans, t: t}
+}
+
+// Token returns a valid token for userId, whether or not the user exists.
+func (s *Server) Token(userId string) string {
+	s.t.Helper()
+	claims := helpers.NewAppClaims(userId, time.Now().Add(time.Hour))
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(s.Config.JWTSecret))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return token
+}
+
+// NewUser stores a user with a verified email address and Password as
+// password, and returns it along with a token for it.
+func (s *Server) NewUser() (*models.User, string) {
+	s.t.Helper()
+	id := ksuid.New().String()
+	hash, err := bcrypt.GenerateFromPassword([]byte(Password), bcrypt.MinCost)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	user := &models.User{ID: id, Email: "user-" + id + "@example.com", Password: string(hash)}
+	ctx := context.Background()
+	if err = s.Repo.InsertUser(ctx, user); err != nil {
+		s.t.Fatal(err)
+	}
+	if err = s.Repo.MarkEmailVerified(ctx, user.ID); err != nil {
+		s.t.Fatal(err)
+	}
+	return user, s.Token(user.ID)
+}
+
+// Do sends a request to path, authenticated with token unless it is empty.
+// body is sent as is when it is an io.Reader and encoded as JSON otherwise.
+func (s *Server) Do(method string, path string, token string, body any) *http.Response {
+	s.t.Helper()
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		reader = b
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, s.URL+path, reader)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if _, ok := body.(io.Reader); body != nil && !ok {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return resp
+}
+
+// Upload sends content as the "file" part of a multipart form to path, the
+// way browsers upload files.
+func (s *Server) Upload(method string, path string, token string, fileName string, content []byte) *http.Response {
+	s.t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", fileName)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if _, err = part.Write(content); err != nil {
+		s.t.Fatal(err)
+	}
+	if err = form.Close(); err != nil {
+		s.t.Fatal(err)
+	}
+	req, err := http.NewRequest(method, s.URL+path, &body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return resp
+}
+
+// Decode reads the response envelope of resp and closes its body.
+func Decode[T any](t testing.TB, resp *http.Response) models.Response[T] {
+	t.Helper()
+	defer resp.Body.Close()
+	var envelope models.Response[T]
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		t.Fatalf("%s %s: decoding response: %v", resp.Request.Method, resp.Request.URL.Path, err)
+	}
+	return envelope
+}
+
+// Call sends a request like Do and decodes its response envelope.
+func Call[T any](s *Server, method string, path string, token string, body any) (*http.Response, models.Response[T]) {
+	s.t.Helper()
+	resp := s.Do(method, path, token, body)
+	return resp, Decode[T](s.t, resp)
+}
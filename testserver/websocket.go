@@ -0,0 +1,135 @@
+package testserver
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bocanada/rest-ws/models"
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketClient is connected to the hub of a Server and records the
+// messages it receives.
+type WebSocketClient struct {
+	t        testing.TB
+	conn     *websocket.Conn
+	messages chan models.WebSocketMessage
+	// err is the error that ended read, set before messages is closed.
+	err error
+}
+
+// DialWebSocket connects to /ws as the owner of token, or anonymously when
+// it is empty. It returns once the hub has registered the client, so no
+// broadcast made afterwards is missed.
+func (s *Server) DialWebSocket(token string) *WebSocketClient {
+	s.t.Helper()
+	u := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+	if token != "" {
+		u += "?token=" + url.QueryEscape(token)
+	}
+	hub := s.Broker.Hub()
+	connected := hub.Len()
+	conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.t.Cleanup(func() { conn.Close() })
+	deadline := time.Now().Add(Timeout)
+	for hub.Len() <= connected {
+		if time.Now().After(deadline) {
+			s.t.Fatal("websocket client was never registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	c := &WebSocketClient{t: s.t, conn: conn, messages: make(chan models.WebSocketMessage, 64)}
+	go c.read()
+	return c
+}
+
+func (c *WebSocketClient) read() {
+	defer close(c.messages)
+	for {
+		var msg models.WebSocketMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			c.err = err
+			return
+		}
+		c.messages <- msg
+	}
+}
+
+// Expect returns the next message and fails the test unless it arrives
+// within Timeout and has type msgType.
+func (c *WebSocketClient) Expect(msgType string) models.WebSocketMessage {
+	c.t.Helper()
+	select {
+	case msg, ok := <-c.messages:
+		if !ok {
+			c.t.Fatalf("connection closed while waiting for %s", msgType)
+		}
+		if msg.Type != msgType {
+			c.t.Fatalf("got a %s message, want %s", msg.Type, msgType)
+		}
+		return msg
+	case <-time.After(Timeout):
+		c.t.Fatalf("no %s message received", msgType)
+	}
+	return models.WebSocketMessage{}
+}
+
+// ExpectNone fails the test if a message arrives within d.
+func (c *WebSocketClient) ExpectNone(d time.Duration) {
+	c.t.Helper()
+	select {
+	case msg, ok := <-c.messages:
+		if ok {
+			c.t.Fatalf("got an unexpected %s message", msg.Type)
+		}
+	case <-time.After(d):
+	}
+}
+
+// Send writes v to the hub as a JSON message.
+func (c *WebSocketClient) Send(v any) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(v); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// ExpectClosed fails the test unless the hub closes the connection with
+// code within Timeout. Messages received in the meantime are ignored.
+func (c *WebSocketClient) ExpectClosed(code int) {
+	c.t.Helper()
+	timeout := time.After(Timeout)
+	for {
+		select {
+		case _, ok := <-c.messages:
+			if ok {
+				continue
+			}
+			if !websocket.IsCloseError(c.err, code) {
+				c.t.Fatalf("connection closed with %v, want close code %d", c.err, code)
+			}
+			return
+		case <-timeout:
+			c.t.Fatalf("connection not closed, want close code %d", code)
+		}
+	}
+}
+
+// DecodePayload decodes the payload of msg into v.
+func DecodePayload(t testing.TB, msg models.WebSocketMessage, v any) {
+	t.Helper()
+	data, err := json.Marshal(msg.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,63 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 secret of the test vectors of RFC 6238.
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	// The last six digits of the eight digit codes of RFC 6238, appendix B.
+	for unix, want := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1234567890:  "005924",
+		20000000000: "353130",
+	} {
+		got, err := Code(rfcSecret, Step(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Code at %d = %s, want %s", unix, got, want)
+		}
+	}
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("Code with an invalid secret: no error")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	for offset, ok := range map[time.Duration]bool{
+		0:           true,
+		-Period:     true,
+		Period:      true,
+		-2 * Period: false,
+		2 * Period:  false,
+	} {
+		code, _ := Code(secret, Step(now.Add(offset)))
+		step, got := Verify(secret, code, now)
+		if got != ok || (ok && step != Step(now.Add(offset))) {
+			t.Errorf("Verify of the code %s away = %d, %t, want %t", offset, step, got, ok)
+		}
+	}
+	if _, ok := Verify(secret, "12345", now); ok {
+		t.Error("Verify of a short code succeeded")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("rest-ws", "someone@example.com", "SECRET")
+	if !strings.HasPrefix(uri, "otpauth://totp/rest-ws:someone@example.com?") || !strings.Contains(uri, "secret=SECRET") || !strings.Contains(uri, "issuer=rest-ws") {
+		t.Errorf("URI = %s", uri)
+	}
+}
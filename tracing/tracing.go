@@ -0,0 +1,154 @@
+// Package tracing builds the OpenTelemetry spans of the server: one per
+// HTTP request, named after its route template, one per repository call and
+// one per broadcast on the hub. W3C trace context is read from incoming
+// requests and written into outgoing ones.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/bocanada/rest-ws/repository"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	serviceName         = "rest-ws"
+	instrumentationName = "github.com/bocanada/rest-ws"
+)
+
+// Propagator reads and writes W3C trace context and baggage.
+var Propagator propagation.TextMapPropagator = propagation.NewCompositeTextMapPropagator(
+	propagation.TraceContext{},
+	propagation.Baggage{},
+)
+
+// NewOTLPProvider returns a provider exporting spans over OTLP/HTTP to
+// endpoint, such as http://localhost:4318, keeping sampleRatio of the
+// traces that do not already carry a sampling decision.
+func NewOTLPProvider(ctx context.Context, endpoint string, sampleRatio float64, version string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	res := resource.NewSchemaless(
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(version),
+	)
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	), nil
+}
+
+// Tracer returns the tracer of the server from tp.
+func Tracer(tp trace.TracerProvider) trace.Tracer {
+	return tp.Tracer(instrumentationName)
+}
+
+// Middleware starts a server span for every request matched by a mux
+// router, named after the method and route template.
+func Middleware(tp trace.TracerProvider) mux.MiddlewareFunc {
+	return otelmux.Middleware(serviceName,
+		otelmux.WithTracerProvider(tp),
+		otelmux.WithPropagators(Propagator),
+		otelmux.WithSpanNameFormatter(func(route string, r *http.Request) string {
+			return r.Method + " " + route
+		}),
+	)
+}
+
+// Transport wraps rt so that every request it sends gets a client span and
+// carries the trace context of its own context.
+func Transport(rt http.RoundTripper, tp trace.TracerProvider) http.RoundTripper {
+	return otelhttp.NewTransport(rt,
+		otelhttp.WithTracerProvider(tp),
+		otelhttp.WithPropagators(Propagator),
+	)
+}
+
+// InstrumentRepository returns repo with a span around every call,
+// carrying the SQL operation the call performs.
+func InstrumentRepository(repo repository.Repository, tp trace.TracerProvider) repository.Repository {
+	tracer := Tracer(tp)
+	return repository.Instrument(repo, func(ctx context.Context, method string) (context.Context, func(err error)) {
+		ctx, span := tracer.Start(ctx, "repository."+method,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.operation", sqlOperation(method)),
+				attribute.String("code.function", method),
+			),
+		)
+		return ctx, func(err error) {
+			if err != nil {
+				span.RecordError(err)
+				if !expectedError(err) {
+					span.SetStatus(codes.Error, err.Error())
+				}
+			}
+			span.End()
+		}
+	})
+}
+
+// operationPrefixes maps the verbs starting the names of repository
+// methods to the SQL statement they mostly run.
+var operationPrefixes = []struct {
+	prefix    string
+	operation string
+}{
+	{"Get", "SELECT"},
+	{"List", "SELECT"},
+	{"Is", "SELECT"},
+	{"Count", "SELECT"},
+	{"Insert", "INSERT"},
+	{"Follow", "INSERT"},
+	{"Record", "INSERT"},
+	{"Update", "UPDATE"},
+	{"Set", "UPDATE"},
+	{"Mark", "UPDATE"},
+	{"Consume", "UPDATE"},
+	{"Enable", "UPDATE"},
+	{"Use", "UPDATE"},
+	{"Lock", "UPDATE"},
+	{"Restore", "UPDATE"},
+	{"Publish", "UPDATE"},
+	{"Delete", "DELETE"},
+	{"Purge", "DELETE"},
+	{"Unfollow", "DELETE"},
+	{"Clear", "DELETE"},
+}
+
+func sqlOperation(method string) string {
+	// Deleted posts go to the trash.
+	if method == "DeletePost" {
+		return "UPDATE"
+	}
+	for _, p := range operationPrefixes {
+		if strings.HasPrefix(method, p.prefix) {
+			return p.operation
+		}
+	}
+	return "OTHER"
+}
+
+// expectedError reports whether err is a repository answer handlers turn
+// into a client error, rather than a failure of the store.
+func expectedError(err error) bool {
+	return errors.Is(err, repository.ErrNotFound) ||
+		errors.Is(err, repository.ErrConflict) ||
+		errors.Is(err, repository.ErrVersionMismatch)
+}
@@ -0,0 +1,109 @@
+// Package validation checks decoded requests field by field and reports
+// every problem at once, in a form clients can act on.
+package validation
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bocanada/rest-ws/models"
+)
+
+const (
+	CodeRequired      = "required"
+	CodeTooShort      = "too_short"
+	CodeTooLong       = "too_long"
+	CodeInvalidEmail  = "invalid_email"
+	CodeInvalidChoice = "invalid_choice"
+	CodeInvalidFormat = "invalid_format"
+	CodeOutOfRange    = "out_of_range"
+)
+
+// Errors lists the invalid fields of a request.
+type Errors []models.FieldError
+
+func (e Errors) Error() string {
+	fields := make([]string, 0, len(e))
+	for _, err := range e {
+		fields = append(fields, err.Field+": "+err.Message)
+	}
+	return "invalid request: " + strings.Join(fields, "; ")
+}
+
+// Validatable is implemented by request types that can check themselves.
+type Validatable interface {
+	Validate() error
+}
+
+// Validator collects field errors. Only the first failed check of each field
+// is recorded, so clients get one actionable message per field.
+type Validator struct {
+	errs Errors
+}
+
+func (v *Validator) failed(field string) bool {
+	for _, err := range v.errs {
+		if err.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Check records an error for field unless ok holds.
+func (v *Validator) Check(ok bool, field string, code string, message string) {
+	if ok || v.failed(field) {
+		return
+	}
+	v.errs = append(v.errs, models.FieldError{Field: field, Code: code, Message: message})
+}
+
+func (v *Validator) Required(field string, value string) {
+	v.Check(strings.TrimSpace(value) != "", field, CodeRequired, "is required")
+}
+
+func (v *Validator) MinLength(field string, value string, min int) {
+	v.Check(utf8.RuneCountInString(value) >= min, field, CodeTooShort, fmt.Sprintf("must be at least %d characters long", min))
+}
+
+func (v *Validator) MaxLength(field string, value string, max int) {
+	v.Check(utf8.RuneCountInString(value) <= max, field, CodeTooLong, fmt.Sprintf("must be at most %d characters long", max))
+}
+
+// MaxBytes limits the encoded size of value, for limits that are not about
+// characters such as bcrypt's 72 bytes.
+func (v *Validator) MaxBytes(field string, value string, max int) {
+	v.Check(len(value) <= max, field, CodeTooLong, fmt.Sprintf("must be at most %d bytes long", max))
+}
+
+// Email accepts a bare address. Surrounding whitespace is allowed, callers
+// are expected to normalise it away.
+func (v *Validator) Email(field string, value string) {
+	value = strings.TrimSpace(value)
+	addr, err := mail.ParseAddress(value)
+	v.Check(err == nil && addr.Address == value, field, CodeInvalidEmail, "must be a valid email address")
+}
+
+func (v *Validator) OneOf(field string, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.Check(false, field, CodeInvalidChoice, "must be one of "+strings.Join(allowed, ", "))
+}
+
+func (v *Validator) Matches(field string, value string, re *regexp.Regexp, message string) {
+	v.Check(re.MatchString(value), field, CodeInvalidFormat, message)
+}
+
+// Err returns the collected Errors, or nil when every check passed.
+func (v *Validator) Err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
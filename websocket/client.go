@@ -1,21 +1,67 @@
 package websocket
 
 import (
+	"log/slog"
+	"time"
+
+	"github.com/bocanada/rest-ws/ratelimit"
 	"github.com/gorilla/websocket"
+	"github.com/segmentio/ksuid"
 )
 
+// closeTimeout bounds the close frame sent to a client going over its
+// message limit.
+const closeTimeout = time.Second
+
 type Client struct {
 	hub      *Hub
 	id       string
+	userId   string
 	socket   *websocket.Conn
 	outbound chan []byte
+	logger   *slog.Logger
+	// done is closed by Read once the client stops reading.
+	done chan struct{}
+
+	// disconnectReason is set by Write before it unregisters the client.
+	disconnectReason string
+	// readReason is set by Read before it closes done.
+	readReason string
 }
 
-func NewClient(hub *Hub, socket *websocket.Conn) *Client {
+func NewClient(hub *Hub, socket *websocket.Conn, userId string) *Client {
 	return &Client{
 		hub:      hub,
+		id:       ksuid.New().String(),
+		userId:   userId,
+		logger:   hub.logger,
 		socket:   socket,
-		outbound: make(chan []byte),
+		outbound: make(chan []byte, hub.sendBuffer),
+		done:     make(chan struct{}),
+	}
+}
+
+// Read consumes the messages of the client, which the hub has no use for,
+// until the connection closes or the client sends more than
+// Options.MessageLimit of them per Options.MessagePeriod.
+func (c *Client) Read() {
+	defer close(c.done)
+	var bucket *ratelimit.Bucket
+	if opts := c.hub.opts; opts.MessageLimit > 0 {
+		bucket = ratelimit.NewBucket(opts.MessageLimit, opts.MessagePeriod)
+	}
+	for {
+		if _, _, err := c.socket.ReadMessage(); err != nil {
+			c.readReason = DisconnectClientClosed
+			return
+		}
+		if bucket != nil && !bucket.Take() {
+			c.logger.Warn("websocket message rate exceeded", "limit", c.hub.opts.MessageLimit, "period", c.hub.opts.MessagePeriod)
+			message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limited")
+			c.socket.WriteControl(websocket.CloseMessage, message, time.Now().Add(closeTimeout))
+			c.readReason = DisconnectRateLimited
+			return
+		}
 	}
 }
 
@@ -28,11 +74,16 @@ func (c *Client) Write() {
 		select {
 		case message, ok := <-c.outbound:
 			if !ok {
+				c.disconnectReason = DisconnectClosed
 				return
 			}
 			if err := c.socket.WriteMessage(websocket.TextMessage, message); err != nil {
+				c.disconnectReason = DisconnectWriteError
 				return
 			}
+		case <-c.done:
+			c.disconnectReason = c.readReason
+			return
 		}
 	}
 }
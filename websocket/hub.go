@@ -2,64 +2,143 @@ package websocket
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bocanada/rest-ws/helpers"
+	"github.com/bocanada/rest-ws/models"
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+// Options sizes the buffers of a Hub. Zero buffer sizes use the defaults of
+// gorilla/websocket. Messages for a client whose send buffer is full are
+// dropped, except with a zero SendBufferSize, which makes every send wait
+// for the client to take the message.
+type Options struct {
+	ReadBufferSize  int
+	WriteBufferSize int
+	SendBufferSize  int
+	// MessageLimit is the number of messages a client may send per
+	// MessagePeriod before it is disconnected, 0 for no limit.
+	MessageLimit  int
+	MessagePeriod time.Duration
+	// Logger receives the connection logs, slog.Default() when nil.
+	Logger *slog.Logger
 }
 
+// Audience selects the users a broadcast is delivered to. Anonymous clients
+// are passed an empty user id.
+type Audience func(userId string) bool
+
 type Hub struct {
+	upgrader   websocket.Upgrader
+	sendBuffer int
+	opts       Options
+	logger     *slog.Logger
 	clients    []*Client
 	register   chan *Client
 	unregister chan *Client
 	mutex      *sync.Mutex
+	running    int32
+
+	broadcasts  uint64
+	dropped     uint64
+	disconnects map[string]uint64
+}
+
+// Disconnect reasons reported in Stats.
+const (
+	DisconnectClosed       = "closed"
+	DisconnectWriteError   = "write_error"
+	DisconnectClientClosed = "client_closed"
+	DisconnectRateLimited  = "rate_limited"
+)
+
+// DisconnectReasons lists every reason a client may be disconnected for.
+var DisconnectReasons = []string{
+	DisconnectClosed,
+	DisconnectWriteError,
+	DisconnectClientClosed,
+	DisconnectRateLimited,
+}
+
+// Stats is a snapshot of the activity of a Hub. Counters start at zero when
+// the hub is created.
+type Stats struct {
+	Clients int
+	// QueueDepth is the number of messages waiting in the send buffers.
+	QueueDepth  int
+	Broadcasts  uint64
+	Dropped     uint64
+	Disconnects map[string]uint64
 }
 
-func NewHub() *Hub {
+func NewHub(opts Options) *Hub {
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
 	return &Hub{
-		clients:    make([]*Client, 0),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		mutex:      &sync.Mutex{},
+		logger: logger,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  opts.ReadBufferSize,
+			WriteBufferSize: opts.WriteBufferSize,
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		},
+		sendBuffer:  opts.SendBufferSize,
+		opts:        opts,
+		clients:     make([]*Client, 0),
+		register:    make(chan *Client),
+		unregister:  make(chan *Client),
+		mutex:       &sync.Mutex{},
+		disconnects: make(map[string]uint64),
 	}
 }
 
 func (hub *Hub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	socket, err := upgrader.Upgrade(w, r, nil)
+	hub.Connect(w, r, "")
+}
+
+// Connect upgrades the request and registers the socket as belonging to
+// userId, which may be empty for anonymous clients.
+func (hub *Hub) Connect(w http.ResponseWriter, r *http.Request, userId string) {
+	logger := hub.logger
+	if id := helpers.RequestId(r.Context()); id != "" {
+		logger = logger.With("request_id", id)
+	}
+	socket, err := hub.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("HandleWebSocket: ", err)
-		helpers.NewResponseError(err).Send(w, http.StatusBadRequest)
+		logger.Warn("websocket upgrade failed", "error", err)
+		helpers.SendError(w, r, models.ErrBadRequest.Wrap(err))
 		return
 	}
-	client := NewClient(hub, socket)
+	client := NewClient(hub, socket, userId)
+	client.logger = logger.With("connection_id", client.id, "user_id", userId, "remote_addr", socket.RemoteAddr().String())
 	hub.register <- client
+	go client.Read()
 	go client.Write()
 }
 
 func (hub *Hub) onConnect(client *Client) {
-	log.Println("Client connected: ", client.socket.RemoteAddr(), len(hub.clients))
 	hub.mutex.Lock()
 	defer hub.mutex.Unlock()
-	client.id = client.socket.RemoteAddr().String()
 	hub.clients = append(hub.clients, client)
-	log.Println("Assigned id: ", client.id)
-
+	client.logger.Info("websocket connected", "clients", len(hub.clients))
 }
 
 func (hub *Hub) onDisconnect(client *Client) {
-	log.Println("Client disconnected: ", client.socket.RemoteAddr())
 	client.socket.Close()
 	hub.mutex.Lock()
 	defer hub.mutex.Unlock()
+	hub.disconnects[client.disconnectReason]++
+	defer func() {
+		client.logger.Info("websocket disconnected", "reason", client.disconnectReason, "clients", len(hub.clients))
+	}()
 	i := -1
 	for j, c := range hub.clients {
 		if c.id == client.id {
@@ -73,6 +152,8 @@ func (hub *Hub) onDisconnect(client *Client) {
 }
 
 func (hub *Hub) Run() {
+	atomic.StoreInt32(&hub.running, 1)
+	defer atomic.StoreInt32(&hub.running, 0)
 	for {
 		select {
 		case client := <-hub.register:
@@ -83,13 +164,76 @@ func (hub *Hub) Run() {
 	}
 }
 
-func (hub *Hub) Broadcast(message any, ignore *Client) {
-	data, _ := json.Marshal(message)
+// Broadcast delivers message to every client but ignore, and returns the
+// number of clients it was queued for.
+func (hub *Hub) Broadcast(message any, ignore *Client) int {
+	return hub.send(message, func(c *Client) bool {
+		return ignore == nil || c.id != ignore.id
+	})
+}
+
+// BroadcastTo delivers message only to the clients whose user is part of
+// audience, and returns the number of clients it was queued for.
+func (hub *Hub) BroadcastTo(message any, audience Audience) int {
+	return hub.send(message, func(c *Client) bool {
+		return audience(c.userId)
+	})
+}
+
+// Running reports whether Run is accepting clients.
+func (hub *Hub) Running() bool {
+	return atomic.LoadInt32(&hub.running) == 1
+}
+
+func (hub *Hub) Stats() Stats {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	stats := Stats{
+		Clients:     len(hub.clients),
+		Broadcasts:  atomic.LoadUint64(&hub.broadcasts),
+		Dropped:     atomic.LoadUint64(&hub.dropped),
+		Disconnects: make(map[string]uint64, len(hub.disconnects)),
+	}
 	for _, c := range hub.clients {
-		if ignore != nil && c.id == ignore.id {
+		stats.QueueDepth += len(c.outbound)
+	}
+	for reason, n := range hub.disconnects {
+		stats.Disconnects[reason] = n
+	}
+	return stats
+}
+
+// Len returns the number of connected clients.
+func (hub *Hub) Len() int {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	return len(hub.clients)
+}
+
+func (hub *Hub) send(message any, include func(c *Client) bool) int {
+	data, _ := json.Marshal(message)
+	atomic.AddUint64(&hub.broadcasts, 1)
+	hub.mutex.Lock()
+	clients := append([]*Client(nil), hub.clients...)
+	hub.mutex.Unlock()
+	queued := 0
+	for _, c := range clients {
+		if !include(c) {
 			continue
 		}
 		c.socket.SetWriteDeadline(time.Now().Add(10 * time.Second))
-		c.outbound <- data
+		if hub.sendBuffer == 0 {
+			c.outbound <- data
+			queued++
+			continue
+		}
+		select {
+		case c.outbound <- data:
+			queued++
+		default:
+			atomic.AddUint64(&hub.dropped, 1)
+			c.logger.Warn("websocket message dropped", "reason", "send buffer full")
+		}
 	}
+	return queued
 }